@@ -1,7 +1,11 @@
 package main
 
-import "github.com/platput/sockv5er/utils"
+import (
+	"os"
+
+	"github.com/platput/sockv5er/utils"
+)
 
 func main() {
-	utils.StartWorker()
+	os.Exit(utils.RunCLI(os.Args[1:]))
 }
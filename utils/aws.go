@@ -11,40 +11,76 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go/aws"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sort"
 	"strings"
 	"time"
 )
 
+// The tags put on every EC2 resource, so that `cleanup --scan-all-regions` finds them without resources.yaml.
+const (
+	awsTagSession   = "sockv5er:session"
+	awsTagOwner     = "sockv5er:owner"
+	awsTagCreatedAt = "sockv5er:created-at"
+)
+
+// The intents recorded in resources.yaml while a resource is being created.
+const (
+	awsIntentSecurityGroup = "security-group"
+	awsIntentKeyPair       = "key-pair"
+	awsIntentInstance      = "instance"
+)
+
 type AWSRepository struct {
 	Client          *ec2.Client
 	Region          string
+	Session         string
+	Intent          string
 	KeyPairId       string
 	SecurityGroupID string
 	defaultVPCID    string
 	Ec2InstanceId   string
 	InstanceIP      string
 	KeyPairKey      string
+	HostKey         *HostKey
+	gracePeriod     time.Duration
+	owner           string
+	createdAt       time.Time
+	pollInterval    time.Duration
 }
 
 func NewAWSProvider() CloudProvider {
-	return &AWSRepository{}
+	return &AWSRepository{pollInterval: 5 * time.Second}
 }
 
-func (repo *AWSRepository) UpdateTracker(resources map[string]string, op TrackingOp, tracker *ResourceTracker) {
-	awsResource := FromMap(resources)
-	if op == Add {
-		tracker.AddAWSResource(awsResource)
-	} else if op == Remove {
-		tracker.RemoveAWSResource(awsResource)
-	}
-	err := tracker.WriteResourcesFile()
-	if err != nil {
-		log.Warnf("Updating resources tracker file failed with err: %s.", err)
-	}
+func (repo *AWSRepository) trackedResource() TrackedResource {
+	return TrackedResource{Kind: ProviderAWS, AWS: &AWSResource{
+		Region:          repo.Region,
+		Session:         repo.Session,
+		Intent:          repo.Intent,
+		InstanceId:      repo.Ec2InstanceId,
+		SecurityGroupId: repo.SecurityGroupID,
+		KeyPairId:       repo.KeyPairId,
+	}}
+}
+
+// createTracked records the intent to create a resource in resources.yaml before create calls EC2, and the
+// resource once it's created. A crash in between leaves the intent, DeleteResources then finds the resource
+// by the session tag. The intent also stays when create fails, the resource may exist anyway.
+func (repo *AWSRepository) createTracked(tracker *ResourceTracker, intent string, create func() error) error {
+	repo.Intent = intent
+	tracker.Update(repo.trackedResource(), Add)
+	err := create()
+	if err == nil {
+		repo.Intent = ""
+	}
+	tracker.Update(repo.trackedResource(), Add)
+	return err
 }
 
-func (repo *AWSRepository) Initialize(s *Settings) error {
-	client, err := getEC2Client(s)
+func (repo *AWSRepository) Initialize(ctx context.Context, s *Settings) error {
+	client, err := getEC2Client(ctx, s)
 	if err != nil {
 		return err
 	}
@@ -52,9 +88,9 @@ func (repo *AWSRepository) Initialize(s *Settings) error {
 	return nil
 }
 
-func getEC2Client(settings *Settings) (*ec2.Client, error) {
+func getEC2Client(ctx context.Context, settings *Settings) (*ec2.Client, error) {
 	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
+		ctx,
 		config.WithCredentialsProvider(
 			credentials.NewStaticCredentialsProvider(settings.AccessKeyId, settings.SecretKey, "")))
 	if err != nil {
@@ -64,86 +100,123 @@ func getEC2Client(settings *Settings) (*ec2.Client, error) {
 	}
 }
 
-func (repo *AWSRepository) GetRegions(s *Settings) []map[string]string {
-	result, err := repo.Client.DescribeRegions(context.TODO(), &ec2.DescribeRegionsInput{})
+func (repo *AWSRepository) GetRegions(ctx context.Context, s *Settings) []Region {
+	result, err := repo.Client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
 	if err != nil {
-		return []map[string]string{}
+		return []Region{}
 	}
 	regions := result.Regions
 	gh := GeoHelper{Settings: s}
-	cloudAgnosticRegions := make([]map[string]string, 0)
-	for i := range regions {
-		country, err := gh.FindCountry(*regions[i].Endpoint)
+	// The endpoints are resolved, looked up and dialed for every region, which is slow one by one.
+	found := make([]*Region, len(regions))
+	forEachConcurrently(len(regions), maxConcurrentRegions, func(i int) {
+		country, countryCode, err := gh.FindLocation(*regions[i].Endpoint)
 		if err != nil {
 			log.Warnf("Finding country for endpoint %s failed with error %v\n", *regions[i].Endpoint, err)
-		} else {
-			country := gh.GetCountryShortName(country)
-			countryToRegionMap := map[string]string{
-				"country": country,
-				"Region":  *regions[i].RegionName,
-			}
-			cloudAgnosticRegions = append(cloudAgnosticRegions, countryToRegionMap)
+			return
+		}
+		found[i] = &Region{
+			ID:          *regions[i].RegionName,
+			Country:     gh.GetCountryShortName(country),
+			CountryCode: countryCode,
+			Latency:     measureLatency(ctx, *regions[i].Endpoint),
+		}
+	})
+	cloudAgnosticRegions := make([]Region, 0)
+	for _, region := range found {
+		if region != nil {
+			cloudAgnosticRegions = append(cloudAgnosticRegions, *region)
 		}
 	}
 	return cloudAgnosticRegions
 }
 
-func (repo *AWSRepository) CreateResources(region string, s *Settings, tracker *ResourceTracker) error {
-	err := repo.SetRegion(region, s)
+// measureLatency is the time it takes to connect to the https port of the endpoint, zero when it can't be reached.
+func measureLatency(ctx context.Context, endpoint string) time.Duration {
+	start := time.Now()
+	dialer := net.Dialer{Timeout: 2 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(endpoint, "443"))
+	if err != nil {
+		return 0
+	}
+	_ = conn.Close()
+	return time.Since(start)
+}
+
+// CreateResources creates the security group, the key pair and the instance, all of them tagged with the session.
+// Each of them is tracked as soon as it exists.
+func (repo *AWSRepository) CreateResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	err := repo.SetRegion(ctx, region, s)
 	if err != nil {
-		resource := ToMap(FromAWSRepository(repo))
-		repo.UpdateTracker(resource, Add, tracker)
 		return err
 	}
 	log.Infof("Region set as: `%s`.\n", repo.Region)
-	err = repo.CreateSecurityGroup()
+	repo.gracePeriod = s.InstanceGracePeriod
+	repo.Session, err = randomSuffix()
+	if err != nil {
+		return err
+	}
+	repo.owner = sessionOwner()
+	repo.createdAt = time.Now().UTC()
+	err = repo.createTracked(tracker, awsIntentSecurityGroup, func() error { return repo.CreateSecurityGroup(ctx) })
 	if err != nil {
-		resource := ToMap(FromAWSRepository(repo))
-		repo.UpdateTracker(resource, Add, tracker)
 		return err
 	}
 	log.Infof("Security Group with ID: `%s` created.\n", repo.SecurityGroupID)
-	err = repo.CreateKeyPair()
+	err = repo.createTracked(tracker, awsIntentKeyPair, func() error { return repo.CreateKeyPair(ctx) })
 	if err != nil {
-		resource := ToMap(FromAWSRepository(repo))
-		repo.UpdateTracker(resource, Add, tracker)
 		return err
 	}
 	log.Infof("Key Pair: `%s` created.\n", repo.KeyPairId)
-	instanceId, err := repo.CreateEC2Instance()
+	repo.HostKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	log.Infof("Host key with fingerprint `%s` generated for the instance.\n", repo.HostKey.Fingerprint())
+	err = repo.createTracked(tracker, awsIntentInstance, func() error {
+		var err error
+		repo.Ec2InstanceId, err = repo.CreateEC2Instance(ctx)
+		return err
+	})
 	if err != nil {
-		resource := ToMap(FromAWSRepository(repo))
-		repo.UpdateTracker(resource, Add, tracker)
 		return err
 	}
-	repo.Ec2InstanceId = instanceId
 	log.Infof("Instance with id: `%s` created.\n", repo.Ec2InstanceId)
-	resource := ToMap(FromAWSRepository(repo))
-	repo.UpdateTracker(resource, Add, tracker)
-	repo.WaitUntilInstanceIsActive(repo.Ec2InstanceId)
-	repo.InstanceIP, err = repo.getPublicIPAddress(instanceId)
+	err = repo.WaitUntilInstanceIsActive(ctx, repo.Ec2InstanceId)
 	if err != nil {
-		log.Fatalf("Unknown error occured while trying to create EC2 Instance. Details: %s", err)
+		return err
 	}
-	return nil
+	repo.InstanceIP, err = repo.getPublicIPAddress(ctx, repo.Ec2InstanceId)
+	return err
 }
 
-func (repo *AWSRepository) DeleteResources(region string, s *Settings, tracker *ResourceTracker) error {
-	err := repo.SetRegion(region, s)
+func (repo *AWSRepository) DeleteResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	err := repo.SetRegion(ctx, region, s)
 	if err != nil {
 		return err
 	}
+	if repo.Intent != "" {
+		err = repo.resolveIntent(ctx)
+		if err != nil {
+			log.Warnf("Finding the resources of the session `%s` failed with error: %s", repo.Session, err)
+			return err
+		}
+	}
 	if repo.Ec2InstanceId != "" {
-		err = repo.TerminateEC2Instance(repo.Ec2InstanceId)
+		err = repo.TerminateEC2Instance(ctx, repo.Ec2InstanceId)
 		if err != nil {
 			log.Warnf("EC2 instance termination failed with error: %s", err)
 			return err
 		}
 		log.Infof("EC2 instance with ID: `%s` terminated.\n", repo.Ec2InstanceId)
-		repo.WaitUntilInstanceIsTerminated(repo.Ec2InstanceId)
+		// The security group can't be deleted while the instance is using it.
+		err = repo.WaitUntilInstanceIsTerminated(ctx, repo.Ec2InstanceId)
+		if err != nil {
+			return err
+		}
 	}
 	if repo.KeyPairId != "" {
-		err = repo.DeleteKeyPair(repo.KeyPairId)
+		err = repo.DeleteKeyPair(ctx, repo.KeyPairId)
 		if err != nil {
 			log.Warnf("EC2 key pair deletion failed with error: %s", err)
 			return err
@@ -151,21 +224,42 @@ func (repo *AWSRepository) DeleteResources(region string, s *Settings, tracker *
 		log.Infof("Key Pair: `%s` deleted.\n", repo.KeyPairId)
 	}
 	if repo.SecurityGroupID != "" {
-		err = repo.DeleteSecurityGroup(repo.SecurityGroupID)
+		err = repo.DeleteSecurityGroup(ctx, repo.SecurityGroupID)
 		if err != nil {
 			log.Warnf("EC2 security group deletion failed with error: %s", err)
 			return err
 		}
 		log.Infof("Security group with id: `%s` deleted.\n", repo.SecurityGroupID)
 	}
-	resource := ToMap(FromAWSRepository(repo))
-	repo.UpdateTracker(resource, Remove, tracker)
+	tracker.Update(repo.trackedResource(), Remove)
+	return nil
+}
+
+// resolveIntent fills in the ids the session is missing from the resources tagged with it, the ones whose
+// creation was recorded as an intent but not as done.
+func (repo *AWSRepository) resolveIntent(ctx context.Context) error {
+	found, err := repo.findTaggedResources(ctx, repo.Session, "")
+	if err != nil {
+		return err
+	}
+	for _, resource := range found {
+		if repo.Ec2InstanceId == "" {
+			repo.Ec2InstanceId = resource.AWS.InstanceId
+		}
+		if repo.SecurityGroupID == "" {
+			repo.SecurityGroupID = resource.AWS.SecurityGroupId
+		}
+		if repo.KeyPairId == "" {
+			repo.KeyPairId = resource.AWS.KeyPairId
+		}
+	}
+	repo.Intent = ""
 	return nil
 }
 
-func (repo *AWSRepository) SetRegion(region string, s *Settings) error {
+func (repo *AWSRepository) SetRegion(ctx context.Context, region string, s *Settings) error {
 	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
+		ctx,
 		config.WithCredentialsProvider(
 			credentials.NewStaticCredentialsProvider(s.AccessKeyId, s.SecretKey, "")),
 		config.WithRegion(region))
@@ -177,15 +271,17 @@ func (repo *AWSRepository) SetRegion(region string, s *Settings) error {
 	return nil
 }
 
-func (repo *AWSRepository) PrepareResourcesForDeletion(resource map[string]string) {
-	res := FromMap(resource)
+func (repo *AWSRepository) PrepareResourcesForDeletion(resource TrackedResource) {
+	res := resource.AWS
 	repo.Region = res.Region
+	repo.Session = res.Session
+	repo.Intent = res.Intent
 	repo.Ec2InstanceId = res.InstanceId
 	repo.KeyPairId = res.KeyPairId
 	repo.SecurityGroupID = res.SecurityGroupId
 }
 
-func (repo *AWSRepository) GetDefaultVPC() error {
+func (repo *AWSRepository) GetDefaultVPC(ctx context.Context) error {
 	isDefaultFilter := types.Filter{
 		Name:   aws.String("is-default"),
 		Values: []string{"true"},
@@ -194,7 +290,7 @@ func (repo *AWSRepository) GetDefaultVPC() error {
 	vpcInput := &ec2.DescribeVpcsInput{
 		Filters: filters,
 	}
-	vpcs, err := repo.Client.DescribeVpcs(context.TODO(), vpcInput)
+	vpcs, err := repo.Client.DescribeVpcs(ctx, vpcInput)
 	if err != nil {
 		return err
 	} else {
@@ -207,12 +303,15 @@ func (repo *AWSRepository) GetDefaultVPC() error {
 	return errors.New(errorMessage)
 }
 
-func (repo *AWSRepository) CreateEC2Instance() (string, error) {
-	userdata := fmt.Sprintf("#!/bin/bash\nshutdown +20")
+func (repo *AWSRepository) CreateEC2Instance(ctx context.Context) (string, error) {
+	userdata, err := CloudInitUserData(repo.HostKey, repo.gracePeriod)
+	if err != nil {
+		return "", err
+	}
 	encodedUserdata := base64.StdEncoding.EncodeToString([]byte(userdata))
 	var maxCount int32 = 1
 	var minCount int32 = 1
-	var keyName = fmt.Sprintf("sockv5er-keypair-%s", repo.Region)
+	var keyName = repo.keyPairName()
 	instanceInput := &ec2.RunInstancesInput{
 		ImageId:                           aws.String("resolve:ssm:/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-x86_64-gp2"),
 		InstanceInitiatedShutdownBehavior: "terminate",
@@ -222,15 +321,16 @@ func (repo *AWSRepository) CreateEC2Instance() (string, error) {
 		UserData:                          aws.String(encodedUserdata),
 		MaxCount:                          &maxCount,
 		MinCount:                          &minCount,
+		TagSpecifications:                 repo.tagSpecifications(types.ResourceTypeInstance, types.ResourceTypeVolume),
 	}
-	instance, err := repo.Client.RunInstances(context.TODO(), instanceInput)
+	instance, err := repo.Client.RunInstances(ctx, instanceInput)
 	if err != nil {
 		return "", err
 	}
 	return *instance.Instances[0].InstanceId, nil
 }
 
-func (repo *AWSRepository) CreateSecurityGroup() error {
+func (repo *AWSRepository) CreateSecurityGroup(ctx context.Context) error {
 	// Get the external ip of the system
 	externalIP, err := GetExternalIP()
 	if err != nil {
@@ -238,14 +338,15 @@ func (repo *AWSRepository) CreateSecurityGroup() error {
 	} else {
 		externalIP = externalIP + "/32"
 	}
-	groupName := fmt.Sprintf("sockv5er-sg-group-%s", repo.Region)
+	groupName := fmt.Sprintf("sockv5er-sg-group-%s-%s", repo.Region, repo.Session)
 	description := fmt.Sprintf("Security group created by sockv5er for the Region %s with just ssh enabled.", repo.Region)
 	sgInput := &ec2.CreateSecurityGroupInput{
-		GroupName:   aws.String(groupName),
-		Description: aws.String(description),
-		VpcId:       aws.String(repo.defaultVPCID),
+		GroupName:         aws.String(groupName),
+		Description:       aws.String(description),
+		VpcId:             aws.String(repo.defaultVPCID),
+		TagSpecifications: repo.tagSpecifications(types.ResourceTypeSecurityGroup),
 	}
-	group, err := repo.Client.CreateSecurityGroup(context.TODO(), sgInput)
+	group, err := repo.Client.CreateSecurityGroup(ctx, sgInput)
 	if err != nil {
 		return err
 	}
@@ -257,7 +358,7 @@ func (repo *AWSRepository) CreateSecurityGroup() error {
 		IpProtocol: aws.String("tcp"),
 		ToPort:     aws.Int32(22),
 	}
-	_, err = repo.Client.AuthorizeSecurityGroupIngress(context.TODO(), sgIngressInput)
+	_, err = repo.Client.AuthorizeSecurityGroupIngress(ctx, sgIngressInput)
 	if err != nil {
 		log.Error("Error opening port 22 using security group:", err)
 		return err
@@ -265,12 +366,31 @@ func (repo *AWSRepository) CreateSecurityGroup() error {
 	return nil
 }
 
-func (repo *AWSRepository) CreateKeyPair() error {
-	keyName := fmt.Sprintf("sockv5er-keypair-%s", repo.Region)
+// keyPairName is unique per session, a key pair left behind by another session doesn't get in the way.
+func (repo *AWSRepository) keyPairName() string {
+	return fmt.Sprintf("sockv5er-keypair-%s-%s", repo.Region, repo.Session)
+}
+
+// tagSpecifications tags the resources of the given types with the session, its owner and when it was created.
+func (repo *AWSRepository) tagSpecifications(resourceTypes ...types.ResourceType) []types.TagSpecification {
+	tags := []types.Tag{
+		{Key: aws.String(awsTagSession), Value: aws.String(repo.Session)},
+		{Key: aws.String(awsTagOwner), Value: aws.String(repo.owner)},
+		{Key: aws.String(awsTagCreatedAt), Value: aws.String(repo.createdAt.Format(time.RFC3339))},
+	}
+	specifications := make([]types.TagSpecification, 0, len(resourceTypes))
+	for _, resourceType := range resourceTypes {
+		specifications = append(specifications, types.TagSpecification{ResourceType: resourceType, Tags: tags})
+	}
+	return specifications
+}
+
+func (repo *AWSRepository) CreateKeyPair(ctx context.Context) error {
 	keypairInput := &ec2.CreateKeyPairInput{
-		KeyName: aws.String(keyName),
+		KeyName:           aws.String(repo.keyPairName()),
+		TagSpecifications: repo.tagSpecifications(types.ResourceTypeKeyPair),
 	}
-	keypair, err := repo.Client.CreateKeyPair(context.TODO(), keypairInput)
+	keypair, err := repo.Client.CreateKeyPair(ctx, keypairInput)
 	if err != nil {
 		return err
 	}
@@ -279,9 +399,9 @@ func (repo *AWSRepository) CreateKeyPair() error {
 	return nil
 }
 
-func (repo *AWSRepository) DeleteKeyPair(keyPairId string) error {
+func (repo *AWSRepository) DeleteKeyPair(ctx context.Context, keyPairId string) error {
 	keypairInput := &ec2.DeleteKeyPairInput{KeyPairId: aws.String(keyPairId)}
-	_, err := repo.Client.DeleteKeyPair(context.TODO(), keypairInput)
+	_, err := repo.Client.DeleteKeyPair(ctx, keypairInput)
 	if err != nil {
 		if strings.Contains(err.Error(), "InvalidKeyPair.NotFound") {
 			return nil
@@ -291,11 +411,11 @@ func (repo *AWSRepository) DeleteKeyPair(keyPairId string) error {
 	return nil
 }
 
-func (repo *AWSRepository) DeleteSecurityGroup(securityGroupId string) error {
+func (repo *AWSRepository) DeleteSecurityGroup(ctx context.Context, securityGroupId string) error {
 	sgInput := &ec2.DeleteSecurityGroupInput{
 		GroupId: aws.String(securityGroupId),
 	}
-	_, err := repo.Client.DeleteSecurityGroup(context.TODO(), sgInput)
+	_, err := repo.Client.DeleteSecurityGroup(ctx, sgInput)
 	if err != nil {
 		if strings.Contains(err.Error(), "InvalidGroup.NotFound") {
 			return nil
@@ -305,11 +425,11 @@ func (repo *AWSRepository) DeleteSecurityGroup(securityGroupId string) error {
 	return nil
 }
 
-func (repo *AWSRepository) TerminateEC2Instance(instanceId string) error {
+func (repo *AWSRepository) TerminateEC2Instance(ctx context.Context, instanceId string) error {
 	instanceInput := &ec2.TerminateInstancesInput{
 		InstanceIds: []string{instanceId},
 	}
-	_, err := repo.Client.TerminateInstances(context.TODO(), instanceInput)
+	_, err := repo.Client.TerminateInstances(ctx, instanceInput)
 	if err != nil {
 		if err != nil {
 			if strings.Contains(err.Error(), " InvalidInstanceID.NotFound") {
@@ -330,13 +450,13 @@ const (
 	Terminated               = "terminated"
 )
 
-func (repo *AWSRepository) CheckIfInstanceIsInState(instanceId string, state InstanceState) bool {
+func (repo *AWSRepository) CheckIfInstanceIsInState(ctx context.Context, instanceId string, state InstanceState) bool {
 	// Create a "describe instances" input with the specified instance ID
 	instanceInput := &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceId},
 	}
 	// Use the EC2 client to describe the instances
-	result, err := repo.Client.DescribeInstances(context.TODO(), instanceInput)
+	result, err := repo.Client.DescribeInstances(ctx, instanceInput)
 	if err != nil {
 		return false
 	}
@@ -350,61 +470,167 @@ func (repo *AWSRepository) CheckIfInstanceIsInState(instanceId string, state Ins
 	return false
 }
 
-func (repo *AWSRepository) WaitUntilInstanceIsActive(instanceId string) bool {
-	fn := func() bool {
-		return repo.CheckIfInstanceIsInState(instanceId, Running)
-	}
-	status := callWithTimeout(5*time.Minute, fn)
-	if status {
-		log.Infoln("Instance is ready.... \nWaiting 10 seconds to finish up the public ip assignment ")
-		time.Sleep(10 * time.Second)
-		return true
+func (repo *AWSRepository) WaitUntilInstanceIsActive(ctx context.Context, instanceId string) error {
+	err := repo.waitForInstanceState(ctx, instanceId, Running)
+	if err != nil {
+		return err
 	}
-	return false
+	log.Infoln("Instance is ready.... \nWaiting 10 seconds to finish up the public ip assignment ")
+	return sleepContext(ctx, 10*time.Second)
 }
 
-func (repo *AWSRepository) WaitUntilInstanceIsTerminated(instanceId string) bool {
+func (repo *AWSRepository) WaitUntilInstanceIsTerminated(ctx context.Context, instanceId string) error {
 	// Check if the instance exists
-	status, err := repo.CheckIfInstanceExists(instanceId)
+	status, err := repo.CheckIfInstanceExists(ctx, instanceId)
 	if err != nil {
 		log.Errorf("Unknown error while try to check if the instance exists: %s", err)
-		return true
+		return err
 	}
 	if status == false {
-		return true
+		return nil
 	}
-	fn := func() bool {
-		return repo.CheckIfInstanceIsInState(instanceId, Terminated)
+	err = repo.waitForInstanceState(ctx, instanceId, Terminated)
+	if err != nil {
+		return err
 	}
-	status = callWithTimeout(5*time.Minute, fn)
-	if status {
-		log.Infoln("Instance has been terminated.... \nWaiting 10 seconds to finish up!")
-		time.Sleep(10 * time.Second)
-		return true
+	log.Infoln("Instance has been terminated.... \nWaiting 10 seconds to finish up!")
+	return sleepContext(ctx, 10*time.Second)
+}
+
+// waitForInstanceState polls the instance until it's in the state, for at most 5 minutes.
+func (repo *AWSRepository) waitForInstanceState(ctx context.Context, instanceId string, state InstanceState) error {
+	deadline := time.Now().Add(5 * time.Minute)
+	for !repo.CheckIfInstanceIsInState(ctx, instanceId, state) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instance `%s` isn't %s after 5 minutes", instanceId, state)
+		}
+		err := sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return err
+		}
 	}
-	return false
+	return nil
 }
 
-func callWithTimeout(duration time.Duration, fn func() bool) bool {
-	timeout := time.After(duration)
-	done := make(chan bool)
-	defer close(done)
-
-	go func() {
-		for {
-			select {
-			case <-timeout:
-				done <- false
-				return
-			default:
-				if fn() {
-					done <- true
-					return
-				}
-			}
+// FindTaggedResources scans every enabled region for resources with the sockv5er:session tag, only the ones
+// with the sockv5er:owner tag of owner unless it's empty. A region which can't be scanned doesn't stop the scan,
+// the error names it once the others are done.
+func (repo *AWSRepository) FindTaggedResources(ctx context.Context, s *Settings, owner string) ([]TrackedResource, error) {
+	result, err := repo.Client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+	found := make([][]TrackedResource, len(result.Regions))
+	errs := make([]error, len(result.Regions))
+	forEachConcurrently(len(result.Regions), maxConcurrentRegions, func(i int) {
+		region := aws.StringValue(result.Regions[i].RegionName)
+		regionRepo := &AWSRepository{}
+		errs[i] = regionRepo.SetRegion(ctx, region, s)
+		if errs[i] == nil {
+			found[i], errs[i] = regionRepo.findTaggedResources(ctx, "", owner)
+		}
+		if errs[i] != nil {
+			log.Warnf("[%s] Scanning the region failed with error: %s\n", region, errs[i])
+		} else {
+			log.Infof("[%s] Found %d tagged sessions.\n", region, len(found[i]))
+		}
+	})
+	resources := make([]TrackedResource, 0)
+	failedRegions := make([]string, 0)
+	for i := range result.Regions {
+		resources = append(resources, found[i]...)
+		if errs[i] != nil {
+			failedRegions = append(failedRegions, aws.StringValue(result.Regions[i].RegionName))
+		}
+	}
+	if ctx.Err() != nil {
+		return resources, ctx.Err()
+	}
+	if len(failedRegions) > 0 {
+		return resources, fmt.Errorf("scanning the regions %s failed", strings.Join(failedRegions, ", "))
+	}
+	return resources, nil
+}
+
+// findTaggedResources lists the resources of the region with a sockv5er:session tag, only the ones of the
+// given session and owner unless they are empty.
+func (repo *AWSRepository) findTaggedResources(ctx context.Context, session string, owner string) ([]TrackedResource, error) {
+	tagFilters := awsTagFilters(session, owner)
+	instances := make([]types.Instance, 0)
+	// Terminated instances stay listed for a while.
+	paginator := ec2.NewDescribeInstancesPaginator(repo.Client, &ec2.DescribeInstancesInput{Filters: append(tagFilters, types.Filter{
+		Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "shutting-down", "stopping", "stopped"},
+	})})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	groups, err := repo.Client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{Filters: tagFilters})
+	if err != nil {
+		return nil, err
+	}
+	keyPairs, err := repo.Client.DescribeKeyPairs(ctx, &ec2.DescribeKeyPairsInput{Filters: tagFilters})
+	if err != nil {
+		return nil, err
+	}
+	return groupAWSSessions(repo.Region, instances, groups.SecurityGroups, keyPairs.KeyPairs), nil
+}
+
+// awsTagFilters selects the resources with a sockv5er:session tag, of the session and the owner when they are set.
+func awsTagFilters(session string, owner string) []types.Filter {
+	filters := []types.Filter{{Name: aws.String("tag-key"), Values: []string{awsTagSession}}}
+	if session != "" {
+		filters = []types.Filter{{Name: aws.String("tag:" + awsTagSession), Values: []string{session}}}
+	}
+	if owner != "" {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + awsTagOwner), Values: []string{owner}})
+	}
+	return filters
+}
+
+// groupAWSSessions puts the resources with the same sockv5er:session tag into one entry, sorted by session.
+func groupAWSSessions(region string, instances []types.Instance, groups []types.SecurityGroup, keyPairs []types.KeyPairInfo) []TrackedResource {
+	sessions := map[string]*AWSResource{}
+	session := func(tags []types.Tag) *AWSResource {
+		id := awsTagValue(tags, awsTagSession)
+		if sessions[id] == nil {
+			sessions[id] = &AWSResource{Region: region, Session: id, Owner: awsTagValue(tags, awsTagOwner)}
+		}
+		return sessions[id]
+	}
+	for _, instance := range instances {
+		session(instance.Tags).InstanceId = aws.StringValue(instance.InstanceId)
+	}
+	for _, group := range groups {
+		session(group.Tags).SecurityGroupId = aws.StringValue(group.GroupId)
+	}
+	for _, keyPair := range keyPairs {
+		session(keyPair.Tags).KeyPairId = aws.StringValue(keyPair.KeyPairId)
+	}
+	ids := make([]string, 0, len(sessions))
+	for id := range sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	resources := make([]TrackedResource, 0, len(ids))
+	for _, id := range ids {
+		resources = append(resources, TrackedResource{Kind: ProviderAWS, AWS: sessions[id]})
+	}
+	return resources
+}
+
+func awsTagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
 		}
-	}()
-	return <-done
+	}
+	return ""
 }
 
 func (repo *AWSRepository) GetHostIP() string {
@@ -415,11 +641,22 @@ func (repo *AWSRepository) GetPrivateKey() []byte {
 	return []byte(repo.KeyPairKey)
 }
 
-func (repo *AWSRepository) getPublicIPAddress(instanceID string) (string, error) {
+func (repo *AWSRepository) GetHostPublicKey() ssh.PublicKey {
+	if repo.HostKey == nil {
+		return nil
+	}
+	return repo.HostKey.PublicKey
+}
+
+func (repo *AWSRepository) GetSSHUsername() string {
+	return "ec2-user"
+}
+
+func (repo *AWSRepository) getPublicIPAddress(ctx context.Context, instanceID string) (string, error) {
 	input := &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
 	}
-	resp, err := repo.Client.DescribeInstances(context.TODO(), input)
+	resp, err := repo.Client.DescribeInstances(ctx, input)
 	if err != nil {
 		return "", err
 	}
@@ -429,12 +666,16 @@ func (repo *AWSRepository) getPublicIPAddress(instanceID string) (string, error)
 	return *resp.Reservations[0].Instances[0].PublicIpAddress, nil
 }
 
-func (repo *AWSRepository) CheckIfInstanceExists(instanceID string) (bool, error) {
+func (repo *AWSRepository) CheckIfInstanceExists(ctx context.Context, instanceID string) (bool, error) {
 	input := &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
 	}
-	resp, err := repo.Client.DescribeInstances(context.TODO(), input)
+	resp, err := repo.Client.DescribeInstances(ctx, input)
 	if err != nil {
+		// An instance which was terminated and purged already is not found anymore.
+		if strings.Contains(err.Error(), "InvalidInstanceID.NotFound") {
+			return false, nil
+		}
 		log.Errorf("Getting instance status failed with error: %s", err)
 		return false, err
 	}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func sessionTags(session string) []types.Tag {
+	return []types.Tag{
+		{Key: aws.String(awsTagOwner), Value: aws.String("me@laptop")},
+		{Key: aws.String(awsTagSession), Value: aws.String(session)},
+	}
+}
+
+func TestGroupAWSSessions(t *testing.T) {
+	instances := []types.Instance{{InstanceId: aws.String("i-2"), Tags: sessionTags("bbbb")}}
+	groups := []types.SecurityGroup{
+		{GroupId: aws.String("sg-1"), Tags: sessionTags("aaaa")},
+		{GroupId: aws.String("sg-2"), Tags: sessionTags("bbbb")},
+	}
+	// The instance of session aaaa is gone already, its key pair and group are left.
+	keyPairs := []types.KeyPairInfo{
+		{KeyPairId: aws.String("key-1"), Tags: sessionTags("aaaa")},
+		{KeyPairId: aws.String("key-2"), Tags: sessionTags("bbbb")},
+	}
+	resources := groupAWSSessions("eu-west-2", instances, groups, keyPairs)
+	expected := []AWSResource{
+		{Region: "eu-west-2", Session: "aaaa", Owner: "me@laptop", SecurityGroupId: "sg-1", KeyPairId: "key-1"},
+		{Region: "eu-west-2", Session: "bbbb", Owner: "me@laptop", InstanceId: "i-2", SecurityGroupId: "sg-2", KeyPairId: "key-2"},
+	}
+	if len(resources) != len(expected) {
+		t.Fatalf("Unexpected sessions: %v", resources)
+	}
+	for i := range expected {
+		if resources[i].Kind != ProviderAWS || *resources[i].AWS != expected[i] {
+			t.Errorf("Expected %v, got: %v", expected[i], resources[i].AWS)
+		}
+	}
+}
+
+func TestAWSTagFilters(t *testing.T) {
+	// The scan of one owner leaves the sessions of the other machines sharing the account alone.
+	filters := awsTagFilters("", "me@laptop")
+	if len(filters) != 2 || aws.StringValue(filters[0].Name) != "tag-key" || filters[0].Values[0] != awsTagSession ||
+		aws.StringValue(filters[1].Name) != "tag:"+awsTagOwner || filters[1].Values[0] != "me@laptop" {
+		t.Errorf("Unexpected filters of the owner: %v", filters)
+	}
+	filters = awsTagFilters("aaaa", "")
+	if len(filters) != 1 || aws.StringValue(filters[0].Name) != "tag:"+awsTagSession || filters[0].Values[0] != "aaaa" {
+		t.Errorf("Unexpected filters of the session: %v", filters)
+	}
+}
+
+func TestAWSTagSpecifications(t *testing.T) {
+	repo := &AWSRepository{Session: "aaaa", owner: "me@laptop"}
+	specifications := repo.tagSpecifications(types.ResourceTypeInstance, types.ResourceTypeVolume)
+	if len(specifications) != 2 || specifications[1].ResourceType != types.ResourceTypeVolume {
+		t.Fatalf("Unexpected tag specifications: %v", specifications)
+	}
+	tags := specifications[0].Tags
+	if awsTagValue(tags, awsTagSession) != "aaaa" || awsTagValue(tags, awsTagOwner) != "me@laptop" ||
+		awsTagValue(tags, awsTagCreatedAt) == "" {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+}
+
+func TestAWSIntentIsTrackedBeforeTheCall(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	tracker := GetNewTracker(trackerFilepath)
+	repo := &AWSRepository{Region: "eu-west-2", Session: "aaaa"}
+	readIntent := func() string {
+		readTracker := GetNewTracker(trackerFilepath)
+		err := readTracker.ReadResourcesFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracked := readTracker.TrackedResources()
+		if len(tracked) != 1 || tracked[0].AWS.Session != "aaaa" {
+			t.Fatalf("Unexpected tracked resources: %v", tracked)
+		}
+		return tracked[0].AWS.Intent
+	}
+	err := repo.createTracked(tracker, awsIntentSecurityGroup, func() error {
+		// A crash here leaves the intent behind.
+		if intent := readIntent(); intent != awsIntentSecurityGroup {
+			t.Errorf("Expected the intent to be tracked before the call, got: %q", intent)
+		}
+		repo.SecurityGroupID = "sg-1"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intent := readIntent(); intent != "" {
+		t.Errorf("Expected the intent to be cleared once the group exists, got: %q", intent)
+	}
+	err = repo.createTracked(tracker, awsIntentInstance, func() error { return errors.New("request timed out") })
+	if err == nil || readIntent() != awsIntentInstance {
+		t.Error("Expected the intent to stay when the call fails")
+	}
+}
+
+func TestAWSWaitUntilInstanceIsTerminatedWhenItIsGone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`<Response><Errors><Error><Code>InvalidInstanceID.NotFound</Code><Message>The instance ID 'i-1' does not exist</Message></Error></Errors><RequestID>1</RequestID></Response>`))
+	}))
+	defer server.Close()
+	repo := &AWSRepository{Client: ec2.New(ec2.Options{
+		Region:       "eu-west-2",
+		BaseEndpoint: awsv2.String(server.URL),
+		Credentials:  credentials.NewStaticCredentialsProvider("key", "secret", ""),
+	})}
+	err := repo.WaitUntilInstanceIsTerminated(context.Background(), "i-1")
+	if err != nil {
+		t.Errorf("Expected an instance which is gone to count as terminated, got: %s", err)
+	}
+}
@@ -0,0 +1,607 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	azureEndpoint      = "https://management.azure.com/"
+	azureLoginEndpoint = "https://login.microsoftonline.com/"
+	azureScope         = "https://management.azure.com/.default"
+	azureVMSize        = "Standard_B1s"
+	azureSSHUsername   = "sockv5er"
+	// The api versions of the resource providers sockv5er uses.
+	azureResourcesAPIVersion = "2021-04-01"
+	azureNetworkAPIVersion   = "2023-09-01"
+	azureComputeAPIVersion   = "2023-09-01"
+	azureLocationsAPIVersion = "2022-12-01"
+	azureRolesAPIVersion     = "2022-04-01"
+	// azureContributorRole is the id of the built-in Contributor role, which may delete the resource group.
+	azureContributorRole = "b24988ac-6182-4be0-a8ab-5f5c3b4d2c8e"
+)
+
+// azureSelfDeleteScript deletes the resource group of the VM with the token of its managed identity. A VM which
+// is only shut down from the inside stays allocated and keeps its public IP and disk, all of them billed.
+const azureSelfDeleteScript = `#!/bin/sh
+IMDS=http://169.254.169.254/metadata
+get() { curl -s -H Metadata:true "$IMDS/$1"; }
+SUBSCRIPTION=$(get "instance/compute/subscriptionId?api-version=2021-02-01&format=text")
+GROUP=$(get "instance/compute/resourceGroupName?api-version=2021-02-01&format=text")
+TOKEN=$(get "identity/oauth2/token?api-version=2018-02-01&resource=%[1]s" | sed -E 's/.*"access_token" *: *"([^"]+)".*/\1/')
+curl -s -X DELETE -H "Authorization: Bearer $TOKEN" \
+  "%[1]ssubscriptions/$SUBSCRIPTION/resourcegroups/$GROUP?api-version=%[2]s"
+`
+
+const azureSelfDeleteFilepath = "/usr/local/bin/sockv5er-self-delete"
+
+// azureRegionCountries maps the Azure regions to the country of their datacenters.
+var azureRegionCountries = map[string]string{
+	"australiacentral":   "Australia",
+	"australiaeast":      "Australia",
+	"australiasoutheast": "Australia",
+	"brazilsouth":        "Brazil",
+	"canadacentral":      "Canada",
+	"canadaeast":         "Canada",
+	"centralindia":       "India",
+	"centralus":          "USA",
+	"eastasia":           "Hong Kong",
+	"eastus":             "USA",
+	"eastus2":            "USA",
+	"francecentral":      "France",
+	"germanywestcentral": "Germany",
+	"israelcentral":      "Israel",
+	"italynorth":         "Italy",
+	"japaneast":          "Japan",
+	"japanwest":          "Japan",
+	"koreacentral":       "S.Korea",
+	"koreasouth":         "S.Korea",
+	"mexicocentral":      "Mexico",
+	"northcentralus":     "USA",
+	"northeurope":        "Ireland",
+	"norwayeast":         "Norway",
+	"polandcentral":      "Poland",
+	"qatarcentral":       "Qatar",
+	"southafricanorth":   "South Africa",
+	"southcentralus":     "USA",
+	"southeastasia":      "Singapore",
+	"southindia":         "India",
+	"spaincentral":       "Spain",
+	"swedencentral":      "Sweden",
+	"switzerlandnorth":   "Switzerland",
+	"uaenorth":           "UAE",
+	"uksouth":            "UK",
+	"ukwest":             "UK",
+	"westcentralus":      "USA",
+	"westeurope":         "Netherlands",
+	"westindia":          "India",
+	"westus":             "USA",
+	"westus2":            "USA",
+	"westus3":            "USA",
+}
+
+// AzureRepository creates every resource of a session in a resource group of its own,
+// so that the cleanup is a single deletion of the group.
+type AzureRepository struct {
+	Client        *AzureClient
+	Location      string
+	ResourceGroup string
+	InstanceIP    string
+	SSHKey        *HostKey
+	HostKey       *HostKey
+	externalIP    func() (string, error)
+	pollInterval  time.Duration
+}
+
+func NewAzureProvider() CloudProvider {
+	return &AzureRepository{externalIP: GetExternalIP, pollInterval: 2 * time.Second}
+}
+
+func (repo *AzureRepository) Initialize(ctx context.Context, s *Settings) error {
+	client, err := NewAzureClient(s)
+	if err != nil {
+		return err
+	}
+	repo.Client = client
+	return nil
+}
+
+func (repo *AzureRepository) trackedResource() TrackedResource {
+	return TrackedResource{Kind: ProviderAzure, Azure: &AzureResource{
+		Region:         repo.Location,
+		SubscriptionId: repo.Client.SubscriptionId,
+		ResourceGroup:  repo.ResourceGroup,
+	}}
+}
+
+// GetRegions returns the physical regions of the subscription. Their countries come from a table,
+// the regions don't have an endpoint of their own to look up.
+func (repo *AzureRepository) GetRegions(ctx context.Context, s *Settings) []Region {
+	var locations struct {
+		Value []struct {
+			Name     string `json:"name"`
+			Metadata struct {
+				RegionType       string `json:"regionType"`
+				PhysicalLocation string `json:"physicalLocation"`
+			} `json:"metadata"`
+		} `json:"value"`
+	}
+	err := repo.Client.do(ctx, http.MethodGet, repo.Client.subscriptionPath("locations", azureLocationsAPIVersion), nil, &locations)
+	if err != nil {
+		log.Warnf("Listing the regions failed with error: %s\n", err)
+		return []Region{}
+	}
+	cloudAgnosticRegions := make([]Region, 0, len(locations.Value))
+	for _, location := range locations.Value {
+		if location.Metadata.RegionType != "Physical" {
+			continue
+		}
+		country, found := azureRegionCountries[location.Name]
+		if !found {
+			country = "Unknown"
+		}
+		// The physical location is a state or a city, or the country again for the smaller countries.
+		city := location.Metadata.PhysicalLocation
+		if city == country {
+			city = ""
+		}
+		cloudAgnosticRegions = append(cloudAgnosticRegions, Region{ID: location.Name, Country: country, City: city})
+	}
+	sort.Slice(cloudAgnosticRegions, func(i, j int) bool {
+		return cloudAgnosticRegions[i].ID < cloudAgnosticRegions[j].ID
+	})
+	return cloudAgnosticRegions
+}
+
+// CreateResources creates the resource group and tracks it before anything is created in it.
+func (repo *AzureRepository) CreateResources(ctx context.Context, location string, s *Settings, tracker *ResourceTracker) error {
+	repo.Location = location
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	name := "sockv5er-" + suffix
+	repo.SSHKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	repo.HostKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	log.Infof("Host key with fingerprint `%s` generated for the VM.\n", repo.HostKey.Fingerprint())
+	// The name is kept before the group is created, so that DeleteResources also removes a group
+	// whose creation was interrupted.
+	repo.ResourceGroup = name
+	err = repo.Client.put(ctx, repo.Client.subscriptionPath("resourcegroups/"+name, azureResourcesAPIVersion), map[string]interface{}{
+		"location": location,
+		"tags":     azureTags(),
+	}, repo.pollInterval)
+	if err != nil {
+		return err
+	}
+	tracker.Update(repo.trackedResource(), Add)
+	log.Infof("Resource group `%s` created.\n", name)
+	nicId, err := repo.CreateNetwork(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = repo.CreateVM(ctx, name, nicId, s.InstanceGracePeriod)
+	if err != nil {
+		return err
+	}
+	log.Infof("VM `%s` created.\n", name)
+	err = repo.AllowVMToDeleteGroup(ctx, name)
+	if err != nil {
+		// Only the caller can't assign roles, e.g. without Owner or User Access Administrator on the subscription.
+		log.Warnf("Allowing the VM to delete its resource group failed with error: %s. The VM only shuts down once the heartbeats stop and is billed until `sockv5er cleanup` deletes it.\n", err)
+	}
+	var publicIP struct {
+		Properties struct {
+			IPAddress string `json:"ipAddress"`
+		} `json:"properties"`
+	}
+	err = repo.Client.do(ctx, http.MethodGet, repo.networkPath("publicIPAddresses/"+name), nil, &publicIP)
+	if err != nil {
+		return err
+	}
+	if publicIP.Properties.IPAddress == "" {
+		return fmt.Errorf("the public IP `%s` has no address", name)
+	}
+	repo.InstanceIP = publicIP.Properties.IPAddress
+	return nil
+}
+
+// CreateNetwork creates the network security group limited to ssh from the external IP, the virtual network,
+// the public IP and the network interface of the VM and returns the id of the network interface.
+func (repo *AzureRepository) CreateNetwork(ctx context.Context, name string) (string, error) {
+	externalIP, err := repo.externalIP()
+	if err != nil {
+		externalIP = "*"
+	} else {
+		externalIP = externalIP + "/32"
+	}
+	nsgId := repo.networkId("networkSecurityGroups/" + name)
+	err = repo.Client.put(ctx, repo.networkPath("networkSecurityGroups/"+name), map[string]interface{}{
+		"location": repo.Location,
+		"properties": map[string]interface{}{"securityRules": []map[string]interface{}{{
+			"name": "ssh",
+			"properties": map[string]interface{}{
+				"protocol":                 "Tcp",
+				"sourceAddressPrefix":      externalIP,
+				"sourcePortRange":          "*",
+				"destinationAddressPrefix": "*",
+				"destinationPortRange":     "22",
+				"access":                   "Allow",
+				"direction":                "Inbound",
+				"priority":                 100,
+			},
+		}}},
+	}, repo.pollInterval)
+	if err != nil {
+		return "", err
+	}
+	err = repo.Client.put(ctx, repo.networkPath("virtualNetworks/"+name), map[string]interface{}{
+		"location": repo.Location,
+		"properties": map[string]interface{}{
+			"addressSpace": map[string]interface{}{"addressPrefixes": []string{"10.0.0.0/16"}},
+			"subnets": []map[string]interface{}{{
+				"name": "default",
+				"properties": map[string]interface{}{
+					"addressPrefix":        "10.0.0.0/24",
+					"networkSecurityGroup": map[string]string{"id": nsgId},
+				},
+			}},
+		},
+	}, repo.pollInterval)
+	if err != nil {
+		return "", err
+	}
+	err = repo.Client.put(ctx, repo.networkPath("publicIPAddresses/"+name), map[string]interface{}{
+		"location":   repo.Location,
+		"sku":        map[string]string{"name": "Standard"},
+		"properties": map[string]string{"publicIPAllocationMethod": "Static"},
+	}, repo.pollInterval)
+	if err != nil {
+		return "", err
+	}
+	err = repo.Client.put(ctx, repo.networkPath("networkInterfaces/"+name), map[string]interface{}{
+		"location": repo.Location,
+		"properties": map[string]interface{}{
+			"networkSecurityGroup": map[string]string{"id": nsgId},
+			"ipConfigurations": []map[string]interface{}{{
+				"name": "ipconfig",
+				"properties": map[string]interface{}{
+					"subnet":          map[string]string{"id": repo.networkId("virtualNetworks/" + name + "/subnets/default")},
+					"publicIPAddress": map[string]string{"id": repo.networkId("publicIPAddresses/" + name)},
+				},
+			}},
+		},
+	}, repo.pollInterval)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Network of `%s` created.\n", name)
+	return repo.networkId("networkInterfaces/" + name), nil
+}
+
+// CreateVM creates the VM with a managed identity and the watchdog, which deletes the resource group once the
+// heartbeats stop.
+func (repo *AzureRepository) CreateVM(ctx context.Context, name string, nicId string, gracePeriod time.Duration) error {
+	userdata, err := cloudInitOptions{
+		HostKey:         repo.HostKey,
+		GracePeriod:     gracePeriod,
+		ShutdownCommand: azureSelfDeleteFilepath + "; shutdown -h now",
+		WriteFiles: []cloudConfigFile{{
+			Path:        azureSelfDeleteFilepath,
+			Permissions: "0755",
+			Content:     fmt.Sprintf(azureSelfDeleteScript, azureEndpoint, azureResourcesAPIVersion),
+		}},
+	}.userData()
+	if err != nil {
+		return err
+	}
+	return repo.Client.put(ctx, repo.groupPath("Microsoft.Compute/virtualMachines/"+name, azureComputeAPIVersion), map[string]interface{}{
+		"location": repo.Location,
+		"tags":     azureTags(),
+		"identity": map[string]string{"type": "SystemAssigned"},
+		"properties": map[string]interface{}{
+			"hardwareProfile": map[string]string{"vmSize": azureVMSize},
+			"storageProfile": map[string]interface{}{
+				"imageReference": map[string]string{
+					"publisher": "Canonical",
+					"offer":     "0001-com-ubuntu-server-jammy",
+					"sku":       "22_04-lts-gen2",
+					"version":   "latest",
+				},
+				"osDisk": map[string]string{"createOption": "FromImage", "deleteOption": "Delete"},
+			},
+			"osProfile": map[string]interface{}{
+				"computerName":  name,
+				"adminUsername": azureSSHUsername,
+				"customData":    base64.StdEncoding.EncodeToString([]byte(userdata)),
+				"linuxConfiguration": map[string]interface{}{
+					"disablePasswordAuthentication": true,
+					"ssh": map[string]interface{}{"publicKeys": []map[string]string{{
+						"path":    fmt.Sprintf("/home/%s/.ssh/authorized_keys", azureSSHUsername),
+						"keyData": repo.SSHKey.AuthorizedKey(),
+					}}},
+				},
+			},
+			"networkProfile": map[string]interface{}{"networkInterfaces": []map[string]string{{"id": nicId}}},
+		},
+	}, repo.pollInterval)
+}
+
+// AllowVMToDeleteGroup gives the managed identity of the VM the Contributor role on the resource group and
+// nothing outside of it. A new identity takes a while to show up for role assignments, until then the
+// assignment fails with a bad request, which is retried.
+func (repo *AzureRepository) AllowVMToDeleteGroup(ctx context.Context, name string) error {
+	var vm struct {
+		Identity struct {
+			PrincipalId string `json:"principalId"`
+		} `json:"identity"`
+	}
+	err := repo.Client.do(ctx, http.MethodGet, repo.groupPath("Microsoft.Compute/virtualMachines/"+name, azureComputeAPIVersion), nil, &vm)
+	if err != nil {
+		return err
+	}
+	if vm.Identity.PrincipalId == "" {
+		return fmt.Errorf("the VM `%s` has no managed identity", name)
+	}
+	assignmentId, err := randomUUID()
+	if err != nil {
+		return err
+	}
+	path := repo.groupPath("Microsoft.Authorization/roleAssignments/"+assignmentId, azureRolesAPIVersion)
+	body := map[string]interface{}{"properties": map[string]string{
+		"roleDefinitionId": fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleDefinitions/%s", repo.Client.SubscriptionId, azureContributorRole),
+		"principalId":      vm.Identity.PrincipalId,
+		"principalType":    "ServicePrincipal",
+	}}
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		err = repo.Client.do(ctx, http.MethodPut, path, body, nil)
+		if err == nil || !strings.Contains(err.Error(), "status 400") || time.Now().After(deadline) {
+			return err
+		}
+		err = sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DeleteResources deletes the resource group with everything in it and waits until it's gone.
+func (repo *AzureRepository) DeleteResources(ctx context.Context, location string, s *Settings, tracker *ResourceTracker) error {
+	repo.Location = location
+	resource := repo.trackedResource()
+	if repo.ResourceGroup != "" {
+		err := repo.Client.delete(ctx, repo.Client.subscriptionPath("resourcegroups/"+repo.ResourceGroup, azureResourcesAPIVersion), repo.pollInterval)
+		if err != nil {
+			log.Warnf("Resource group deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Resource group `%s` deleted.\n", repo.ResourceGroup)
+	}
+	tracker.Update(resource, Remove)
+	return nil
+}
+
+func (repo *AzureRepository) PrepareResourcesForDeletion(resource TrackedResource) {
+	res := resource.Azure
+	repo.Location = res.Region
+	repo.ResourceGroup = res.ResourceGroup
+	// Resource groups tracked in another subscription are deleted there.
+	if res.SubscriptionId != "" {
+		repo.Client.SubscriptionId = res.SubscriptionId
+	}
+}
+
+func (repo *AzureRepository) GetHostIP() string {
+	return repo.InstanceIP
+}
+
+func (repo *AzureRepository) GetPrivateKey() []byte {
+	if repo.SSHKey == nil {
+		return nil
+	}
+	return repo.SSHKey.PrivateKeyPEM
+}
+
+func (repo *AzureRepository) GetHostPublicKey() ssh.PublicKey {
+	if repo.HostKey == nil {
+		return nil
+	}
+	return repo.HostKey.PublicKey
+}
+
+func (repo *AzureRepository) GetSSHUsername() string {
+	return azureSSHUsername
+}
+
+func (repo *AzureRepository) groupPath(path string, apiVersion string) string {
+	return repo.Client.subscriptionPath(fmt.Sprintf("resourceGroups/%s/providers/%s", repo.ResourceGroup, path), apiVersion)
+}
+
+func (repo *AzureRepository) networkPath(path string) string {
+	return repo.groupPath("Microsoft.Network/"+path, azureNetworkAPIVersion)
+}
+
+// networkId is the id other resources use to reference a network resource of the group.
+func (repo *AzureRepository) networkId(path string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/%s", repo.Client.SubscriptionId, repo.ResourceGroup, path)
+}
+
+// randomUUID returns a version 4 UUID, the names of role assignments have to be UUIDs.
+func randomUUID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// azureTags marks the resources as created by sockv5er in the portal.
+func azureTags() map[string]string {
+	return map[string]string{"created-by": "sockv5er"}
+}
+
+// AzureClient is a minimal client of the Azure Resource Manager REST API.
+type AzureClient struct {
+	Endpoint       string
+	SubscriptionId string
+	HTTP           *http.Client
+	token          func(ctx context.Context) (string, error)
+}
+
+// NewAzureClient authenticates with azure_access_token, e.g. from `az account get-access-token`,
+// or with the client secret of a service principal.
+func NewAzureClient(s *Settings) (*AzureClient, error) {
+	if s.AzureSubscriptionId == "" {
+		return nil, errors.New("set azure_subscription_id to use Azure")
+	}
+	client := &AzureClient{Endpoint: azureEndpoint, SubscriptionId: s.AzureSubscriptionId, HTTP: &http.Client{Timeout: time.Minute}}
+	switch {
+	case s.AzureAccessToken != "":
+		client.token = func(context.Context) (string, error) { return s.AzureAccessToken, nil }
+	case s.AzureTenantId != "" && s.AzureClientId != "" && s.AzureClientSecret != "":
+		tokenURL := azureLoginEndpoint + url.PathEscape(s.AzureTenantId) + "/oauth2/v2.0/token"
+		client.token = azureClientCredentials(client.HTTP, tokenURL, s.AzureClientId, s.AzureClientSecret)
+	default:
+		return nil, errors.New("set azure_access_token or azure_tenant_id, azure_client_id and azure_client_secret to use Azure")
+	}
+	return client, nil
+}
+
+// azureClientCredentials gets access tokens with the client credentials grant and reuses them until shortly before they expire.
+func azureClientCredentials(client *http.Client, tokenURL string, clientId string, clientSecret string) func(ctx context.Context) (string, error) {
+	var mu sync.Mutex
+	token := ""
+	expiry := time.Time{}
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && time.Now().Before(expiry) {
+			return token, nil
+		}
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientId},
+			"client_secret": {clientSecret},
+			"scope":         {azureScope},
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response, err := client.Do(request)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		var result struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		if err != nil || response.StatusCode != http.StatusOK || result.AccessToken == "" {
+			return "", fmt.Errorf("getting an access token for `%s` failed with status %d", clientId, response.StatusCode)
+		}
+		token = result.AccessToken
+		expiry = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+		return token, nil
+	}
+}
+
+func (c *AzureClient) subscriptionPath(path string, apiVersion string) string {
+	return fmt.Sprintf("subscriptions/%s/%s?api-version=%s", c.SubscriptionId, path, apiVersion)
+}
+
+func (c *AzureClient) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	token, err := c.token(ctx)
+	if err != nil {
+		return err
+	}
+	return doJSON(ctx, c.HTTP, method, c.Endpoint, path, token, body, out)
+}
+
+type azureProvisioning struct {
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+	} `json:"properties"`
+}
+
+// put creates or updates the resource at path and waits until it's provisioned.
+func (c *AzureClient) put(ctx context.Context, path string, body interface{}, interval time.Duration) error {
+	resource := &azureProvisioning{}
+	err := c.do(ctx, http.MethodPut, path, body, resource)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(10 * time.Minute)
+	for {
+		switch resource.Properties.ProvisioningState {
+		case "Succeeded":
+			return nil
+		case "Failed", "Canceled":
+			return fmt.Errorf("provisioning %s failed with state %s", path, resource.Properties.ProvisioningState)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s isn't provisioned after 10 minutes", path)
+		}
+		err = sleepContext(ctx, interval)
+		if err != nil {
+			return err
+		}
+		err = c.do(ctx, http.MethodGet, path, nil, resource)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// delete deletes the resource at path and waits until it's gone. Deleting something that's already gone succeeds.
+func (c *AzureClient) delete(ctx context.Context, path string, interval time.Duration) error {
+	err := c.do(ctx, http.MethodDelete, path, nil, nil)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(10 * time.Minute)
+	for {
+		err = c.do(ctx, http.MethodGet, path, nil, nil)
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s still exists 10 minutes after deleting it", path)
+		}
+		err = sleepContext(ctx, interval)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeARM is a local stand-in for the parts of the Azure Resource Manager API sockv5er uses.
+// Resources are provisioned on the first GET after they are created.
+type fakeARM struct {
+	resources   map[string]map[string]interface{}
+	provisioned map[string]bool
+}
+
+func startFakeARM(t *testing.T) (*fakeARM, *httptest.Server) {
+	fake := &fakeARM{resources: map[string]map[string]interface{}{}, provisioned: map[string]bool{}}
+	return fake, startFakeAPI(t, fake.serve)
+}
+
+func (f *fakeARM) serve(r *fakeRequest) {
+	if r.URL.Query().Get("api-version") == "" {
+		r.w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/subscriptions/test-subscription/")
+	switch {
+	case r.Method == http.MethodGet && path == "locations":
+		r.reply(http.StatusOK, map[string]interface{}{"value": []map[string]interface{}{
+			{"name": "westeurope", "metadata": map[string]string{"regionType": "Physical", "physicalLocation": "Netherlands"}},
+			{"name": "europe", "metadata": map[string]string{"regionType": "Logical"}},
+			{"name": "eastus", "metadata": map[string]string{"regionType": "Physical", "physicalLocation": "Virginia"}},
+			{"name": "newregion", "metadata": map[string]string{"regionType": "Physical"}},
+		}})
+	case r.Method == http.MethodPut:
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			r.t.Errorf("Invalid request body for %s: %s", r.URL.Path, err)
+		}
+		group := strings.Split(strings.ToLower(path), "/")[1]
+		if !strings.HasPrefix(strings.ToLower(path), "resourcegroups/") || (strings.Contains(path, "/providers/") && f.resources["resourcegroups/"+group] == nil) {
+			r.reply(http.StatusNotFound, map[string]interface{}{"error": map[string]string{"code": "ResourceGroupNotFound", "message": group}})
+			return
+		}
+		f.resources[strings.ToLower(path)] = body
+		r.reply(http.StatusCreated, map[string]interface{}{"properties": map[string]string{"provisioningState": "Creating"}})
+	case r.Method == http.MethodGet:
+		if f.resources[strings.ToLower(path)] == nil {
+			r.reply(http.StatusNotFound, map[string]interface{}{"error": map[string]string{"code": "NotFound", "message": path}})
+			return
+		}
+		state := "Creating"
+		if f.provisioned[strings.ToLower(path)] {
+			state = "Succeeded"
+		}
+		f.provisioned[strings.ToLower(path)] = true
+		response := map[string]interface{}{"properties": map[string]string{"provisioningState": state, "ipAddress": "203.0.113.40"}}
+		if f.resources[strings.ToLower(path)]["identity"] != nil {
+			response["identity"] = map[string]string{"type": "SystemAssigned", "principalId": "vm-principal"}
+		}
+		r.reply(http.StatusOK, response)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "resourcegroups/"):
+		if f.resources[path] == nil {
+			r.reply(http.StatusNotFound, map[string]interface{}{"error": map[string]string{"code": "ResourceGroupNotFound"}})
+			return
+		}
+		for resource := range f.resources {
+			if strings.HasPrefix(resource, path) {
+				delete(f.resources, resource)
+			}
+		}
+		r.w.WriteHeader(http.StatusAccepted)
+	default:
+		r.t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		r.w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestAzureRepository(server *httptest.Server) *AzureRepository {
+	return &AzureRepository{
+		Client: &AzureClient{
+			Endpoint:       server.URL,
+			SubscriptionId: "test-subscription",
+			HTTP:           server.Client(),
+			token:          func(context.Context) (string, error) { return "test-token", nil },
+		},
+		externalIP:   func() (string, error) { return "198.51.100.7", nil },
+		pollInterval: time.Millisecond,
+	}
+}
+
+func TestAzureGetRegions(t *testing.T) {
+	_, server := startFakeARM(t)
+	regions := newTestAzureRepository(server).GetRegions(context.Background(), &Settings{})
+	expected := []Region{
+		{ID: "eastus", Country: "USA", City: "Virginia"},
+		{ID: "newregion", Country: "Unknown"},
+		{ID: "westeurope", Country: "Netherlands"},
+	}
+	if len(regions) != len(expected) {
+		t.Fatalf("Expected the physical regions, got: %v", regions)
+	}
+	for i := range expected {
+		if regions[i] != expected[i] {
+			t.Errorf("Expected %v, got: %v", expected[i], regions[i])
+		}
+	}
+}
+
+func TestAzureCreateAndDeleteResources(t *testing.T) {
+	fake, server := startFakeARM(t)
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := newTestAzureRepository(server)
+	err := repo.CreateResources(context.Background(), "westeurope", &Settings{InstanceGracePeriod: 10 * time.Minute}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.GetHostIP() != "203.0.113.40" || repo.GetSSHUsername() != azureSSHUsername || len(repo.GetPrivateKey()) == 0 {
+		t.Errorf("Unexpected connection details: %s %s", repo.GetHostIP(), repo.GetSSHUsername())
+	}
+	group := "resourcegroups/" + repo.ResourceGroup
+	nsg, _ := json.Marshal(fake.resources[group+"/providers/microsoft.network/networksecuritygroups/"+repo.ResourceGroup])
+	if !strings.Contains(string(nsg), `"sourceAddressPrefix":"198.51.100.7/32"`) || !strings.Contains(string(nsg), `"destinationPortRange":"22"`) {
+		t.Errorf("The network security group isn't limited to ssh from the external IP: %s", nsg)
+	}
+	vm := fake.resources[group+"/providers/microsoft.compute/virtualmachines/"+repo.ResourceGroup]
+	if vm == nil {
+		t.Fatal("The VM wasn't created")
+	}
+	properties := vm["properties"].(map[string]interface{})
+	if properties["hardwareProfile"].(map[string]interface{})["vmSize"] != azureVMSize {
+		t.Errorf("Unexpected VM: %v", properties)
+	}
+	userdata, _ := base64.StdEncoding.DecodeString(properties["osProfile"].(map[string]interface{})["customData"].(string))
+	if !strings.Contains(string(userdata), repo.HostKey.AuthorizedKey()) || !strings.Contains(string(userdata), azureSelfDeleteFilepath) {
+		t.Error("The custom data doesn't contain the host key and the self delete script")
+	}
+	assignments := 0
+	for path, resource := range fake.resources {
+		if strings.HasPrefix(path, group+"/providers/microsoft.authorization/roleassignments/") {
+			assignments++
+			properties := resource["properties"].(map[string]interface{})
+			if properties["principalId"] != "vm-principal" || !strings.HasSuffix(properties["roleDefinitionId"].(string), azureContributorRole) {
+				t.Errorf("Unexpected role assignment: %v", properties)
+			}
+		}
+	}
+	if assignments != 1 {
+		t.Errorf("Expected the identity of the VM to get a role on the resource group, got %d assignments", assignments)
+	}
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 1 || tracked[0].Kind != ProviderAzure || tracked[0].Azure.ResourceGroup != repo.ResourceGroup ||
+		tracked[0].Azure.SubscriptionId != "test-subscription" {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+
+	cleanup := newTestAzureRepository(server)
+	cleanup.PrepareResourcesForDeletion(tracked[0])
+	err = cleanup.DeleteResources(context.Background(), tracked[0].Region(), &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.resources) != 0 {
+		t.Errorf("The resources weren't deleted: %v", fake.resources)
+	}
+	if len(tracker.TrackedResources()) != 0 {
+		t.Error("The deleted resources are still tracked")
+	}
+}
+
+func TestAzureClientCredentials(t *testing.T) {
+	requests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_secret") != "secret" || r.FormValue("scope") != azureScope {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "service-principal-token", "expires_in": 3600})
+	}))
+	defer tokenServer.Close()
+	token := azureClientCredentials(tokenServer.Client(), tokenServer.URL, "client", "secret")
+	for i := 0; i < 2; i++ {
+		value, err := token(context.Background())
+		if err != nil || value != "service-principal-token" {
+			t.Fatalf("Unexpected token: %s %v", value, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the token to be reused, it was requested %d times", requests)
+	}
+	_, err := azureClientCredentials(tokenServer.Client(), tokenServer.URL, "client", "wrong")(context.Background())
+	if err == nil {
+		t.Error("Expected a wrong client secret to fail")
+	}
+}
@@ -0,0 +1,673 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes returned by the sockv5er subcommands.
+const (
+	ExitOK             = 0
+	ExitError          = 1
+	ExitUsage          = 2
+	ExitNoSession      = 3
+	ExitCleanupPartial = 4
+)
+
+const cliUsage = `Usage: sockv5er [--config path] [command] [flags]
+
+Without a command sockv5er runs interactively.
+Settings are layered as defaults, config file, env and flags. The config file
+defaults to ~/.sockv5er/config.toml.
+
+Commands:
+  up        Create the resources in a region and start the socksv5 server,
+            --name starts another session next to the running ones
+  down      Stop a running session and delete its resources, down <name>
+            stops the named session
+  ls        List the sessions, running or with resources left
+  status    Show the tracked resources and whether a session is running
+  cleanup   Delete the resources listed in resources.yaml of the sessions which
+            aren't running, with --scan-all-regions also the resources tagged by
+            sockv5er for this user and machine which it doesn't list, with
+            --all-owners those of every owner
+  regions   List the regions available for the tunnel
+
+Exit codes:
+  0  success
+  1  runtime error
+  2  invalid usage
+  3  no running session (status)
+  4  some resources could not be deleted
+`
+
+// cliEnv carries what every subcommand needs from the global flags.
+type cliEnv struct {
+	stdout     io.Writer
+	configPath string
+}
+
+// loadSettings layers the config file, the env and the given flag values.
+// The log level of the settings is applied right away.
+func (e *cliEnv) loadSettings(flags *Settings) (*Settings, error) {
+	settings, err := LoadSettings(e.configPath, flags)
+	if err != nil {
+		return nil, err
+	}
+	if level, err := log.ParseLevel(settings.LogLevel); err == nil {
+		log.SetLevel(level)
+	}
+	return settings, nil
+}
+
+type command struct {
+	name string
+	run  func(e *cliEnv, args []string) int
+}
+
+var commands = []command{
+	{"up", runUp},
+	{"down", runDown},
+	{"ls", runLs},
+	{"status", runStatus},
+	{"cleanup", runCleanup},
+	{"regions", runRegions},
+}
+
+// RunCLI dispatches the command line arguments to the matching subcommand and returns the process exit code.
+func RunCLI(args []string) int {
+	e := &cliEnv{stdout: os.Stdout}
+	fs := newFlagSet("sockv5er")
+	fs.StringVar(&e.configPath, "config", "", "path of the TOML config file")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		settings, err := e.loadSettings(nil)
+		if err != nil {
+			log.Errorf("Loading settings failed with error: %s\n", err)
+			return ExitUsage
+		}
+		StartWorker(settings)
+		return ExitOK
+	}
+	if args[0] == "help" {
+		fmt.Print(cliUsage)
+		return ExitOK
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(e, args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "sockv5er: unknown command `%s`\n\n%s", args[0], cliUsage)
+	return ExitUsage
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) int {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s: unexpected arguments: %s\n", fs.Name(), strings.Join(fs.Args(), " "))
+		return ExitUsage
+	}
+	return -1
+}
+
+func runUp(e *cliEnv, args []string) int {
+	fs := newFlagSet("up")
+	name := fs.String("name", defaultSessionName, "name of the session, sessions with different names run at the same time")
+	region := fs.String("region", "", "region to create the socksv5 proxy in (required, except for the local and static providers)")
+	provider := fs.String("provider", "", "cloud provider to create the resources with, aws, lightsail, gcp, digitalocean, hetzner, azure, local or static (overrides PROVIDER)")
+	host := fs.String("host", "", "address the socksv5 server listens on (overrides SOCKS_V5_HOST)")
+	port := fs.String("port", "", "port the socksv5 server listens on (overrides SOCKS_V5_PORT)")
+	cleanup := fs.Bool("cleanup", false, "delete resources left over from previous runs before starting")
+	if code := parseFlags(fs, args); code >= 0 {
+		return code
+	}
+	if err := validateSessionName(*name); err != nil {
+		fmt.Fprintf(os.Stderr, "up: %s\n", err)
+		return ExitUsage
+	}
+	settings, err := e.loadSettings(&Settings{Provider: *provider, SocksV5Host: *host, SocksV5Port: *port})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "up: %s\n", err)
+		return ExitUsage
+	}
+	// The local container and the existing server have no regions to choose from.
+	if *region == "" && settings.Provider != ProviderLocal && settings.Provider != ProviderStatic {
+		fmt.Fprintln(os.Stderr, "up: --region is required")
+		return ExitUsage
+	}
+	if settings.SocksV5Port == "" {
+		fmt.Fprintln(os.Stderr, "up: set --port or SOCKS_V5_PORT")
+		return ExitUsage
+	}
+	// Checked before anything is created, the tunnel would fail on it later anyway.
+	if _, err := LoadSocksV5Credentials(settings); err != nil {
+		fmt.Fprintf(os.Stderr, "up: %s\n", err)
+		return ExitUsage
+	}
+	if pid, running := runningSessionPID(*name); running {
+		fmt.Fprintf(os.Stderr, "up: the session `%s` is already running with pid %d, start another one with --name\n", *name, pid)
+		return ExitError
+	}
+	s, _, err := newSocksV5Er(settings)
+	if err != nil {
+		log.Errorf("SockV5er failed with error: %s\n", err)
+		return ExitError
+	}
+	err = s.tracker.ReadResourcesFile()
+	if err != nil {
+		log.Errorf("Reading resources.yaml file failed with error: %s\n", err)
+		return ExitError
+	}
+	running := runningSessions()
+	stale := 0
+	for _, resource := range s.tracker.TrackedResources() {
+		if _, found := running[resource.SessionName()]; !found {
+			stale++
+		} else if resource.Port == settings.SocksV5Port {
+			fmt.Fprintf(os.Stderr, "up: the port %s is used by the session `%s`, choose another one with --port\n", resource.Port, resource.SessionName())
+			return ExitUsage
+		}
+	}
+	if stale > 0 {
+		if !*cleanup {
+			log.Warnf("resources.yaml at `%s` still lists resources from a previous run. Use `sockv5er cleanup` or `up --cleanup` to delete them.\n", settings.TrackingFilepath)
+		} else if failures, err := deleteTrackedResourcesUntilInterrupted(s, ofStoppedSessions(running)); err != nil || failures > 0 {
+			log.Errorf("Cleaning up previous resources failed. Resolve it with `sockv5er cleanup` before starting a new session.\n")
+			return ExitCleanupPartial
+		}
+	}
+	// Written before the resources are created, so that `sockv5er down` can interrupt the creation too.
+	err = writeSessionPID(*name, os.Getpid())
+	if err != nil {
+		log.Warnf("Writing the session pid file failed with error: %s. `sockv5er down` won't find this session.\n", err)
+	}
+	defer removeSessionPID(*name)
+	s.tracker.setSession(*name, settings.SocksV5Port)
+	// Whatever was created before a failure or an interrupt is deleted again.
+	err = s.createResources(*region)
+	if err != nil {
+		log.Errorf("Creating resources in the region `%s` failed with error: %s\n", *region, err)
+		return ExitError
+	}
+	log.Infoln("Created all the resources required to start the socksv5 server")
+	showConnectionDetails(settings)
+	err = s.createSocksV5Tunnel()
+	// The other sessions are left running with their resources.
+	failures, cleanupErr := deleteTrackedResourcesUntilInterrupted(s, ofSession(*name))
+	if err != nil {
+		log.Errorf("SockV5er failed with error: %s\n", err)
+		return ExitError
+	}
+	if cleanupErr != nil || failures > 0 {
+		return ExitCleanupPartial
+	}
+	return ExitOK
+}
+
+func runDown(e *cliEnv, args []string) int {
+	fs := newFlagSet("down")
+	timeout := fs.Duration("timeout", 10*time.Minute, "how long to wait for the running session to clean up")
+	name, code := parseFlagsAndName(fs, args)
+	if code >= 0 {
+		return code
+	}
+	if pid, running := runningSessionPID(name); running {
+		fmt.Fprintf(e.stdout, "Stopping the session `%s` with pid %d.\n", name, pid)
+		err := stopProcess(pid)
+		if err != nil {
+			log.Errorf("Stopping the session failed with error: %s\n", err)
+			return ExitError
+		}
+		deadline := time.Now().Add(*timeout)
+		for isProcessAlive(pid) {
+			if time.Now().After(deadline) {
+				log.Errorf("The session with pid %d did not exit within %s.\n", pid, *timeout)
+				return ExitError
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+	// Whatever the stopped session left behind, or a session that crashed, is still in resources.yaml.
+	return cleanupTrackedResources(e, ofSession(name))
+}
+
+// parseFlagsAndName parses the flags before and after the optional session name, which defaults to the default session.
+func parseFlagsAndName(fs *flag.FlagSet, args []string) (string, int) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "", ExitOK
+		}
+		return "", ExitUsage
+	}
+	if fs.NArg() == 0 {
+		return defaultSessionName, -1
+	}
+	name := fs.Arg(0)
+	if err := validateSessionName(name); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Name(), err)
+		return "", ExitUsage
+	}
+	return name, parseFlags(fs, fs.Args()[1:])
+}
+
+func runCleanup(e *cliEnv, args []string) int {
+	fs := newFlagSet("cleanup")
+	yes := fs.Bool("yes", false, "delete without asking for confirmation")
+	scanAllRegions := fs.Bool("scan-all-regions", false, "also delete the resources tagged by sockv5er for this user and machine in every region, listed in resources.yaml or not (aws only)")
+	allOwners := fs.Bool("all-owners", false, "with --scan-all-regions, also delete the tagged resources of the other users and machines sharing the account")
+	if code := parseFlags(fs, args); code >= 0 {
+		return code
+	}
+	if *allOwners && !*scanAllRegions {
+		fmt.Fprintln(os.Stderr, "cleanup: --all-owners only works with --scan-all-regions")
+		return ExitUsage
+	}
+	running := runningSessions()
+	if len(running) > 0 {
+		fmt.Fprintf(e.stdout, "Leaving the running sessions %s, stop them with `sockv5er down <name>`.\n", strings.Join(sortedSessionNames(running), ", "))
+	}
+	if !*yes && !confirm(e, "Delete the resources listed in resources.yaml?") {
+		fmt.Fprintln(e.stdout, "Nothing was deleted.")
+		return ExitOK
+	}
+	if !*scanAllRegions {
+		return cleanupTrackedResources(e, ofStoppedSessions(running))
+	}
+	// A resources.yaml which can't be read doesn't stop the scan, the scan is meant for that case too.
+	code := cleanupTrackedResources(e, ofStoppedSessions(running))
+	if code == ExitUsage {
+		return code
+	}
+	owner := sessionOwner()
+	if *allOwners {
+		owner = ""
+	}
+	scanCode := cleanupTaggedResources(e, running, owner, *yes)
+	if scanCode != ExitOK {
+		return scanCode
+	}
+	if code != ExitOK {
+		return ExitCleanupPartial
+	}
+	return ExitOK
+}
+
+// confirm asks the question and tells whether it was answered with y.
+func confirm(e *cliEnv, question string) bool {
+	fmt.Fprintf(e.stdout, "%s Y/N? ", question)
+	answer := ""
+	_, err := fmt.Fscanf(os.Stdin, "%s\n", &answer)
+	return err == nil && strings.ToLower(answer) == "y"
+}
+
+// cleanupTaggedResources deletes the resources of the owner the provider finds by their tags in every region,
+// except the ones resources.yaml lists for the running sessions. An empty owner deletes those of every owner.
+// The sessions are listed first and only deleted once that's confirmed, unless yes is set.
+func cleanupTaggedResources(e *cliEnv, running map[string]int, owner string, yes bool) int {
+	settings, err := e.loadSettings(nil)
+	if err != nil {
+		log.Errorf("Loading settings failed with error: %s\n", err)
+		return ExitUsage
+	}
+	s, _, err := newSocksV5Er(settings)
+	if err != nil {
+		log.Errorf("SockV5er failed with error: %s\n", err)
+		return ExitError
+	}
+	finder, ok := s.repo.(TaggedResourceFinder)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cleanup: the provider `%s` doesn't tag its resources, --scan-all-regions only works with aws\n", settings.Provider)
+		return ExitUsage
+	}
+	err = s.tracker.ReadResourcesFile()
+	if err != nil {
+		if len(running) > 0 {
+			log.Errorf("Reading resources.yaml file failed with error: %s. The resources of the running sessions can't be told apart, stop them before the scan.\n", err)
+			return ExitError
+		}
+		// The deletions are recorded in a throwaway tracker, the broken file is left as it is.
+		log.Warnf("Reading resources.yaml file failed with error: %s. It isn't updated by the scan.\n", err)
+		dir, err := os.MkdirTemp("", "sockv5er")
+		if err != nil {
+			log.Errorf("SockV5er failed with error: %s\n", err)
+			return ExitError
+		}
+		defer os.RemoveAll(dir)
+		s.tracker = GetNewTracker(filepath.Join(dir, "resources.yaml"))
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	if owner != "" {
+		fmt.Fprintf(e.stdout, "Scanning every region for resources tagged by sockv5er for %s.\n", owner)
+	} else {
+		fmt.Fprintln(e.stdout, "Scanning every region for resources tagged by sockv5er for any owner.")
+	}
+	resources, scanErr := finder.FindTaggedResources(ctx, settings, owner)
+	if scanErr != nil {
+		log.Errorf("Scanning for tagged resources failed with error: %s\n", scanErr)
+		if resources == nil {
+			return ExitError
+		}
+	}
+	resources = withoutRunningSessions(resources, s.tracker.TrackedResources(), running)
+	if len(resources) == 0 {
+		fmt.Fprintln(e.stdout, "No tagged resources were found.")
+		if scanErr != nil {
+			return ExitCleanupPartial
+		}
+		return ExitOK
+	}
+	for _, resource := range resources {
+		fmt.Fprintf(e.stdout, "[%s] %s\n", resource.Region(), strings.Join(resource.Describe(), ", "))
+	}
+	if !yes && !confirm(e, fmt.Sprintf("Delete the resources of these %d tagged sessions?", len(resources))) {
+		fmt.Fprintln(e.stdout, "The tagged resources weren't deleted.")
+		return ExitOK
+	}
+	failures := s.deleteResources(ctx, resources)
+	if scanErr != nil || failures > 0 {
+		return ExitCleanupPartial
+	}
+	fmt.Fprintf(e.stdout, "Deleted the resources of %d tagged sessions.\n", len(resources))
+	return ExitOK
+}
+
+// withoutRunningSessions drops the found resources which are tracked for one of the running sessions.
+func withoutRunningSessions(found []TrackedResource, tracked []TrackedResource, running map[string]int) []TrackedResource {
+	resources := make([]TrackedResource, 0, len(found))
+	for _, resource := range found {
+		inUse := false
+		for _, t := range tracked {
+			if _, ok := running[t.SessionName()]; ok && t.sameSession(resource) {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+// cleanupTrackedResources deletes the tracked resources which include selects.
+func cleanupTrackedResources(e *cliEnv, include func(TrackedResource) bool) int {
+	settings, err := e.loadSettings(nil)
+	if err != nil {
+		log.Errorf("Loading settings failed with error: %s\n", err)
+		return ExitUsage
+	}
+	s, _, err := newSocksV5Er(settings)
+	if err != nil {
+		log.Errorf("SockV5er failed with error: %s\n", err)
+		return ExitError
+	}
+	failures, err := deleteTrackedResourcesUntilInterrupted(s, include)
+	if err != nil {
+		log.Errorf("Reading resources.yaml file failed with error: %s\n", err)
+		return ExitError
+	}
+	if failures > 0 {
+		return ExitCleanupPartial
+	}
+	fmt.Fprintln(e.stdout, "The tracked resources are deleted.")
+	return ExitOK
+}
+
+// deleteTrackedResourcesUntilInterrupted deletes the tracked resources which include selects, an interrupt stops
+// the deletions in flight.
+func deleteTrackedResourcesUntilInterrupted(s *SocksV5Er, include func(TrackedResource) bool) (int, error) {
+	ctx, stop := interruptContext()
+	defer stop()
+	return s.deleteTrackedResources(ctx, include)
+}
+
+func sortedSessionNames(sessions map[string]int) []string {
+	names := make([]string, 0, len(sessions))
+	for name := range sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type sessionOutput struct {
+	Name     string        `json:"name"`
+	Running  bool          `json:"running"`
+	PID      int           `json:"pid,omitempty"`
+	Port     string        `json:"port,omitempty"`
+	Provider string        `json:"provider,omitempty"`
+	Region   string        `json:"region,omitempty"`
+	Status   SessionStatus `json:"status,omitempty"`
+}
+
+// listSessions lists a session per tracked entry, and the running sessions which track no resources,
+// e.g. the ones of the static provider. They're sorted by name.
+func listSessions(tracked []TrackedResource, running map[string]int) []sessionOutput {
+	sessions := make([]sessionOutput, 0, len(tracked)+len(running))
+	listed := make(map[string]bool)
+	for _, r := range tracked {
+		pid, isRunning := running[r.SessionName()]
+		sessions = append(sessions, sessionOutput{
+			Name:     r.SessionName(),
+			Running:  isRunning,
+			PID:      pid,
+			Port:     r.Port,
+			Provider: r.Kind,
+			Region:   r.Region(),
+			Status:   r.Status,
+		})
+		listed[r.SessionName()] = true
+	}
+	for name, pid := range running {
+		if !listed[name] {
+			sessions = append(sessions, sessionOutput{Name: name, Running: true, PID: pid})
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+	return sessions
+}
+
+func runLs(e *cliEnv, args []string) int {
+	fs := newFlagSet("ls")
+	asJSON := fs.Bool("json", false, "print the sessions as JSON")
+	if code := parseFlags(fs, args); code >= 0 {
+		return code
+	}
+	settings, err := e.loadSettings(nil)
+	if err != nil {
+		log.Errorf("Loading settings failed with error: %s\n", err)
+		return ExitUsage
+	}
+	tracked := make([]TrackedResource, 0)
+	if resourcesFilepath := trackerFilepath(settings); resourcesFilepath != "" {
+		tracker := GetNewTracker(resourcesFilepath)
+		err := tracker.ReadResourcesFile()
+		if err != nil {
+			log.Errorf("Reading resources.yaml file failed with error: %s\n", err)
+			return ExitError
+		}
+		tracked = tracker.TrackedResources()
+	}
+	sessions := listSessions(tracked, runningSessions())
+	if *asJSON {
+		err := json.NewEncoder(e.stdout).Encode(sessions)
+		if err != nil {
+			return ExitError
+		}
+		return ExitOK
+	}
+	if len(sessions) == 0 {
+		fmt.Fprintln(e.stdout, "No sessions.")
+		return ExitOK
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(e.stdout)
+	t.AppendHeader(table.Row{"Name", "PID", "Port", "Provider", "Region", "Status"})
+	for _, session := range sessions {
+		pid := "stopped"
+		if session.Running {
+			pid = fmt.Sprint(session.PID)
+		}
+		t.AppendRow(table.Row{session.Name, pid, session.Port, session.Provider, session.Region, session.Status})
+	}
+	t.Render()
+	return ExitOK
+}
+
+type statusOutput struct {
+	Running   bool              `json:"running"`
+	PID       int               `json:"pid,omitempty"`
+	Resources []TrackedResource `json:"resources"`
+}
+
+func runStatus(e *cliEnv, args []string) int {
+	fs := newFlagSet("status")
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	if code := parseFlags(fs, args); code >= 0 {
+		return code
+	}
+	settings, err := e.loadSettings(nil)
+	if err != nil {
+		log.Errorf("Loading settings failed with error: %s\n", err)
+		return ExitUsage
+	}
+	status := statusOutput{Resources: []TrackedResource{}}
+	running := runningSessions()
+	status.Running = len(running) > 0
+	// With several sessions running the pids are listed by `sockv5er ls`.
+	if len(running) == 1 {
+		for _, pid := range running {
+			status.PID = pid
+		}
+	}
+	if resourcesFilepath := trackerFilepath(settings); resourcesFilepath != "" {
+		tracker := GetNewTracker(resourcesFilepath)
+		err := tracker.ReadResourcesFile()
+		if err != nil {
+			log.Errorf("Reading resources.yaml file failed with error: %s\n", err)
+			return ExitError
+		}
+		status.Resources = append(status.Resources, tracker.TrackedResources()...)
+	}
+	if *asJSON {
+		err := json.NewEncoder(e.stdout).Encode(status)
+		if err != nil {
+			return ExitError
+		}
+	} else {
+		if status.Running {
+			for _, name := range sortedSessionNames(running) {
+				fmt.Fprintf(e.stdout, "Session `%s` running with pid %d.\n", name, running[name])
+			}
+		} else {
+			fmt.Fprintln(e.stdout, "No session is running.")
+		}
+		showTrackedResources(status.Resources, e.stdout)
+	}
+	if !status.Running {
+		return ExitNoSession
+	}
+	return ExitOK
+}
+
+func showTrackedResources(resources []TrackedResource, stdout io.Writer) {
+	if len(resources) == 0 {
+		fmt.Fprintln(stdout, "No resources are tracked.")
+		return
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(stdout)
+	t.AppendHeader(table.Row{"ID", "Name", "Provider", "Region", "Status", "Resources"})
+	for _, r := range resources {
+		t.AppendRow(table.Row{r.ID, r.SessionName(), r.Kind, r.Region(), r.Status, strings.Join(r.Describe(), "\n")})
+	}
+	t.Render()
+}
+
+type regionOutput struct {
+	Country     string `json:"country"`
+	CountryCode string `json:"countryCode,omitempty"`
+	City        string `json:"city,omitempty"`
+	Region      string `json:"region"`
+	LatencyMs   int64  `json:"latencyMs,omitempty"`
+}
+
+func runRegions(e *cliEnv, args []string) int {
+	fs := newFlagSet("regions")
+	asJSON := fs.Bool("json", false, "print the regions as JSON")
+	provider := fs.String("provider", "", "cloud provider to list the regions of, aws, lightsail, gcp, digitalocean, hetzner, azure, local or static (overrides PROVIDER)")
+	if code := parseFlags(fs, args); code >= 0 {
+		return code
+	}
+	settings, err := e.loadSettings(&Settings{Provider: *provider})
+	if err != nil {
+		log.Errorf("Loading settings failed with error: %s\n", err)
+		return ExitUsage
+	}
+	repo, err := NewCloudProvider(settings.Provider)
+	if err != nil {
+		log.Errorf("SockV5er failed with error: %s\n", err)
+		return ExitError
+	}
+	err = repo.Initialize(context.Background(), settings)
+	if err != nil {
+		log.Errorf("SockV5er failed with error: %s\n", err)
+		return ExitError
+	}
+	countryOptions := repo.GetRegions(context.Background(), settings)
+	if len(countryOptions) == 0 {
+		log.Errorln("No regions could be listed. Check the credentials and the geo location file.")
+		return ExitError
+	}
+	if !*asJSON {
+		showRegionsOptions(countryOptions)
+		return ExitOK
+	}
+	regions := make([]regionOutput, 0, len(countryOptions))
+	for _, option := range countryOptions {
+		regions = append(regions, regionOutput{
+			Country:     option.Country,
+			CountryCode: option.CountryCode,
+			City:        option.City,
+			Region:      option.ID,
+			LatencyMs:   option.Latency.Milliseconds(),
+		})
+	}
+	err = json.NewEncoder(e.stdout).Encode(regions)
+	if err != nil {
+		return ExitError
+	}
+	return ExitOK
+}
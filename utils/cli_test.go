@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestRunCLIUnknownCommand(t *testing.T) {
+	want := ExitUsage
+	got := RunCLI([]string{"sideways"})
+	if want != got {
+		t.Errorf("Unexpected exit code for an unknown command. want: %d got: %d", want, got)
+	}
+}
+
+func TestRunUpRequiresRegion(t *testing.T) {
+	want := ExitUsage
+	got := runUp(&cliEnv{stdout: os.Stdout}, []string{"--port", "1337"})
+	if want != got {
+		t.Errorf("Unexpected exit code for `up` without a region. want: %d got: %d", want, got)
+	}
+}
+
+func TestRunUpRejectsUnknownFlag(t *testing.T) {
+	want := ExitUsage
+	got := runUp(&cliEnv{stdout: os.Stdout}, []string{"--regoin", "eu-west-2"})
+	if want != got {
+		t.Errorf("Unexpected exit code for `up` with an unknown flag. want: %d got: %d", want, got)
+	}
+}
+
+func TestRunStatusRejectsPositionalArguments(t *testing.T) {
+	want := ExitUsage
+	got := runStatus(&cliEnv{stdout: os.Stdout}, []string{"extra"})
+	if want != got {
+		t.Errorf("Unexpected exit code for `status` with positional arguments. want: %d got: %d", want, got)
+	}
+}
+
+func TestRunUpRejectsInvalidName(t *testing.T) {
+	want := ExitUsage
+	got := runUp(&cliEnv{stdout: os.Stdout}, []string{"--name", "US_exit", "--region", "us-east-1", "--port", "1080"})
+	if want != got {
+		t.Errorf("Unexpected exit code for `up` with an invalid name. want: %d got: %d", want, got)
+	}
+}
+
+func TestRunCleanupAllOwnersRequiresScan(t *testing.T) {
+	want := ExitUsage
+	got := runCleanup(&cliEnv{stdout: os.Stdout}, []string{"--all-owners", "--yes"})
+	if want != got {
+		t.Errorf("Unexpected exit code for `cleanup --all-owners` without --scan-all-regions. want: %d got: %d", want, got)
+	}
+}
+
+func TestRunDownRejectsInvalidArguments(t *testing.T) {
+	for _, args := range [][]string{{"US_exit"}, {"us-exit", "extra"}, {"us-exit", "--timeuot", "1m"}} {
+		want := ExitUsage
+		got := runDown(&cliEnv{stdout: os.Stdout}, args)
+		if want != got {
+			t.Errorf("Unexpected exit code for `down %v`. want: %d got: %d", args, want, got)
+		}
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	tracked := []TrackedResource{
+		{Name: "us-exit", Port: "1080", Kind: ProviderAWS, Status: StatusActive, AWS: &AWSResource{Region: "us-east-1", Session: "a"}},
+		{Kind: ProviderHetzner, Status: StatusUnknown, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1"}},
+	}
+	running := map[string]int{"us-exit": 10, "static": 11}
+	want := []sessionOutput{
+		{Name: defaultSessionName, Provider: ProviderHetzner, Region: "nbg1", Status: StatusUnknown},
+		{Name: "static", Running: true, PID: 11},
+		{Name: "us-exit", Running: true, PID: 10, Port: "1080", Provider: ProviderAWS, Region: "us-east-1", Status: StatusActive},
+	}
+	if got := listSessions(tracked, running); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got: %v", want, got)
+	}
+	// The scan leaves the resources of the running sessions alone.
+	found := []TrackedResource{
+		{Kind: ProviderAWS, AWS: &AWSResource{Region: "us-east-1", Session: "a"}},
+		{Kind: ProviderAWS, AWS: &AWSResource{Region: "us-east-1", Session: "b"}},
+	}
+	left := withoutRunningSessions(found, tracked, running)
+	if len(left) != 1 || left[0].AWS.Session != "b" {
+		t.Errorf("Unexpected resources to delete: %v", left)
+	}
+}
@@ -1,14 +1,97 @@
 package utils
 
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The providers selectable with the `provider` setting.
+const (
+	ProviderAWS          = "aws"
+	ProviderLightsail    = "lightsail"
+	ProviderGCP          = "gcp"
+	ProviderDigitalOcean = "digitalocean"
+	ProviderHetzner      = "hetzner"
+	ProviderAzure        = "azure"
+	ProviderLocal        = "local"
+	ProviderStatic       = "static"
+)
+
+var providers = map[string]func() CloudProvider{
+	ProviderAWS:          NewAWSProvider,
+	ProviderLightsail:    NewLightsailProvider,
+	ProviderGCP:          NewGCPProvider,
+	ProviderDigitalOcean: NewDigitalOceanProvider,
+	ProviderHetzner:      NewHetznerProvider,
+	ProviderAzure:        NewAzureProvider,
+	ProviderLocal:        NewLocalContainerProvider,
+	ProviderStatic:       NewStaticHostProvider,
+}
+
+// NewCloudProvider returns the provider with the name used in the settings and in resources.yaml.
+// An empty name means AWS, the provider of the resources tracked before the others existed.
+func NewCloudProvider(name string) (CloudProvider, error) {
+	if name == "" {
+		name = ProviderAWS
+	}
+	newProvider, found := providers[name]
+	if !found {
+		return nil, fmt.Errorf("unknown provider `%s`", name)
+	}
+	return newProvider(), nil
+}
+
+// Region is a location a provider can create the instance in.
+type Region struct {
+	// ID is the name the provider uses for the region, which is passed to CreateResources.
+	ID      string
+	Country string
+	// CountryCode is the ISO 3166 code of the country, CountryCode, City and Latency are empty when
+	// the provider doesn't tell.
+	CountryCode string
+	City        string
+	Latency     time.Duration
+}
+
+// CloudProvider creates the instance the tunnel connects to. The resources it creates are tracked with
+// the tracker as soon as they exist, as a TrackedResource of the provider's Kind, and given back to
+// PrepareResourcesForDeletion by the cleanup.
+//
+// The calls which reach the provider take a context, cancelling it stops the calls in flight and the waits.
+// CreateResources returns the error of the context then, and DeleteResources on the same provider deletes
+// whatever it created so far.
 type CloudProvider interface {
-	Initialize(s *Settings) error
-	GetRegions(s *Settings) []map[string]string
-	CreateResources(region string, s *Settings, tracker *ResourceTracker) error
-	DeleteResources(region string, s *Settings, tracker *ResourceTracker) error
-	PrepareResourcesForDeletion(resources map[string]string)
-	UpdateTracker(resources map[string]string, op TrackingOp, tracker *ResourceTracker)
+	Initialize(ctx context.Context, s *Settings) error
+	GetRegions(ctx context.Context, s *Settings) []Region
+	CreateResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error
+	DeleteResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error
+	PrepareResourcesForDeletion(resource TrackedResource)
 	GetHostIP() string
 	GetPrivateKey() []byte
+	GetHostPublicKey() ssh.PublicKey
+	// GetSSHUsername is the user of the instance the tunnel logs in as, unless the settings override it.
+	GetSSHUsername() string
+}
+
+// SSHPortProvider is implemented by the providers whose instances don't listen for ssh on the ssh_port setting.
+type SSHPortProvider interface {
+	GetSSHPort() string
+}
+
+// HostOwner is implemented by the providers which may connect to a host sockv5er didn't create.
+// A host which isn't owned gets no heartbeats and is never shut down.
+type HostOwner interface {
+	OwnsHost() bool
+}
+
+// TaggedResourceFinder is implemented by the providers which tag what they create. It finds the resources
+// of every session of the owner in every region, whether resources.yaml lists them or not. An empty owner
+// finds the sessions of every owner.
+type TaggedResourceFinder interface {
+	FindTaggedResources(ctx context.Context, s *Settings, owner string) ([]TrackedResource, error)
 }
 
 type TrackingOp int
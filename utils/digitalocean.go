@@ -0,0 +1,377 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	digitalOceanEndpoint = "https://api.digitalocean.com/v2/"
+	// The smallest droplet size, available in every region.
+	digitalOceanSize        = "s-1vcpu-512mb-10gb"
+	digitalOceanImage       = "ubuntu-22-04-x64"
+	digitalOceanSSHUsername = "root"
+)
+
+// digitalOceanSelfDestructScript deletes the droplet, a droplet which is only powered off is still billed.
+const digitalOceanSelfDestructScript = `#!/bin/sh
+ID=$(curl -s http://169.254.169.254/metadata/v1/id)
+curl -s -X DELETE -H "Authorization: Bearer $(cat %[1]s)" "%[2]sdroplets/$ID"
+`
+
+const (
+	digitalOceanSelfDestructFilepath = "/usr/local/bin/sockv5er-self-destruct"
+	digitalOceanTokenFilepath        = "/root/.sockv5er-token"
+)
+
+// digitalOceanRegionCountries maps the region slugs without their number to the country they are in.
+var digitalOceanRegionCountries = map[string]string{
+	"ams": "Netherlands",
+	"blr": "India",
+	"fra": "Germany",
+	"lon": "UK",
+	"nyc": "USA",
+	"sfo": "USA",
+	"sgp": "Singapore",
+	"syd": "Australia",
+	"tor": "Canada",
+}
+
+type DigitalOceanRepository struct {
+	Client     *RESTClient
+	Region     string
+	DropletId  string
+	FirewallId string
+	SSHKeyId   string
+	Tag        string
+	DropletIP  string
+	SSHKey     *HostKey
+	HostKey    *HostKey
+	// SelfDestructToken is the scoped token the droplet deletes itself with, the droplet gets no other token.
+	SelfDestructToken string
+	externalIP        func() (string, error)
+	pollInterval      time.Duration
+}
+
+func NewDigitalOceanProvider() CloudProvider {
+	return &DigitalOceanRepository{externalIP: GetExternalIP, pollInterval: 2 * time.Second}
+}
+
+func (repo *DigitalOceanRepository) Initialize(ctx context.Context, s *Settings) error {
+	if s.DigitalOceanToken == "" {
+		return errors.New("set digitalocean_token to use DigitalOcean")
+	}
+	repo.Client = &RESTClient{
+		Endpoint: digitalOceanEndpoint,
+		Token:    s.DigitalOceanToken,
+		HTTP:     &http.Client{Timeout: time.Minute},
+	}
+	repo.SelfDestructToken = s.DigitalOceanSelfDestructToken
+	return nil
+}
+
+func (repo *DigitalOceanRepository) trackedResource() TrackedResource {
+	return TrackedResource{Kind: ProviderDigitalOcean, DigitalOcean: &DigitalOceanResource{
+		Region:     repo.Region,
+		DropletId:  repo.DropletId,
+		FirewallId: repo.FirewallId,
+		SSHKeyId:   repo.SSHKeyId,
+		Tag:        repo.Tag,
+	}}
+}
+
+// GetRegions returns the available regions which offer the droplet size sockv5er creates.
+func (repo *DigitalOceanRepository) GetRegions(ctx context.Context, s *Settings) []Region {
+	var regions struct {
+		Regions []struct {
+			Slug      string   `json:"slug"`
+			Name      string   `json:"name"`
+			Available bool     `json:"available"`
+			Sizes     []string `json:"sizes"`
+		} `json:"regions"`
+	}
+	err := repo.Client.do(ctx, http.MethodGet, "regions?per_page=200", nil, &regions)
+	if err != nil {
+		log.Warnf("Listing the regions failed with error: %s\n", err)
+		return []Region{}
+	}
+	cloudAgnosticRegions := make([]Region, 0, len(regions.Regions))
+	for _, region := range regions.Regions {
+		if !region.Available || !containsString(region.Sizes, digitalOceanSize) {
+			continue
+		}
+		country, found := digitalOceanRegionCountries[strings.TrimRight(region.Slug, "0123456789")]
+		if !found {
+			country = "Unknown"
+		}
+		// The names are the city and the number of the datacenter, e.g. `New York 3`.
+		cloudAgnosticRegions = append(cloudAgnosticRegions, Region{
+			ID:      region.Slug,
+			Country: country,
+			City:    strings.TrimRight(region.Name, " 0123456789"),
+		})
+	}
+	sort.Slice(cloudAgnosticRegions, func(i, j int) bool {
+		return cloudAgnosticRegions[i].ID < cloudAgnosticRegions[j].ID
+	})
+	return cloudAgnosticRegions
+}
+
+// CreateResources uploads the ssh key, creates the tag, the firewall and the droplet. Every resource is tracked
+// as soon as it exists, so that it's deleted even when a later step fails.
+func (repo *DigitalOceanRepository) CreateResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	repo.Region = region
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	name := "sockv5er-" + suffix
+	repo.SSHKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	repo.HostKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	log.Infof("Host key with fingerprint `%s` generated for the droplet.\n", repo.HostKey.Fingerprint())
+	err = repo.CreateSSHKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	log.Infof("SSH key `%s` uploaded.\n", repo.SSHKeyId)
+	tracker.Update(repo.trackedResource(), Add)
+	err = repo.Client.do(ctx, http.MethodPost, "tags", map[string]string{"name": name}, nil)
+	if err != nil {
+		return err
+	}
+	repo.Tag = name
+	tracker.Update(repo.trackedResource(), Add)
+	err = repo.CreateFirewall(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof("Firewall `%s` created.\n", repo.FirewallId)
+	tracker.Update(repo.trackedResource(), Add)
+	err = repo.CreateDroplet(ctx, s.InstanceGracePeriod)
+	if err != nil {
+		return err
+	}
+	log.Infof("Droplet `%s` created.\n", repo.DropletId)
+	tracker.Update(repo.trackedResource(), Add)
+	repo.DropletIP, err = repo.WaitUntilDropletIsActive(ctx)
+	return err
+}
+
+func (repo *DigitalOceanRepository) CreateSSHKey(ctx context.Context, name string) error {
+	var response struct {
+		SSHKey struct {
+			Id int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err := repo.Client.do(ctx, http.MethodPost, "account/keys", map[string]string{
+		"name":       name,
+		"public_key": repo.SSHKey.AuthorizedKey(),
+	}, &response)
+	if err != nil {
+		return err
+	}
+	repo.SSHKeyId = strconv.Itoa(response.SSHKey.Id)
+	return nil
+}
+
+// CreateFirewall allows ssh from the external IP to the droplets with the tag of the session.
+func (repo *DigitalOceanRepository) CreateFirewall(ctx context.Context) error {
+	externalIP, err := repo.externalIP()
+	if err != nil {
+		externalIP = "0.0.0.0/0"
+	} else {
+		externalIP = externalIP + "/32"
+	}
+	everywhere := map[string]interface{}{"addresses": []string{"0.0.0.0/0", "::/0"}}
+	var response struct {
+		Firewall struct {
+			Id string `json:"id"`
+		} `json:"firewall"`
+	}
+	err = repo.Client.do(ctx, http.MethodPost, "firewalls", map[string]interface{}{
+		"name": repo.Tag,
+		"tags": []string{repo.Tag},
+		"inbound_rules": []map[string]interface{}{{
+			"protocol": "tcp",
+			"ports":    "22",
+			"sources":  map[string]interface{}{"addresses": []string{externalIP}},
+		}},
+		// A firewall without outbound rules blocks all outgoing traffic of the droplet.
+		"outbound_rules": []map[string]interface{}{
+			{"protocol": "tcp", "ports": "all", "destinations": everywhere},
+			{"protocol": "udp", "ports": "all", "destinations": everywhere},
+			{"protocol": "icmp", "destinations": everywhere},
+		},
+	}, &response)
+	if err != nil {
+		return err
+	}
+	repo.FirewallId = response.Firewall.Id
+	return nil
+}
+
+// CreateDroplet creates the droplet. It only deletes itself once the heartbeats stop when there is a self destruct
+// token, the token of the client would give whoever gets onto the droplet the whole account.
+func (repo *DigitalOceanRepository) CreateDroplet(ctx context.Context, gracePeriod time.Duration) error {
+	options := cloudInitOptions{HostKey: repo.HostKey, GracePeriod: gracePeriod}
+	if repo.SelfDestructToken != "" {
+		options.ShutdownCommand = digitalOceanSelfDestructFilepath + "; shutdown -h now"
+		options.WriteFiles = []cloudConfigFile{
+			{Path: digitalOceanTokenFilepath, Permissions: "0600", Content: repo.SelfDestructToken},
+			{
+				Path:        digitalOceanSelfDestructFilepath,
+				Permissions: "0700",
+				Content:     fmt.Sprintf(digitalOceanSelfDestructScript, digitalOceanTokenFilepath, repo.Client.Endpoint),
+			},
+		}
+	} else {
+		log.Warnf("digitalocean_self_destruct_token isn't set, the droplet only powers off once the heartbeats stop and is billed until `sockv5er cleanup` deletes it.\n")
+	}
+	userdata, err := options.userData()
+	if err != nil {
+		return err
+	}
+	sshKeyId, err := strconv.Atoi(repo.SSHKeyId)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Droplet struct {
+			Id int `json:"id"`
+		} `json:"droplet"`
+	}
+	err = repo.Client.do(ctx, http.MethodPost, "droplets", map[string]interface{}{
+		"name":      repo.Tag,
+		"region":    repo.Region,
+		"size":      digitalOceanSize,
+		"image":     digitalOceanImage,
+		"ssh_keys":  []int{sshKeyId},
+		"tags":      []string{repo.Tag},
+		"user_data": userdata,
+	}, &response)
+	if err != nil {
+		return err
+	}
+	repo.DropletId = strconv.Itoa(response.Droplet.Id)
+	return nil
+}
+
+func (repo *DigitalOceanRepository) WaitUntilDropletIsActive(ctx context.Context) (string, error) {
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		var response struct {
+			Droplet struct {
+				Status   string `json:"status"`
+				Networks struct {
+					V4 []struct {
+						IPAddress string `json:"ip_address"`
+						Type      string `json:"type"`
+					} `json:"v4"`
+				} `json:"networks"`
+			} `json:"droplet"`
+		}
+		err := repo.Client.do(ctx, http.MethodGet, "droplets/"+repo.DropletId, nil, &response)
+		if err != nil {
+			return "", err
+		}
+		if response.Droplet.Status == "active" {
+			for _, network := range response.Droplet.Networks.V4 {
+				if network.Type == "public" {
+					log.Infoln("Droplet is ready.")
+					return network.IPAddress, nil
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("droplet `%s` isn't active after 5 minutes, its status is %s", repo.DropletId, response.Droplet.Status)
+		}
+		err = sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func (repo *DigitalOceanRepository) DeleteResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	repo.Region = region
+	resource := repo.trackedResource()
+	deletions := []struct {
+		kind string
+		id   string
+		path string
+	}{
+		{"Droplet", repo.DropletId, "droplets/"},
+		{"Firewall", repo.FirewallId, "firewalls/"},
+		{"SSH key", repo.SSHKeyId, "account/keys/"},
+		{"Tag", repo.Tag, "tags/"},
+	}
+	for _, deletion := range deletions {
+		if deletion.id == "" {
+			continue
+		}
+		err := repo.Client.do(ctx, http.MethodDelete, deletion.path+deletion.id, nil, nil)
+		// The droplet may have deleted itself already.
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Warnf("%s deletion failed with error: %s", deletion.kind, err)
+			return err
+		}
+		log.Infof("%s `%s` deleted.\n", deletion.kind, deletion.id)
+	}
+	tracker.Update(resource, Remove)
+	return nil
+}
+
+func (repo *DigitalOceanRepository) PrepareResourcesForDeletion(resource TrackedResource) {
+	res := resource.DigitalOcean
+	repo.Region = res.Region
+	repo.DropletId = res.DropletId
+	repo.FirewallId = res.FirewallId
+	repo.SSHKeyId = res.SSHKeyId
+	repo.Tag = res.Tag
+}
+
+func (repo *DigitalOceanRepository) GetHostIP() string {
+	return repo.DropletIP
+}
+
+func (repo *DigitalOceanRepository) GetPrivateKey() []byte {
+	if repo.SSHKey == nil {
+		return nil
+	}
+	return repo.SSHKey.PrivateKeyPEM
+}
+
+func (repo *DigitalOceanRepository) GetHostPublicKey() ssh.PublicKey {
+	if repo.HostKey == nil {
+		return nil
+	}
+	return repo.HostKey.PublicKey
+}
+
+func (repo *DigitalOceanRepository) GetSSHUsername() string {
+	return digitalOceanSSHUsername
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDigitalOcean is a local stand-in for the parts of the DigitalOcean API sockv5er uses.
+type fakeDigitalOcean struct {
+	nextId    int
+	keys      map[string]map[string]interface{}
+	tags      map[string]bool
+	firewalls map[string]map[string]interface{}
+	droplets  map[string]map[string]interface{}
+	// polls counts the droplet requests, the droplet becomes active on the second one.
+	polls int
+}
+
+func startFakeDigitalOcean(t *testing.T) (*fakeDigitalOcean, *httptest.Server) {
+	fake := &fakeDigitalOcean{
+		nextId:    100,
+		keys:      map[string]map[string]interface{}{},
+		tags:      map[string]bool{},
+		firewalls: map[string]map[string]interface{}{},
+		droplets:  map[string]map[string]interface{}{},
+	}
+	return fake, startFakeAPI(t, fake.serve)
+}
+
+func (f *fakeDigitalOcean) serve(r *fakeRequest) {
+	remove := func(resources map[string]map[string]interface{}, id string) {
+		if _, found := resources[id]; !found {
+			r.reply(http.StatusNotFound, map[string]string{"id": "not_found", "message": "The resource you were accessing could not be found."})
+			return
+		}
+		delete(resources, id)
+		r.w.WriteHeader(http.StatusNoContent)
+	}
+	f.nextId++
+	id := strconv.Itoa(f.nextId)
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet && path == "regions":
+		r.reply(http.StatusOK, map[string]interface{}{"regions": []map[string]interface{}{
+			{"slug": "nyc3", "name": "New York 3", "available": true, "sizes": []string{digitalOceanSize}},
+			{"slug": "fra1", "name": "Frankfurt 1", "available": true, "sizes": []string{digitalOceanSize}},
+			{"slug": "nyc2", "available": false, "sizes": []string{digitalOceanSize}},
+			{"slug": "ams3", "available": true, "sizes": []string{"s-2vcpu-4gb"}},
+		}})
+	case r.Method == http.MethodPost && path == "account/keys":
+		f.keys[id] = r.decode()
+		r.reply(http.StatusCreated, map[string]interface{}{"ssh_key": map[string]interface{}{"id": f.nextId}})
+	case r.Method == http.MethodPost && path == "tags":
+		f.tags[r.decode()["name"].(string)] = true
+		r.reply(http.StatusCreated, map[string]interface{}{"tag": map[string]interface{}{}})
+	case r.Method == http.MethodPost && path == "firewalls":
+		body := r.decode()
+		for _, tag := range body["tags"].([]interface{}) {
+			if !f.tags[tag.(string)] {
+				r.reply(http.StatusUnprocessableEntity, map[string]string{"id": "unprocessable_entity", "message": "tag not found"})
+				return
+			}
+		}
+		f.firewalls["fw-"+id] = body
+		r.reply(http.StatusAccepted, map[string]interface{}{"firewall": map[string]string{"id": "fw-" + id}})
+	case r.Method == http.MethodPost && path == "droplets":
+		body := r.decode()
+		if body["region"] == "nowhere1" {
+			r.reply(http.StatusUnprocessableEntity, map[string]string{"id": "unprocessable_entity", "message": "region is not available"})
+			return
+		}
+		f.droplets[id] = body
+		r.reply(http.StatusAccepted, map[string]interface{}{"droplet": map[string]interface{}{"id": f.nextId, "status": "new"}})
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "droplets/"):
+		if _, found := f.droplets[strings.TrimPrefix(path, "droplets/")]; !found {
+			r.reply(http.StatusNotFound, map[string]string{"id": "not_found"})
+			return
+		}
+		f.polls++
+		droplet := map[string]interface{}{"status": "new", "networks": map[string]interface{}{"v4": []interface{}{}}}
+		if f.polls > 1 {
+			droplet = map[string]interface{}{"status": "active", "networks": map[string]interface{}{"v4": []map[string]string{
+				{"ip_address": "10.110.0.2", "type": "private"},
+				{"ip_address": "203.0.113.20", "type": "public"},
+			}}}
+		}
+		r.reply(http.StatusOK, map[string]interface{}{"droplet": droplet})
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "droplets/"):
+		remove(f.droplets, strings.TrimPrefix(path, "droplets/"))
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "firewalls/"):
+		remove(f.firewalls, strings.TrimPrefix(path, "firewalls/"))
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "account/keys/"):
+		remove(f.keys, strings.TrimPrefix(path, "account/keys/"))
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "tags/"):
+		delete(f.tags, strings.TrimPrefix(path, "tags/"))
+		r.w.WriteHeader(http.StatusNoContent)
+	default:
+		r.t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		r.w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestDigitalOceanRepository(server *httptest.Server) *DigitalOceanRepository {
+	return &DigitalOceanRepository{
+		Client:       &RESTClient{Endpoint: server.URL + "/", Token: "test-token", HTTP: server.Client()},
+		externalIP:   func() (string, error) { return "198.51.100.7", nil },
+		pollInterval: time.Millisecond,
+	}
+}
+
+func TestDigitalOceanGetRegions(t *testing.T) {
+	_, server := startFakeDigitalOcean(t)
+	regions := newTestDigitalOceanRepository(server).GetRegions(context.Background(), &Settings{})
+	if len(regions) != 2 {
+		t.Fatalf("Expected the available regions with the droplet size, got: %v", regions)
+	}
+	if regions[0] != (Region{ID: "fra1", Country: "Germany", City: "Frankfurt"}) {
+		t.Errorf("Unexpected region: %v", regions[0])
+	}
+	if regions[1] != (Region{ID: "nyc3", Country: "USA", City: "New York"}) {
+		t.Errorf("Unexpected region: %v", regions[1])
+	}
+}
+
+func TestDigitalOceanCreateAndDeleteResources(t *testing.T) {
+	fake, server := startFakeDigitalOcean(t)
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := newTestDigitalOceanRepository(server)
+	repo.SelfDestructToken = "droplet-delete-token"
+	err := repo.CreateResources(context.Background(), "fra1", &Settings{InstanceGracePeriod: 10 * time.Minute}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.GetHostIP() != "203.0.113.20" || repo.GetSSHUsername() != "root" || len(repo.GetPrivateKey()) == 0 {
+		t.Errorf("Unexpected connection details: %s %s", repo.GetHostIP(), repo.GetSSHUsername())
+	}
+	if repo.GetHostPublicKey() == nil {
+		t.Error("Expected a pinned host key")
+	}
+	if key := fake.keys[repo.SSHKeyId]; key == nil || key["public_key"] != repo.SSHKey.AuthorizedKey() {
+		t.Errorf("Unexpected ssh key: %v", key)
+	}
+	firewall, _ := json.Marshal(fake.firewalls[repo.FirewallId])
+	if !strings.Contains(string(firewall), `"sources":{"addresses":["198.51.100.7/32"]}`) {
+		t.Errorf("The firewall isn't limited to the external IP: %s", firewall)
+	}
+	droplet := fake.droplets[repo.DropletId]
+	if droplet == nil || droplet["size"] != digitalOceanSize || droplet["region"] != "fra1" {
+		t.Fatalf("Unexpected droplet: %v", droplet)
+	}
+	userdata := droplet["user_data"].(string)
+	if !strings.Contains(userdata, repo.HostKey.AuthorizedKey()) || !strings.Contains(userdata, digitalOceanSelfDestructFilepath) {
+		t.Error("The user data doesn't contain the host key and the self destruct script")
+	}
+	if !strings.Contains(userdata, repo.SelfDestructToken) || strings.Contains(userdata, repo.Client.Token) {
+		t.Error("The droplet should get the self destruct token and never the token of the client")
+	}
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 1 || tracked[0].Kind != ProviderDigitalOcean || tracked[0].DigitalOcean.DropletId != repo.DropletId ||
+		tracked[0].DigitalOcean.FirewallId != repo.FirewallId || tracked[0].DigitalOcean.SSHKeyId != repo.SSHKeyId {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+
+	// The droplet deleted itself already.
+	delete(fake.droplets, repo.DropletId)
+	cleanup := newTestDigitalOceanRepository(server)
+	cleanup.PrepareResourcesForDeletion(tracked[0])
+	err = cleanup.DeleteResources(context.Background(), tracked[0].Region(), &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.keys) != 0 || len(fake.firewalls) != 0 || len(fake.tags) != 0 {
+		t.Error("The resources weren't deleted")
+	}
+	if len(tracker.TrackedResources()) != 0 {
+		t.Error("The deleted resources are still tracked")
+	}
+}
+
+func TestDigitalOceanTracksPartiallyCreatedResources(t *testing.T) {
+	_, server := startFakeDigitalOcean(t)
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := newTestDigitalOceanRepository(server)
+	err := repo.CreateResources(context.Background(), "nowhere1", &Settings{}, tracker)
+	if err == nil || !strings.Contains(err.Error(), "region is not available") {
+		t.Fatalf("Expected the droplet creation to fail, got: %v", err)
+	}
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 1 || tracked[0].DigitalOcean.SSHKeyId != repo.SSHKeyId || tracked[0].DigitalOcean.FirewallId != repo.FirewallId ||
+		tracked[0].DigitalOcean.Tag != repo.Tag || tracked[0].DigitalOcean.DropletId != "" {
+		t.Errorf("Expected the created resources to be tracked, got: %v", tracked)
+	}
+}
+
+func TestDigitalOceanDropletWithoutSelfDestructToken(t *testing.T) {
+	fake, server := startFakeDigitalOcean(t)
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := newTestDigitalOceanRepository(server)
+	err := repo.CreateResources(context.Background(), "fra1", &Settings{InstanceGracePeriod: 10 * time.Minute}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userdata := fake.droplets[repo.DropletId]["user_data"].(string)
+	if strings.Contains(userdata, digitalOceanSelfDestructFilepath) || strings.Contains(userdata, repo.Client.Token) {
+		t.Error("The droplet shouldn't get a token without a self destruct token")
+	}
+}
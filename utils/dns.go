@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// defaultDNSUpstream answers the lookups the routing rules need when no dns_upstream is configured.
+const defaultDNSUpstream = "1.1.1.1:53"
+
+// remoteResolver keeps host names unresolved, so go-socks5 dials the FQDN and the instance resolves it.
+type remoteResolver struct{}
+
+func (remoteResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// TunnelResolver resolves host names with DNS over TCP to Upstream, reached through the tunnel.
+// Nothing is sent to the local resolvers, only the hosts file is consulted first.
+type TunnelResolver struct {
+	Upstream string
+	resolver *net.Resolver
+}
+
+func NewTunnelResolver(upstream string, dial func(network, addr string) (net.Conn, error)) *TunnelResolver {
+	return &TunnelResolver{
+		Upstream: upstream,
+		resolver: &net.Resolver{
+			PreferGo: true,
+			// The Go resolver frames the queries for TCP because an ssh channel isn't a net.PacketConn.
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dial("tcp", upstream)
+			},
+		},
+	}
+}
+
+// LookupIP returns the first IPv4 address of the host.
+func (r *TunnelResolver) LookupIP(ctx context.Context, host string) (net.IP, error) {
+	ips, err := r.resolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IPv4 address found for `%s`", host)
+	}
+	return ips[0], nil
+}
+
+// Resolve implements socks5.NameResolver.
+func (r *TunnelResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ip, err := r.LookupIP(ctx, name)
+	return ctx, ip, err
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// failLocalDNS makes every lookup with the local resolvers fail the test.
+func failLocalDNS(t *testing.T) {
+	original := net.DefaultResolver
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			t.Errorf("Unexpected local DNS lookup through %s", address)
+			return nil, errors.New("local DNS is disabled in this test")
+		},
+	}
+	t.Cleanup(func() { net.DefaultResolver = original })
+}
+
+// startTestDNSServer answers every A query over TCP with ip.
+func startTestDNSServer(t *testing.T, ip net.IP) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go answerDNSQueries(conn, ip.To4())
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func answerDNSQueries(conn net.Conn, ip net.IP) {
+	defer conn.Close()
+	for {
+		var length uint16
+		if binary.Read(conn, binary.BigEndian, &length) != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil || len(query) < 12 {
+			return
+		}
+		// The question is the name followed by the type and the class.
+		end := 12
+		for end < len(query) && query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		end += 5
+		if end > len(query) {
+			return
+		}
+		response := append([]byte{}, query[:2]...)
+		response = append(response, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0)
+		response = append(response, query[12:end]...)
+		response = append(response, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		response = append(response, ip...)
+		if binary.Write(conn, binary.BigEndian, uint16(len(response))) != nil {
+			return
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+// socksConnect asks the socksv5 server at addr to connect to the host name.
+func socksConnect(t *testing.T, addr string, host string, port int) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 || reply[3] != 0 {
+		t.Fatalf("The socksv5 server refused the connection: %v", reply)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn
+}
+
+func startTestSocksV5Server(t *testing.T, config *SSHConfig, tunnel func(network, addr string) (net.Conn, error)) string {
+	conf, _ := config.socksV5Config(tunnel, nil)
+	server, err := socks5.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() { _ = server.Serve(listener) }()
+	return listener.Addr().String()
+}
+
+func TestSocksV5PassesHostNamesToTheInstance(t *testing.T) {
+	failLocalDNS(t)
+	server := startTestSSHServer(t)
+	_, echoPort, _ := net.SplitHostPort(startEchoServer(t))
+	server.addHost("echo.sockv5er.invalid", "127.0.0.1")
+	sc, err := NewSupervisedClient(server.sshConfig().connectToSSH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	socksAddr := startTestSocksV5Server(t, &SSHConfig{}, sc.Dial)
+
+	port, _ := strconv.Atoi(echoPort)
+	assertEcho(t, socksConnect(t, socksAddr, "echo.sockv5er.invalid", port))
+	dialed := server.dialed()
+	if len(dialed) != 1 || dialed[0] != net.JoinHostPort("echo.sockv5er.invalid", echoPort) {
+		t.Errorf("Expected the instance to dial the host name, got: %v", dialed)
+	}
+}
+
+func TestSocksV5ResolvesThroughTheTunnel(t *testing.T) {
+	failLocalDNS(t)
+	server := startTestSSHServer(t)
+	echoAddr := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+	dnsAddr := startTestDNSServer(t, net.ParseIP("127.0.0.1"))
+	sc, err := NewSupervisedClient(server.sshConfig().connectToSSH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	socksAddr := startTestSocksV5Server(t, &SSHConfig{DNSUpstream: dnsAddr}, sc.Dial)
+
+	port, _ := strconv.Atoi(echoPort)
+	assertEcho(t, socksConnect(t, socksAddr, "echo.sockv5er.invalid", port))
+	dialed := server.dialed()
+	if len(dialed) != 2 || dialed[0] != dnsAddr || dialed[1] != echoAddr {
+		t.Errorf("Expected the DNS query and the connection to go through the tunnel, got: %v", dialed)
+	}
+}
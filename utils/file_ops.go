@@ -5,6 +5,10 @@ import (
 	log "github.com/sirupsen/logrus"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 func ReadFileContent(filepath string) ([]byte, error) {
@@ -24,6 +28,35 @@ func WriteFileContent(filepath string, fileContent []byte) error {
 	return nil
 }
 
+// writeFileAtomically replaces the file at path with the content. The content goes to a temporary file
+// which is synced and renamed over the file, so a crash leaves either the old or the new content.
+func writeFileAtomically(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	// Syncing the directory makes the rename durable, windows doesn't support it and needs no sync.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
 func CheckIfResourcesYAMLExistsAndReturnPath() (bool, string) {
 	homeDir, _ := os.UserHomeDir()
 	currentDir, _ := os.UserHomeDir()
@@ -71,3 +104,80 @@ func CreateSockV5erDirectory() string {
 	}
 	return resourcesFilepath
 }
+
+// sessionPIDFilepath is the pid file of the named session. The default session keeps the name it had
+// before sessions were named, so `sockv5er down` of an older version still finds it.
+func sessionPIDFilepath(name string) string {
+	filename := "sockv5er.pid"
+	if name != defaultSessionName {
+		filename = "sockv5er-" + name + ".pid"
+	}
+	return filepath.Join(CreateSockV5erDirectory(), filename)
+}
+
+func writeSessionPID(name string, pid int) error {
+	return WriteFileContent(sessionPIDFilepath(name), []byte(strconv.Itoa(pid)))
+}
+
+func removeSessionPID(name string) {
+	err := os.Remove(sessionPIDFilepath(name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Removing the session pid file failed with error: %s\n", err)
+	}
+}
+
+// runningSessionPID returns the pid recorded by `sockv5er up` for the named session and whether that process is still alive.
+func runningSessionPID(name string) (int, bool) {
+	content, err := os.ReadFile(sessionPIDFilepath(name))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid == os.Getpid() {
+		return 0, false
+	}
+	return pid, isProcessAlive(pid)
+}
+
+// runningSessions returns the pids of the sessions whose `sockv5er up` is still alive by the name of the session.
+func runningSessions() map[string]int {
+	sessions := make(map[string]int)
+	paths, _ := filepath.Glob(filepath.Join(CreateSockV5erDirectory(), "sockv5er*.pid"))
+	for _, path := range paths {
+		name := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(path), ".pid"), "sockv5er")
+		if name == "" {
+			name = defaultSessionName
+		} else if name = strings.TrimPrefix(name, "-"); validateSessionName(name) != nil {
+			continue
+		}
+		if pid, running := runningSessionPID(name); running {
+			sessions[name] = pid
+		}
+	}
+	return sessions
+}
+
+func isProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess only succeeds for live processes on windows.
+		return true
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// stopProcess asks the process to exit so that it can clean up after itself.
+// Windows has no SIGTERM, so the process is killed there instead.
+func stopProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return process.Kill()
+	}
+	return process.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,634 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	gcpComputeEndpoint = "https://compute.googleapis.com/compute/v1/"
+	gcpComputeScope    = "https://www.googleapis.com/auth/compute"
+	gcpMachineType     = "e2-micro"
+	// Ubuntu runs cloud-init from the user-data metadata, the Debian images don't.
+	gcpSourceImage = "projects/ubuntu-os-cloud/global/images/family/ubuntu-2204-lts"
+	gcpSSHUsername = "sockv5er"
+)
+
+// gcpSelfDeleteScript deletes the instance with the token of the self delete service account, so that
+// a stopped instance doesn't keep its disk around after the heartbeats stop.
+const gcpSelfDeleteScript = `#!/bin/sh
+METADATA=http://metadata.google.internal/computeMetadata/v1
+get() { curl -s -H "Metadata-Flavor: Google" "$METADATA/$1"; }
+NAME=$(get instance/name)
+ZONE=$(get instance/zone)
+PROJECT=$(get project/project-id)
+TOKEN=$(get instance/service-accounts/default/token | sed -E 's/.*"access_token" *: *"([^"]+)".*/\1/')
+curl -s -X DELETE -H "Authorization: Bearer $TOKEN" \
+  "https://compute.googleapis.com/compute/v1/projects/$PROJECT/zones/${ZONE##*/}/instances/$NAME"
+`
+
+const gcpSelfDeleteFilepath = "/usr/local/bin/sockv5er-self-delete"
+
+// gcpRegionCountries maps the Compute Engine regions to the country they are in.
+// The zones don't have an endpoint of their own, so the ip2location lookup used for AWS doesn't work.
+var gcpRegionCountries = map[string]string{
+	"africa-south1":           "South Africa",
+	"asia-east1":              "Taiwan",
+	"asia-east2":              "Hong Kong",
+	"asia-northeast1":         "Japan",
+	"asia-northeast2":         "Japan",
+	"asia-northeast3":         "S.Korea",
+	"asia-south1":             "India",
+	"asia-south2":             "India",
+	"asia-southeast1":         "Singapore",
+	"asia-southeast2":         "Indonesia",
+	"australia-southeast1":    "Australia",
+	"australia-southeast2":    "Australia",
+	"europe-central2":         "Poland",
+	"europe-north1":           "Finland",
+	"europe-southwest1":       "Spain",
+	"europe-west1":            "Belgium",
+	"europe-west10":           "Germany",
+	"europe-west12":           "Italy",
+	"europe-west2":            "UK",
+	"europe-west3":            "Germany",
+	"europe-west4":            "Netherlands",
+	"europe-west6":            "Switzerland",
+	"europe-west8":            "Italy",
+	"europe-west9":            "France",
+	"me-central1":             "Qatar",
+	"me-central2":             "Saudi Arabia",
+	"me-west1":                "Israel",
+	"northamerica-northeast1": "Canada",
+	"northamerica-northeast2": "Canada",
+	"southamerica-east1":      "Brazil",
+	"southamerica-west1":      "Chile",
+	"us-central1":             "USA",
+	"us-east1":                "USA",
+	"us-east4":                "USA",
+	"us-east5":                "USA",
+	"us-south1":               "USA",
+	"us-west1":                "USA",
+	"us-west2":                "USA",
+	"us-west3":                "USA",
+	"us-west4":                "USA",
+}
+
+type GCPRepository struct {
+	Client       *GCPClient
+	Project      string
+	Zone         string
+	InstanceName string
+	FirewallName string
+	InstanceIP   string
+	SSHKey       *HostKey
+	HostKey      ssh.PublicKey
+	// SelfDeleteServiceAccount is the service account the instance deletes itself with, the instance gets no other.
+	SelfDeleteServiceAccount string
+	gracePeriod              time.Duration
+	externalIP               func() (string, error)
+	pollInterval             time.Duration
+}
+
+func NewGCPProvider() CloudProvider {
+	return &GCPRepository{externalIP: GetExternalIP, pollInterval: 2 * time.Second}
+}
+
+func (repo *GCPRepository) Initialize(ctx context.Context, s *Settings) error {
+	client, err := NewGCPClient(s)
+	if err != nil {
+		return err
+	}
+	repo.Client = client
+	repo.Project = client.Project
+	repo.SelfDeleteServiceAccount = s.GCPSelfDeleteServiceAccount
+	return nil
+}
+
+func (repo *GCPRepository) trackedResource() TrackedResource {
+	return TrackedResource{Kind: ProviderGCP, GCP: &GCPResource{
+		Region:       repo.Zone,
+		Project:      repo.Project,
+		InstanceName: repo.InstanceName,
+		FirewallName: repo.FirewallName,
+	}}
+}
+
+// GetRegions returns one zone per region, the zones of a region all exit from the same country.
+func (repo *GCPRepository) GetRegions(ctx context.Context, s *Settings) []Region {
+	var zones struct {
+		Items []struct {
+			Name   string `json:"name"`
+			Region string `json:"region"`
+			Status string `json:"status"`
+		} `json:"items"`
+	}
+	err := repo.Client.do(ctx, http.MethodGet, repo.projectPath("zones"), nil, &zones)
+	if err != nil {
+		log.Warnf("Listing the zones failed with error: %s\n", err)
+		return []Region{}
+	}
+	zoneByRegion := make(map[string]string)
+	for _, zone := range zones.Items {
+		region := lastPathSegment(zone.Region)
+		if zone.Status != "UP" {
+			continue
+		}
+		if current, found := zoneByRegion[region]; !found || zone.Name < current {
+			zoneByRegion[region] = zone.Name
+		}
+	}
+	regions := make([]string, 0, len(zoneByRegion))
+	for region := range zoneByRegion {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	cloudAgnosticRegions := make([]Region, 0, len(regions))
+	for _, region := range regions {
+		country, found := gcpRegionCountries[region]
+		if !found {
+			country = "Unknown"
+		}
+		cloudAgnosticRegions = append(cloudAgnosticRegions, Region{ID: zoneByRegion[region], Country: country})
+	}
+	return cloudAgnosticRegions
+}
+
+// CreateResources creates the firewall rule and the instance in the zone. The instance is tracked
+// before waiting for it, so that it's deleted even when it never comes up.
+func (repo *GCPRepository) CreateResources(ctx context.Context, zone string, s *Settings, tracker *ResourceTracker) error {
+	repo.Zone = zone
+	repo.gracePeriod = s.InstanceGracePeriod
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	name := "sockv5er-" + suffix
+	err = repo.CreateFirewall(ctx, name)
+	if err != nil {
+		tracker.Update(repo.trackedResource(), Add)
+		return err
+	}
+	log.Infof("Firewall rule `%s` created.\n", repo.FirewallName)
+	repo.SSHKey, err = GenerateHostKey()
+	if err != nil {
+		tracker.Update(repo.trackedResource(), Add)
+		return err
+	}
+	err = repo.CreateInstance(ctx, name)
+	if err != nil {
+		tracker.Update(repo.trackedResource(), Add)
+		return err
+	}
+	log.Infof("Instance `%s` created.\n", repo.InstanceName)
+	tracker.Update(repo.trackedResource(), Add)
+	repo.InstanceIP, err = repo.WaitUntilInstanceIsRunning(ctx)
+	if err != nil {
+		return err
+	}
+	repo.HostKey, err = repo.WaitForHostKey(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof("Host key with fingerprint `%s` published by the instance.\n", ssh.FingerprintSHA256(repo.HostKey))
+	return nil
+}
+
+func (repo *GCPRepository) CreateFirewall(ctx context.Context, name string) error {
+	externalIP, err := repo.externalIP()
+	if err != nil {
+		externalIP = "0.0.0.0/0"
+	} else {
+		externalIP = externalIP + "/32"
+	}
+	firewall := map[string]interface{}{
+		"name":         name,
+		"description":  "Created by sockv5er with just ssh enabled.",
+		"network":      "global/networks/default",
+		"direction":    "INGRESS",
+		"sourceRanges": []string{externalIP},
+		"targetTags":   []string{name},
+		"allowed":      []map[string]interface{}{{"IPProtocol": "tcp", "ports": []string{"22"}}},
+	}
+	// The name is kept before the insert, so that DeleteResources also removes a firewall rule whose
+	// insert was interrupted. Deleting what doesn't exist succeeds.
+	repo.FirewallName = name
+	return repo.Client.wait(ctx, repo.projectPath("global/firewalls"), firewall, repo.pollInterval)
+}
+
+// CreateInstance creates the instance. It only deletes itself once the heartbeats stop when there is a self delete
+// service account, without one the instance runs without any service account, so that whoever gets onto it gets
+// no access to the project.
+func (repo *GCPRepository) CreateInstance(ctx context.Context, name string) error {
+	options := cloudInitOptions{GracePeriod: repo.gracePeriod}
+	serviceAccounts := []map[string]interface{}{}
+	if repo.SelfDeleteServiceAccount != "" {
+		options.ShutdownCommand = gcpSelfDeleteFilepath + "; shutdown -h now"
+		options.WriteFiles = []cloudConfigFile{{Path: gcpSelfDeleteFilepath, Permissions: "0755", Content: gcpSelfDeleteScript}}
+		serviceAccounts = []map[string]interface{}{{"email": repo.SelfDeleteServiceAccount, "scopes": []string{gcpComputeScope}}}
+	} else {
+		log.Warnf("gcp_self_delete_service_account isn't set, the instance only powers off once the heartbeats stop and its disk is billed until `sockv5er cleanup` deletes it.\n")
+	}
+	userdata, err := options.userData()
+	if err != nil {
+		return err
+	}
+	instance := map[string]interface{}{
+		"name":        name,
+		"machineType": fmt.Sprintf("zones/%s/machineTypes/%s", repo.Zone, gcpMachineType),
+		"tags":        map[string]interface{}{"items": []string{name}},
+		"disks": []map[string]interface{}{{
+			"boot":             true,
+			"autoDelete":       true,
+			"initializeParams": map[string]interface{}{"sourceImage": gcpSourceImage},
+		}},
+		"networkInterfaces": []map[string]interface{}{{
+			"network":       "global/networks/default",
+			"accessConfigs": []map[string]interface{}{{"type": "ONE_TO_ONE_NAT", "name": "External NAT"}},
+		}},
+		"serviceAccounts": serviceAccounts,
+		"metadata": map[string]interface{}{"items": []map[string]string{
+			{"key": "ssh-keys", "value": fmt.Sprintf("%s:%s %s", gcpSSHUsername, repo.SSHKey.AuthorizedKey(), gcpSSHUsername)},
+			{"key": "user-data", "value": userdata},
+			// The guest agent publishes the host keys it generates as guest attributes.
+			{"key": "enable-guest-attributes", "value": "TRUE"},
+		}},
+	}
+	repo.InstanceName = name
+	return repo.Client.wait(ctx, repo.zonePath("instances"), instance, repo.pollInterval)
+}
+
+func (repo *GCPRepository) WaitUntilInstanceIsRunning(ctx context.Context) (string, error) {
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		var instance struct {
+			Status            string `json:"status"`
+			NetworkInterfaces []struct {
+				AccessConfigs []struct {
+					NatIP string `json:"natIP"`
+				} `json:"accessConfigs"`
+			} `json:"networkInterfaces"`
+		}
+		err := repo.Client.do(ctx, http.MethodGet, repo.zonePath("instances/"+repo.InstanceName), nil, &instance)
+		if err != nil {
+			return "", err
+		}
+		if instance.Status == "RUNNING" && len(instance.NetworkInterfaces) > 0 &&
+			len(instance.NetworkInterfaces[0].AccessConfigs) > 0 && instance.NetworkInterfaces[0].AccessConfigs[0].NatIP != "" {
+			log.Infoln("Instance is ready.")
+			return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("instance `%s` isn't running after 5 minutes, its status is %s", repo.InstanceName, instance.Status)
+		}
+		err = sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// WaitForHostKey reads the host key the guest agent publishes once sshd is set up.
+func (repo *GCPRepository) WaitForHostKey(ctx context.Context) (ssh.PublicKey, error) {
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		var attributes struct {
+			QueryValue struct {
+				Items []struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+				} `json:"items"`
+			} `json:"queryValue"`
+		}
+		err := repo.Client.do(ctx, http.MethodGet, repo.zonePath("instances/"+repo.InstanceName+"/getGuestAttributes?queryPath=hostkeys%2F"), nil, &attributes)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		keys := make(map[string]string)
+		for _, item := range attributes.QueryValue.Items {
+			keys[item.Key] = item.Value
+		}
+		for _, keyType := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256} {
+			if keys[keyType] == "" {
+				continue
+			}
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyType + " " + keys[keyType]))
+			if err != nil {
+				return nil, fmt.Errorf("the instance published an invalid host key: %w", err)
+			}
+			return key, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("instance `%s` didn't publish its host key within 5 minutes", repo.InstanceName)
+		}
+		err = sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (repo *GCPRepository) DeleteResources(ctx context.Context, zone string, s *Settings, tracker *ResourceTracker) error {
+	repo.Zone = zone
+	resource := repo.trackedResource()
+	if repo.InstanceName != "" {
+		err := repo.Client.waitDelete(ctx, repo.zonePath("instances/"+repo.InstanceName), repo.pollInterval)
+		if err != nil {
+			log.Warnf("Compute Engine instance deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Instance `%s` deleted.\n", repo.InstanceName)
+	}
+	if repo.FirewallName != "" {
+		err := repo.Client.waitDelete(ctx, repo.projectPath("global/firewalls/"+repo.FirewallName), repo.pollInterval)
+		if err != nil {
+			log.Warnf("Firewall rule deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Firewall rule `%s` deleted.\n", repo.FirewallName)
+	}
+	tracker.Update(resource, Remove)
+	return nil
+}
+
+func (repo *GCPRepository) PrepareResourcesForDeletion(resource TrackedResource) {
+	res := resource.GCP
+	repo.Zone = res.Region
+	repo.InstanceName = res.InstanceName
+	repo.FirewallName = res.FirewallName
+	// Resources tracked in another project are deleted there.
+	if res.Project != "" {
+		repo.Project = res.Project
+	}
+}
+
+func (repo *GCPRepository) GetHostIP() string {
+	return repo.InstanceIP
+}
+
+func (repo *GCPRepository) GetPrivateKey() []byte {
+	if repo.SSHKey == nil {
+		return nil
+	}
+	return repo.SSHKey.PrivateKeyPEM
+}
+
+func (repo *GCPRepository) GetHostPublicKey() ssh.PublicKey {
+	return repo.HostKey
+}
+
+func (repo *GCPRepository) GetSSHUsername() string {
+	return gcpSSHUsername
+}
+
+func (repo *GCPRepository) projectPath(path string) string {
+	return fmt.Sprintf("projects/%s/%s", repo.Project, path)
+}
+
+func (repo *GCPRepository) zonePath(path string) string {
+	return repo.projectPath(fmt.Sprintf("zones/%s/%s", repo.Zone, path))
+}
+
+func lastPathSegment(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// GCPClient is a minimal client of the Compute Engine REST API.
+type GCPClient struct {
+	Endpoint string
+	Project  string
+	HTTP     *http.Client
+	token    func(ctx context.Context) (string, error)
+}
+
+// NewGCPClient authenticates with gcp_access_token, e.g. from `gcloud auth print-access-token`,
+// or with the service account key in gcp_credentials_file.
+func NewGCPClient(s *Settings) (*GCPClient, error) {
+	client := &GCPClient{Endpoint: gcpComputeEndpoint, Project: s.GCPProject, HTTP: &http.Client{Timeout: time.Minute}}
+	switch {
+	case s.GCPAccessToken != "":
+		client.token = func(context.Context) (string, error) { return s.GCPAccessToken, nil }
+	case s.GCPCredentialsFile != "":
+		account, err := readGCPServiceAccount(expandHomeDir(s.GCPCredentialsFile))
+		if err != nil {
+			return nil, err
+		}
+		if client.Project == "" {
+			client.Project = account.ProjectID
+		}
+		client.token = account.tokenSource(client.HTTP)
+	default:
+		return nil, errors.New("set gcp_access_token or gcp_credentials_file to use Google Cloud")
+	}
+	if client.Project == "" {
+		return nil, errors.New("set gcp_project to use Google Cloud")
+	}
+	return client, nil
+}
+
+func (c *GCPClient) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	token, err := c.token(ctx)
+	if err != nil {
+		return err
+	}
+	return doJSON(ctx, c.HTTP, method, c.Endpoint, path, token, body, out)
+}
+
+type gcpOperation struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+func (o *gcpOperation) err() error {
+	if o.Error == nil || len(o.Error.Errors) == 0 {
+		return nil
+	}
+	return fmt.Errorf("operation %s failed: %s: %s", o.Name, o.Error.Errors[0].Code, o.Error.Errors[0].Message)
+}
+
+// wait inserts body at path and waits for the operation to finish.
+func (c *GCPClient) wait(ctx context.Context, path string, body interface{}, interval time.Duration) error {
+	operation := &gcpOperation{}
+	err := c.do(ctx, http.MethodPost, path, body, operation)
+	if err != nil {
+		return err
+	}
+	return c.waitForOperation(ctx, projectOfPath(path, c.Project), operation, interval)
+}
+
+// waitDelete deletes path and waits for the operation to finish. Deleting something that's already gone succeeds.
+func (c *GCPClient) waitDelete(ctx context.Context, path string, interval time.Duration) error {
+	operation := &gcpOperation{}
+	err := c.do(ctx, http.MethodDelete, path, nil, operation)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.waitForOperation(ctx, projectOfPath(path, c.Project), operation, interval)
+}
+
+// projectOfPath is the project of a "projects/<project>/..." path, or fallback for other paths.
+func projectOfPath(path string, fallback string) string {
+	rest, found := strings.CutPrefix(path, "projects/")
+	if !found {
+		return fallback
+	}
+	project, _, _ := strings.Cut(rest, "/")
+	return project
+}
+
+// waitForOperation polls the operation, in the project which owns it, until it's done.
+func (c *GCPClient) waitForOperation(ctx context.Context, project string, operation *gcpOperation, interval time.Duration) error {
+	operationsPath := fmt.Sprintf("projects/%s/global/operations/%s", project, operation.Name)
+	if operation.Zone != "" {
+		operationsPath = fmt.Sprintf("projects/%s/zones/%s/operations/%s", project, lastPathSegment(operation.Zone), operation.Name)
+	}
+	deadline := time.Now().Add(5 * time.Minute)
+	for operation.Status != "DONE" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("operation %s didn't finish within 5 minutes", operation.Name)
+		}
+		err := sleepContext(ctx, interval)
+		if err != nil {
+			return err
+		}
+		err = c.do(ctx, http.MethodGet, operationsPath, nil, operation)
+		if err != nil {
+			return err
+		}
+	}
+	return operation.err()
+}
+
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	ProjectID   string `json:"project_id"`
+}
+
+func readGCPServiceAccount(path string) (*gcpServiceAccount, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	account := &gcpServiceAccount{}
+	err = json.Unmarshal(content, account)
+	if err != nil {
+		return nil, fmt.Errorf("`%s` is not a service account key: %w", path, err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" || account.TokenURI == "" {
+		return nil, fmt.Errorf("`%s` is not a service account key", path)
+	}
+	return account, nil
+}
+
+// tokenSource exchanges a signed JWT for access tokens (RFC 7523) and reuses them until shortly before they expire.
+func (a *gcpServiceAccount) tokenSource(client *http.Client) func(ctx context.Context) (string, error) {
+	var mu sync.Mutex
+	token := ""
+	expiry := time.Time{}
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && time.Now().Before(expiry) {
+			return token, nil
+		}
+		assertion, err := a.signedJWT(time.Now())
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response, err := client.Do(request)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		var result struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		if err != nil || response.StatusCode != http.StatusOK || result.AccessToken == "" {
+			return "", fmt.Errorf("getting an access token for `%s` failed with status %d", a.ClientEmail, response.StatusCode)
+		}
+		token = result.AccessToken
+		expiry = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+		return token, nil
+	}
+}
+
+func (a *gcpServiceAccount) signedJWT(now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return "", errors.New("the private key of the service account isn't PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("the private key of the service account isn't an RSA key")
+	}
+	encode := func(value interface{}) (string, error) {
+		content, err := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(content), err
+	}
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encode(map[string]interface{}{
+		"iss":   a.ClientEmail,
+		"scope": gcpComputeScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(header + "." + claims))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCompute is a local stand-in for the parts of the Compute Engine API sockv5er uses.
+type fakeCompute struct {
+	firewalls map[string]map[string]interface{}
+	instances map[string]map[string]interface{}
+	hostKey   *HostKey
+	// polled are the projects the operations were polled in.
+	polled []string
+}
+
+func startFakeCompute(t *testing.T) (*fakeCompute, *httptest.Server) {
+	hostKey, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeCompute{
+		firewalls: map[string]map[string]interface{}{},
+		instances: map[string]map[string]interface{}{},
+		hostKey:   hostKey,
+	}
+	return fake, startFakeAPI(t, fake.serve)
+}
+
+func (f *fakeCompute) serve(r *fakeRequest) {
+	project, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/projects/"), "/")
+	if strings.Contains(path, "operations/") {
+		f.polled = append(f.polled, project)
+	}
+	switch {
+	case r.Method == http.MethodGet && path == "zones":
+		r.reply(http.StatusOK, map[string]interface{}{"items": []map[string]string{
+			{"name": "europe-west3-b", "region": "https://compute/regions/europe-west3", "status": "UP"},
+			{"name": "europe-west3-a", "region": "https://compute/regions/europe-west3", "status": "UP"},
+			{"name": "us-central1-a", "region": "https://compute/regions/us-central1", "status": "DOWN"},
+			{"name": "us-central1-b", "region": "https://compute/regions/us-central1", "status": "UP"},
+		}})
+	case r.Method == http.MethodPost && path == "global/firewalls":
+		body := r.decode()
+		f.firewalls[body["name"].(string)] = body
+		// The firewall operation is polled until it's done.
+		r.reply(http.StatusOK, map[string]string{"name": "operation-firewall", "status": "RUNNING"})
+	case r.Method == http.MethodGet && path == "global/operations/operation-firewall":
+		r.reply(http.StatusOK, map[string]string{"name": "operation-firewall", "status": "DONE"})
+	case r.Method == http.MethodPost && path == "zones/europe-west3-a/instances":
+		body := r.decode()
+		f.instances[body["name"].(string)] = body
+		r.reply(http.StatusOK, map[string]string{"name": "operation-instance", "zone": "https://compute/zones/europe-west3-a", "status": "DONE"})
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/getGuestAttributes"):
+		parts := strings.Split(path, "/")
+		hostKey := strings.Fields(f.hostKey.AuthorizedKey())
+		if _, found := f.instances[parts[3]]; !found || r.URL.Query().Get("queryPath") != "hostkeys/" {
+			r.w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r.reply(http.StatusOK, map[string]interface{}{"queryValue": map[string]interface{}{"items": []map[string]string{
+			{"namespace": "hostkeys", "key": hostKey[0], "value": hostKey[1]},
+		}}})
+	case strings.HasPrefix(path, "zones/europe-west3-a/instances/"):
+		name := strings.TrimPrefix(path, "zones/europe-west3-a/instances/")
+		if _, found := f.instances[name]; !found {
+			r.w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.instances, name)
+			r.reply(http.StatusOK, map[string]string{"name": "operation-delete", "status": "DONE"})
+			return
+		}
+		r.reply(http.StatusOK, map[string]interface{}{
+			"status":            "RUNNING",
+			"networkInterfaces": []interface{}{map[string]interface{}{"accessConfigs": []interface{}{map[string]string{"natIP": "203.0.113.10"}}}},
+		})
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "global/firewalls/"):
+		name := strings.TrimPrefix(path, "global/firewalls/")
+		if _, found := f.firewalls[name]; !found {
+			r.w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.firewalls, name)
+		r.reply(http.StatusOK, map[string]string{"name": "operation-delete", "status": "DONE"})
+	default:
+		r.t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		r.w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestGCPRepository(server *httptest.Server) *GCPRepository {
+	return &GCPRepository{
+		Client: &GCPClient{
+			Endpoint: server.URL,
+			Project:  "test-project",
+			HTTP:     server.Client(),
+			token:    func(context.Context) (string, error) { return "test-token", nil },
+		},
+		Project:      "test-project",
+		externalIP:   func() (string, error) { return "198.51.100.7", nil },
+		pollInterval: time.Millisecond,
+	}
+}
+
+func TestGCPGetRegions(t *testing.T) {
+	_, server := startFakeCompute(t)
+	regions := newTestGCPRepository(server).GetRegions(context.Background(), &Settings{})
+	if len(regions) != 2 {
+		t.Fatalf("Expected one zone for each region with zones up, got: %v", regions)
+	}
+	if regions[0].ID != "europe-west3-a" || regions[0].Country != "Germany" {
+		t.Errorf("Unexpected region: %v", regions[0])
+	}
+	if regions[1].ID != "us-central1-b" || regions[1].Country != "USA" {
+		t.Errorf("Unexpected region: %v", regions[1])
+	}
+}
+
+func TestGCPCreateAndDeleteResources(t *testing.T) {
+	fake, server := startFakeCompute(t)
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := newTestGCPRepository(server)
+	repo.SelfDeleteServiceAccount = "self-delete@test-project.iam.gserviceaccount.com"
+	err := repo.CreateResources(context.Background(), "europe-west3-a", &Settings{InstanceGracePeriod: 10 * time.Minute}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.GetHostIP() != "203.0.113.10" || repo.GetSSHUsername() != gcpSSHUsername || len(repo.GetPrivateKey()) == 0 {
+		t.Errorf("Unexpected connection details: %s %s", repo.GetHostIP(), repo.GetSSHUsername())
+	}
+	if repo.GetHostPublicKey() == nil || string(repo.GetHostPublicKey().Marshal()) != string(fake.hostKey.PublicKey.Marshal()) {
+		t.Error("The host key published by the instance isn't pinned")
+	}
+	firewall := fake.firewalls[repo.FirewallName]
+	if firewall == nil || firewall["sourceRanges"].([]interface{})[0] != "198.51.100.7/32" {
+		t.Errorf("The firewall isn't limited to the external IP: %v", firewall)
+	}
+	instance := fake.instances[repo.InstanceName]
+	if instance == nil || !strings.HasSuffix(instance["machineType"].(string), "/e2-micro") {
+		t.Fatalf("Unexpected instance: %v", instance)
+	}
+	metadata, _ := json.Marshal(instance["metadata"])
+	if !strings.Contains(string(metadata), repo.SSHKey.AuthorizedKey()) || !strings.Contains(string(metadata), gcpSelfDeleteFilepath) {
+		t.Error("The instance metadata doesn't contain the ssh key and the self delete script")
+	}
+	accounts, _ := json.Marshal(instance["serviceAccounts"])
+	if string(accounts) != `[{"email":"self-delete@test-project.iam.gserviceaccount.com","scopes":["`+gcpComputeScope+`"]}]` {
+		t.Errorf("The instance should only get the self delete service account: %s", accounts)
+	}
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 1 || tracked[0].Kind != ProviderGCP || tracked[0].GCP.InstanceName != repo.InstanceName {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+
+	cleanup := newTestGCPRepository(server)
+	cleanup.PrepareResourcesForDeletion(tracked[0])
+	err = cleanup.DeleteResources(context.Background(), tracked[0].Region(), &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.instances) != 0 || len(fake.firewalls) != 0 {
+		t.Error("The resources weren't deleted")
+	}
+	if len(tracker.TrackedResources()) != 0 {
+		t.Error("The deleted resources are still tracked")
+	}
+	// The instance may have deleted itself already.
+	err = cleanup.DeleteResources(context.Background(), tracked[0].Region(), &Settings{}, tracker)
+	if err != nil {
+		t.Errorf("Deleting resources which are gone should succeed, got: %s", err)
+	}
+}
+
+func TestGCPInstanceWithoutSelfDeleteServiceAccount(t *testing.T) {
+	fake, server := startFakeCompute(t)
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := newTestGCPRepository(server)
+	err := repo.CreateResources(context.Background(), "europe-west3-a", &Settings{InstanceGracePeriod: 10 * time.Minute}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := fake.instances[repo.InstanceName]
+	metadata, _ := json.Marshal(instance["metadata"])
+	if accounts := instance["serviceAccounts"].([]interface{}); len(accounts) != 0 || strings.Contains(string(metadata), gcpSelfDeleteFilepath) {
+		t.Errorf("The instance got a service account without the self delete service account: %v", accounts)
+	}
+}
+
+func TestGCPOperationIsPolledInItsProject(t *testing.T) {
+	fake, server := startFakeCompute(t)
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := newTestGCPRepository(server)
+	// The entry of another project is cleaned up with the client of this one.
+	repo.Project = "other-project"
+	err := repo.CreateResources(context.Background(), "europe-west3-a", &Settings{InstanceGracePeriod: 10 * time.Minute}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.polled) == 0 || fake.polled[0] != "other-project" {
+		t.Errorf("Expected the operation to be polled in other-project, got: %v", fake.polled)
+	}
+}
+
+func TestGCPServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(parts) != 3 || rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "service-token", "expires_in": 3600})
+	}))
+	defer tokenServer.Close()
+	credentialsFile := filepath.Join(t.TempDir(), "service-account.json")
+	content, _ := json.Marshal(map[string]string{
+		"client_email": "sockv5er@test-project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokenServer.URL,
+		"project_id":   "test-project",
+	})
+	err = os.WriteFile(credentialsFile, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewGCPClient(&Settings{GCPCredentialsFile: credentialsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Project != "test-project" {
+		t.Errorf("Expected the project of the service account, got: %s", client.Project)
+	}
+	for i := 0; i < 2; i++ {
+		token, err := client.token(context.Background())
+		if err != nil || token != "service-token" {
+			t.Fatalf("Unexpected token: %s %v", token, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the token to be reused, it was requested %d times", requests)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/ip2location/ip2location-go/v9"
 	"net"
+	"sync"
 )
 
 type IP2LocationFinder interface {
@@ -13,6 +14,23 @@ type IP2LocationFinder interface {
 
 type GeoHelper struct {
 	Settings *Settings
+	mu       sync.Mutex
+	db       *ip2location.DB
+}
+
+// openDB opens the ip2location DB once and reuses it for every lookup.
+func (h *GeoHelper) openDB() (*ip2location.DB, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.db != nil {
+		return h.db, nil
+	}
+	db, err := ip2location.OpenDB(h.Settings.GeoLocationFile)
+	if err != nil {
+		return nil, err
+	}
+	h.db = db
+	return db, nil
 }
 
 func (h *GeoHelper) GetIP(ep string) (string, error) {
@@ -30,16 +48,41 @@ func (h *GeoHelper) GetIP(ep string) (string, error) {
 }
 
 func (h *GeoHelper) FindCountry(ep string) (string, error) {
+	country, _, err := h.FindLocation(ep)
+	return country, err
+}
+
+// FindLocation returns the country name and the ISO 3166 country code of the endpoint.
+func (h *GeoHelper) FindLocation(ep string) (string, string, error) {
 	ip, err := h.GetIP(ep)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	db, err := h.openDB()
+	if err != nil {
+		return "", "", err
 	}
-	db, err := ip2location.OpenDB(h.Settings.GeoLocationFile)
 	results, err := db.Get_all(ip)
 	if err != nil {
-		return "", errors.New("Country name couldn't be found for the ep: " + ep)
+		return "", "", errors.New("Country name couldn't be found for the ep: " + ep)
+	}
+	return results.Country_long, results.Country_short, nil
+}
+
+// FindCountryCode returns the ISO 3166 country code of the IP, e.g. `US`.
+func (h *GeoHelper) FindCountryCode(ip net.IP) (string, error) {
+	db, err := h.openDB()
+	if err != nil {
+		return "", err
+	}
+	results, err := db.Get_country_short(ip.String())
+	if err != nil {
+		return "", err
+	}
+	if results.Country_short == "" || results.Country_short == "-" {
+		return "", errors.New("Country code couldn't be found for the ip: " + ip.String())
 	}
-	return results.Country_long, nil
+	return results.Country_short, nil
 }
 
 func (h *GeoHelper) GetCountryShortName(country string) string {
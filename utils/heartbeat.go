@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	heartbeatFilepath = "/var/tmp/sockv5er-heartbeat"
+	watchdogFilepath  = "/usr/local/bin/sockv5er-watchdog"
+)
+
+// watchdogScript shuts the instance down once the heartbeat file hasn't been touched for the grace period.
+// The heartbeat file is touched at boot, so the grace period also covers the time until sockv5er connects.
+const watchdogScript = `#!/bin/sh
+HEARTBEAT=%s
+GRACE_SECONDS=%d
+while true; do
+  now=$(date +%%s)
+  last=$(stat -c %%Y "$HEARTBEAT" 2>/dev/null || echo 0)
+  if [ $((now - last)) -gt $GRACE_SECONDS ]; then
+    %s
+  fi
+  sleep 30
+done
+`
+
+func watchdogFiles(gracePeriod time.Duration, shutdownCommand string) []cloudConfigFile {
+	return []cloudConfigFile{{
+		Path:        watchdogFilepath,
+		Permissions: "0755",
+		Content:     fmt.Sprintf(watchdogScript, heartbeatFilepath, int(gracePeriod.Seconds()), shutdownCommand),
+	}}
+}
+
+func watchdogCommands() []string {
+	return []string{
+		fmt.Sprintf("touch %s", heartbeatFilepath),
+		fmt.Sprintf("chmod 666 %s", heartbeatFilepath),
+		fmt.Sprintf("systemd-run --unit sockv5er-watchdog %s", watchdogFilepath),
+	}
+}
+
+// HeartbeatInterval returns how often the heartbeat has to be sent so that a few missed ones don't stop the instance.
+func HeartbeatInterval(gracePeriod time.Duration) time.Duration {
+	interval := gracePeriod / 4
+	if interval < 5*time.Second {
+		interval = 5 * time.Second
+	}
+	return interval
+}
+
+// keepInstanceAlive touches the heartbeat file on the instance every interval until stop is closed.
+// client returns the current connection, which changes when the tunnel reconnects.
+func keepInstanceAlive(client func() *ssh.Client, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := sendHeartbeat(client())
+			if err != nil {
+				log.Warnf("Sending the heartbeat to the instance failed with error: %s\n", err)
+			} else {
+				log.Debugln("Heartbeat sent to the instance.")
+			}
+		}
+	}
+}
+
+func sendHeartbeat(client *ssh.Client) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Run(fmt.Sprintf("touch %s", heartbeatFilepath))
+}
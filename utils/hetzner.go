@@ -0,0 +1,352 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	hetznerEndpoint = "https://api.hetzner.cloud/v1/"
+	// The smallest shared vCPU server type which is available in every location.
+	hetznerServerType  = "cpx11"
+	hetznerImage       = "ubuntu-22.04"
+	hetznerSSHUsername = "root"
+)
+
+// hetznerCountries maps the country codes of the locations to the country names used for the other providers.
+var hetznerCountries = map[string]string{
+	"DE": "Germany",
+	"FI": "Finland",
+	"SG": "Singapore",
+	"US": "USA",
+}
+
+type HetznerRepository struct {
+	Client       *RESTClient
+	Location     string
+	ServerId     string
+	FirewallId   string
+	SSHKeyId     string
+	ServerIP     string
+	SSHKey       *HostKey
+	HostKey      *HostKey
+	externalIP   func() (string, error)
+	pollInterval time.Duration
+}
+
+func NewHetznerProvider() CloudProvider {
+	return &HetznerRepository{externalIP: GetExternalIP, pollInterval: 2 * time.Second}
+}
+
+func (repo *HetznerRepository) Initialize(ctx context.Context, s *Settings) error {
+	if s.HetznerToken == "" {
+		return errors.New("set hetzner_token to use Hetzner Cloud")
+	}
+	repo.Client = &RESTClient{
+		Endpoint: hetznerEndpoint,
+		Token:    s.HetznerToken,
+		HTTP:     &http.Client{Timeout: time.Minute},
+	}
+	return nil
+}
+
+func (repo *HetznerRepository) trackedResource() TrackedResource {
+	return TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{
+		Region:     repo.Location,
+		ServerId:   repo.ServerId,
+		FirewallId: repo.FirewallId,
+		SSHKeyId:   repo.SSHKeyId,
+	}}
+}
+
+// GetRegions returns the locations, the regions of Hetzner Cloud.
+func (repo *HetznerRepository) GetRegions(ctx context.Context, s *Settings) []Region {
+	var locations struct {
+		Locations []struct {
+			Name    string `json:"name"`
+			Country string `json:"country"`
+			City    string `json:"city"`
+		} `json:"locations"`
+	}
+	err := repo.Client.do(ctx, http.MethodGet, "locations?per_page=50", nil, &locations)
+	if err != nil {
+		log.Warnf("Listing the locations failed with error: %s\n", err)
+		return []Region{}
+	}
+	cloudAgnosticRegions := make([]Region, 0, len(locations.Locations))
+	for _, location := range locations.Locations {
+		country, found := hetznerCountries[location.Country]
+		if !found {
+			country = location.Country
+		}
+		cloudAgnosticRegions = append(cloudAgnosticRegions, Region{
+			ID:          location.Name,
+			Country:     country,
+			CountryCode: location.Country,
+			City:        location.City,
+		})
+	}
+	sort.Slice(cloudAgnosticRegions, func(i, j int) bool {
+		return cloudAgnosticRegions[i].ID < cloudAgnosticRegions[j].ID
+	})
+	return cloudAgnosticRegions
+}
+
+// CreateResources uploads the ssh key, creates the firewall and the server in the location, tracking each one as it's created.
+func (repo *HetznerRepository) CreateResources(ctx context.Context, location string, s *Settings, tracker *ResourceTracker) error {
+	repo.Location = location
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	name := "sockv5er-" + suffix
+	repo.SSHKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	repo.HostKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	log.Infof("Host key with fingerprint `%s` generated for the server.\n", repo.HostKey.Fingerprint())
+	err = repo.CreateSSHKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	log.Infof("SSH key `%s` uploaded.\n", repo.SSHKeyId)
+	tracker.Update(repo.trackedResource(), Add)
+	err = repo.CreateFirewall(ctx, name)
+	if err != nil {
+		return err
+	}
+	log.Infof("Firewall `%s` created.\n", repo.FirewallId)
+	tracker.Update(repo.trackedResource(), Add)
+	err = repo.CreateServer(ctx, name, s.InstanceGracePeriod)
+	if err != nil {
+		return err
+	}
+	log.Infof("Server `%s` created.\n", repo.ServerId)
+	tracker.Update(repo.trackedResource(), Add)
+	return repo.WaitUntilServerIsRunning(ctx)
+}
+
+func (repo *HetznerRepository) CreateSSHKey(ctx context.Context, name string) error {
+	var response struct {
+		SSHKey struct {
+			Id int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err := repo.Client.do(ctx, http.MethodPost, "ssh_keys", map[string]interface{}{
+		"name":       name,
+		"public_key": repo.SSHKey.AuthorizedKey(),
+		"labels":     hetznerLabels(),
+	}, &response)
+	if err != nil {
+		return err
+	}
+	repo.SSHKeyId = strconv.Itoa(response.SSHKey.Id)
+	return nil
+}
+
+// CreateFirewall allows ssh from the external IP. Outgoing traffic is allowed as long as there are no outbound rules.
+func (repo *HetznerRepository) CreateFirewall(ctx context.Context, name string) error {
+	externalIP, err := repo.externalIP()
+	if err != nil {
+		externalIP = "0.0.0.0/0"
+	} else {
+		externalIP = externalIP + "/32"
+	}
+	var response struct {
+		Firewall struct {
+			Id int `json:"id"`
+		} `json:"firewall"`
+	}
+	err = repo.Client.do(ctx, http.MethodPost, "firewalls", map[string]interface{}{
+		"name":   name,
+		"labels": hetznerLabels(),
+		"rules": []map[string]interface{}{{
+			"direction":  "in",
+			"protocol":   "tcp",
+			"port":       "22",
+			"source_ips": []string{externalIP},
+		}},
+	}, &response)
+	if err != nil {
+		return err
+	}
+	repo.FirewallId = strconv.Itoa(response.Firewall.Id)
+	return nil
+}
+
+// CreateServer creates the server, which only powers off once the heartbeats stop. Deleting itself would need
+// a token on the server, and Hetzner tokens can't be scoped below the whole project. A powered off server is
+// still billed until the cleanup deletes it.
+func (repo *HetznerRepository) CreateServer(ctx context.Context, name string, gracePeriod time.Duration) error {
+	userdata, err := cloudInitOptions{HostKey: repo.HostKey, GracePeriod: gracePeriod}.userData()
+	if err != nil {
+		return err
+	}
+	sshKeyId, err := strconv.Atoi(repo.SSHKeyId)
+	if err != nil {
+		return err
+	}
+	firewallId, err := strconv.Atoi(repo.FirewallId)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Server struct {
+			Id int `json:"id"`
+		} `json:"server"`
+	}
+	err = repo.Client.do(ctx, http.MethodPost, "servers", map[string]interface{}{
+		"name":        name,
+		"location":    repo.Location,
+		"server_type": hetznerServerType,
+		"image":       hetznerImage,
+		"ssh_keys":    []int{sshKeyId},
+		"firewalls":   []map[string]int{{"firewall": firewallId}},
+		"labels":      hetznerLabels(),
+		"user_data":   userdata,
+	}, &response)
+	if err != nil {
+		return err
+	}
+	repo.ServerId = strconv.Itoa(response.Server.Id)
+	return nil
+}
+
+func (repo *HetznerRepository) WaitUntilServerIsRunning(ctx context.Context) error {
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		var response struct {
+			Server struct {
+				Status    string `json:"status"`
+				PublicNet struct {
+					IPv4 struct {
+						IP string `json:"ip"`
+					} `json:"ipv4"`
+				} `json:"public_net"`
+			} `json:"server"`
+		}
+		err := repo.Client.do(ctx, http.MethodGet, "servers/"+repo.ServerId, nil, &response)
+		if err != nil {
+			return err
+		}
+		if response.Server.Status == "running" && response.Server.PublicNet.IPv4.IP != "" {
+			log.Infoln("Server is ready.")
+			repo.ServerIP = response.Server.PublicNet.IPv4.IP
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server `%s` isn't running after 5 minutes, its status is %s", repo.ServerId, response.Server.Status)
+		}
+		err = sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DeleteResources deletes the server and waits until it's gone, the firewall can't be deleted while it's applied to the server.
+func (repo *HetznerRepository) DeleteResources(ctx context.Context, location string, s *Settings, tracker *ResourceTracker) error {
+	repo.Location = location
+	resource := repo.trackedResource()
+	if repo.ServerId != "" {
+		err := repo.deleteServer(ctx)
+		if err != nil {
+			log.Warnf("Server deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Server `%s` deleted.\n", repo.ServerId)
+	}
+	if repo.FirewallId != "" {
+		err := repo.Client.do(ctx, http.MethodDelete, "firewalls/"+repo.FirewallId, nil, nil)
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Warnf("Firewall deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Firewall `%s` deleted.\n", repo.FirewallId)
+	}
+	if repo.SSHKeyId != "" {
+		err := repo.Client.do(ctx, http.MethodDelete, "ssh_keys/"+repo.SSHKeyId, nil, nil)
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Warnf("SSH key deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("SSH key `%s` deleted.\n", repo.SSHKeyId)
+	}
+	tracker.Update(resource, Remove)
+	return nil
+}
+
+// deleteServer succeeds once the server is gone, also when it was deleted already.
+func (repo *HetznerRepository) deleteServer(ctx context.Context) error {
+	err := repo.Client.do(ctx, http.MethodDelete, "servers/"+repo.ServerId, nil, nil)
+	if errors.Is(err, errNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		err = repo.Client.do(ctx, http.MethodGet, "servers/"+repo.ServerId, nil, nil)
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server `%s` still exists 5 minutes after deleting it", repo.ServerId)
+		}
+		err = sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (repo *HetznerRepository) PrepareResourcesForDeletion(resource TrackedResource) {
+	res := resource.Hetzner
+	repo.Location = res.Region
+	repo.ServerId = res.ServerId
+	repo.FirewallId = res.FirewallId
+	repo.SSHKeyId = res.SSHKeyId
+}
+
+func (repo *HetznerRepository) GetHostIP() string {
+	return repo.ServerIP
+}
+
+func (repo *HetznerRepository) GetPrivateKey() []byte {
+	if repo.SSHKey == nil {
+		return nil
+	}
+	return repo.SSHKey.PrivateKeyPEM
+}
+
+func (repo *HetznerRepository) GetHostPublicKey() ssh.PublicKey {
+	if repo.HostKey == nil {
+		return nil
+	}
+	return repo.HostKey.PublicKey
+}
+
+func (repo *HetznerRepository) GetSSHUsername() string {
+	return hetznerSSHUsername
+}
+
+// hetznerLabels marks the resources as created by sockv5er in the console.
+func hetznerLabels() map[string]string {
+	return map[string]string{"created-by": "sockv5er"}
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeHetznerServer struct {
+	body  map[string]interface{}
+	polls int
+	// deleting is set once the server is deleted, it disappears on the next request.
+	deleting bool
+}
+
+// fakeHetzner is a local stand-in for the parts of the Hetzner Cloud API sockv5er uses.
+type fakeHetzner struct {
+	nextId    int
+	keys      map[string]map[string]interface{}
+	firewalls map[string]map[string]interface{}
+	servers   map[string]*fakeHetznerServer
+}
+
+func startFakeHetzner(t *testing.T) (*fakeHetzner, *httptest.Server) {
+	fake := &fakeHetzner{
+		nextId:    200,
+		keys:      map[string]map[string]interface{}{},
+		firewalls: map[string]map[string]interface{}{},
+		servers:   map[string]*fakeHetznerServer{},
+	}
+	return fake, startFakeAPI(t, fake.serve)
+}
+
+func (f *fakeHetzner) serve(r *fakeRequest) {
+	fail := func(status int, code string) {
+		r.reply(status, map[string]interface{}{"error": map[string]string{"code": code, "message": code}})
+	}
+	f.nextId++
+	id := strconv.Itoa(f.nextId)
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	for serverId, server := range f.servers {
+		if server.deleting {
+			delete(f.servers, serverId)
+		}
+	}
+	switch {
+	case r.Method == http.MethodGet && path == "locations":
+		r.reply(http.StatusOK, map[string]interface{}{"locations": []map[string]string{
+			{"name": "nbg1", "country": "DE", "city": "Nuremberg"},
+			{"name": "hel1", "country": "FI", "city": "Helsinki"},
+			{"name": "ash", "country": "US", "city": "Ashburn, VA"},
+		}})
+	case r.Method == http.MethodPost && path == "ssh_keys":
+		f.keys[id] = r.decode()
+		r.reply(http.StatusCreated, map[string]interface{}{"ssh_key": map[string]interface{}{"id": f.nextId}})
+	case r.Method == http.MethodPost && path == "firewalls":
+		f.firewalls[id] = r.decode()
+		r.reply(http.StatusCreated, map[string]interface{}{"firewall": map[string]interface{}{"id": f.nextId}, "actions": []interface{}{}})
+	case r.Method == http.MethodPost && path == "servers":
+		f.servers[id] = &fakeHetznerServer{body: r.decode()}
+		r.reply(http.StatusCreated, map[string]interface{}{"server": map[string]interface{}{"id": f.nextId, "status": "initializing"}})
+	case strings.HasPrefix(path, "servers/"):
+		server, found := f.servers[strings.TrimPrefix(path, "servers/")]
+		if !found {
+			fail(http.StatusNotFound, "not_found")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			server.deleting = true
+			r.reply(http.StatusOK, map[string]interface{}{"action": map[string]string{"status": "running"}})
+			return
+		}
+		server.polls++
+		status := "initializing"
+		if server.polls > 1 {
+			status = "running"
+		}
+		r.reply(http.StatusOK, map[string]interface{}{"server": map[string]interface{}{
+			"status":     status,
+			"public_net": map[string]interface{}{"ipv4": map[string]string{"ip": "203.0.113.30"}},
+		}})
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "firewalls/"):
+		firewallId := strings.TrimPrefix(path, "firewalls/")
+		for _, server := range f.servers {
+			firewalls, _ := json.Marshal(server.body["firewalls"])
+			if strings.Contains(string(firewalls), `"firewall":`+firewallId) {
+				fail(http.StatusConflict, "resource_in_use")
+				return
+			}
+		}
+		if _, found := f.firewalls[firewallId]; !found {
+			fail(http.StatusNotFound, "not_found")
+			return
+		}
+		delete(f.firewalls, firewallId)
+		r.w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "ssh_keys/"):
+		if _, found := f.keys[strings.TrimPrefix(path, "ssh_keys/")]; !found {
+			fail(http.StatusNotFound, "not_found")
+			return
+		}
+		delete(f.keys, strings.TrimPrefix(path, "ssh_keys/"))
+		r.w.WriteHeader(http.StatusNoContent)
+	default:
+		r.t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		r.w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newTestHetznerRepository(server *httptest.Server) *HetznerRepository {
+	return &HetznerRepository{
+		Client:       &RESTClient{Endpoint: server.URL + "/", Token: "test-token", HTTP: server.Client()},
+		externalIP:   func() (string, error) { return "198.51.100.7", nil },
+		pollInterval: time.Millisecond,
+	}
+}
+
+func TestHetznerGetRegions(t *testing.T) {
+	_, server := startFakeHetzner(t)
+	regions := newTestHetznerRepository(server).GetRegions(context.Background(), &Settings{})
+	expected := []Region{
+		{ID: "ash", Country: "USA", CountryCode: "US", City: "Ashburn, VA"},
+		{ID: "hel1", Country: "Finland", CountryCode: "FI", City: "Helsinki"},
+		{ID: "nbg1", Country: "Germany", CountryCode: "DE", City: "Nuremberg"},
+	}
+	if len(regions) != len(expected) {
+		t.Fatalf("Unexpected regions: %v", regions)
+	}
+	for i := range expected {
+		if regions[i] != expected[i] {
+			t.Errorf("Expected %v, got: %v", expected[i], regions[i])
+		}
+	}
+}
+
+func TestHetznerCreateAndDeleteResources(t *testing.T) {
+	fake, server := startFakeHetzner(t)
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	tracker := GetNewTracker(trackerFilepath)
+	repo := newTestHetznerRepository(server)
+	err := repo.CreateResources(context.Background(), "nbg1", &Settings{InstanceGracePeriod: 10 * time.Minute}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.GetHostIP() != "203.0.113.30" || repo.GetSSHUsername() != "root" || len(repo.GetPrivateKey()) == 0 {
+		t.Errorf("Unexpected connection details: %s %s", repo.GetHostIP(), repo.GetSSHUsername())
+	}
+	firewall, _ := json.Marshal(fake.firewalls[repo.FirewallId])
+	if !strings.Contains(string(firewall), `"source_ips":["198.51.100.7/32"]`) {
+		t.Errorf("The firewall isn't limited to the external IP: %s", firewall)
+	}
+	created := fake.servers[repo.ServerId]
+	if created == nil || created.body["server_type"] != hetznerServerType || created.body["location"] != "nbg1" {
+		t.Fatalf("Unexpected server: %v", created)
+	}
+	userdata := created.body["user_data"].(string)
+	if !strings.Contains(userdata, repo.HostKey.AuthorizedKey()) {
+		t.Error("The user data doesn't contain the host key")
+	}
+	if strings.Contains(userdata, repo.Client.Token) {
+		t.Error("The token of the project shouldn't be handed to the server")
+	}
+
+	cleanupTracker := GetNewTracker(trackerFilepath)
+	err = cleanupTracker.ReadResourcesFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := cleanupTracker.TrackedResources()
+	if len(tracked) != 1 || tracked[0].Kind != ProviderHetzner || tracked[0].Hetzner.ServerId != repo.ServerId ||
+		tracked[0].Hetzner.FirewallId != repo.FirewallId || tracked[0].Hetzner.SSHKeyId != repo.SSHKeyId {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+	cleanup := newTestHetznerRepository(server)
+	cleanup.PrepareResourcesForDeletion(tracked[0])
+	err = cleanup.DeleteResources(context.Background(), tracked[0].Region(), &Settings{}, cleanupTracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.servers) != 0 || len(fake.firewalls) != 0 || len(fake.keys) != 0 {
+		t.Error("The resources weren't deleted")
+	}
+	if len(cleanupTracker.TrackedResources()) != 0 {
+		t.Error("The deleted resources are still tracked")
+	}
+}
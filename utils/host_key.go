@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/yaml.v2"
+)
+
+// HostKey is an SSH host key generated locally and injected into the instance through the user data,
+// so that the server's identity is known before the first connection.
+type HostKey struct {
+	PrivateKeyPEM []byte
+	PublicKey     ssh.PublicKey
+}
+
+func GenerateHostKey() (*HostKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &HostKey{
+		PrivateKeyPEM: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		PublicKey:     publicKey,
+	}, nil
+}
+
+func (k *HostKey) AuthorizedKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.PublicKey)))
+}
+
+// Fingerprint returns the SHA256 fingerprint in the format printed by ssh-keygen.
+func (k *HostKey) Fingerprint() string {
+	return ssh.FingerprintSHA256(k.PublicKey)
+}
+
+type cloudConfig struct {
+	SSHDeleteKeys bool              `yaml:"ssh_deletekeys,omitempty"`
+	SSHKeys       map[string]string `yaml:"ssh_keys,omitempty"`
+	WriteFiles    []cloudConfigFile `yaml:"write_files,omitempty"`
+	RunCmd        []string          `yaml:"runcmd,omitempty"`
+}
+
+type cloudConfigFile struct {
+	Path        string `yaml:"path"`
+	Permissions string `yaml:"permissions"`
+	Content     string `yaml:"content"`
+}
+
+// CloudInitUserData returns a cloud-config which installs the host key before sshd starts
+// and a watchdog which shuts the instance down once the heartbeats stop for the grace period.
+// It also starts the relay for the socksv5 UDP associations.
+func CloudInitUserData(hostKey *HostKey, gracePeriod time.Duration) (string, error) {
+	return cloudInitOptions{HostKey: hostKey, GracePeriod: gracePeriod}.userData()
+}
+
+// cloudInitOptions tailor the user data to a provider.
+type cloudInitOptions struct {
+	// HostKey is installed as the host key of the instance. When nil the image keeps its own host keys.
+	HostKey     *HostKey
+	GracePeriod time.Duration
+	// ShutdownCommand is what the watchdog runs once the heartbeats stop, `shutdown -h now` by default.
+	ShutdownCommand string
+	// WriteFiles are installed next to the watchdog and the relay.
+	WriteFiles []cloudConfigFile
+}
+
+func (o cloudInitOptions) userData() (string, error) {
+	shutdownCommand := o.ShutdownCommand
+	if shutdownCommand == "" {
+		shutdownCommand = "shutdown -h now"
+	}
+	config := cloudConfig{
+		WriteFiles: append(watchdogFiles(o.GracePeriod, shutdownCommand), udpRelayFiles()...),
+		RunCmd:     append(udpRelayCommands(), watchdogCommands()...),
+	}
+	config.WriteFiles = append(config.WriteFiles, o.WriteFiles...)
+	if o.HostKey != nil {
+		config.SSHDeleteKeys = true
+		config.SSHKeys = map[string]string{
+			"ecdsa_private": string(o.HostKey.PrivateKeyPEM),
+			"ecdsa_public":  o.HostKey.AuthorizedKey(),
+		}
+	}
+	content, err := yaml.Marshal(&config)
+	if err != nil {
+		return "", err
+	}
+	return "#cloud-config\n" + string(content), nil
+}
+
+// hostKeyCallback pins the host key of the session if there is one and falls back to the known_hosts file otherwise.
+func hostKeyCallback(hostPublicKey ssh.PublicKey, knownHostsFilepath string) (ssh.HostKeyCallback, error) {
+	if hostPublicKey != nil {
+		return ssh.FixedHostKey(hostPublicKey), nil
+	}
+	if knownHostsFilepath == "" {
+		return nil, fmt.Errorf("no host key to verify the ssh server with")
+	}
+	return knownhosts.New(knownHostsFilepath)
+}
+
+func knownHostsLine(host string, port string, key ssh.PublicKey) string {
+	return knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, port))}, key)
+}
+
+// AddKnownHost appends the host key to the known_hosts file so that other ssh clients can reach the instance.
+func AddKnownHost(knownHostsFilepath string, host string, port string, key ssh.PublicKey) error {
+	file, err := os.OpenFile(knownHostsFilepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintln(file, knownHostsLine(host, port, key))
+	return err
+}
+
+// RemoveKnownHost removes the line added by AddKnownHost and leaves every other line untouched.
+func RemoveKnownHost(knownHostsFilepath string, host string, port string, key ssh.PublicKey) error {
+	content, err := os.ReadFile(knownHostsFilepath)
+	if err != nil {
+		return err
+	}
+	line := knownHostsLine(host, port, key)
+	var kept strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		if scanner.Text() == line {
+			continue
+		}
+		kept.WriteString(scanner.Text())
+		kept.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return WriteFileContent(knownHostsFilepath, []byte(kept.String()))
+}
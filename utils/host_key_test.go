@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestCloudInitUserDataInstallsHostKey(t *testing.T) {
+	hostKey, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userdata, err := CloudInitUserData(hostKey, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(userdata, "#cloud-config\n") {
+		t.Error("The user data should be a cloud-config")
+	}
+	config := cloudConfig{}
+	err = yaml.Unmarshal([]byte(userdata), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SSHKeys["ecdsa_public"] != hostKey.AuthorizedKey() || config.SSHKeys["ecdsa_private"] != string(hostKey.PrivateKeyPEM) {
+		t.Error("The user data doesn't contain the generated host key")
+	}
+	if len(config.WriteFiles) != 2 || !strings.Contains(config.WriteFiles[0].Content, "GRACE_SECONDS=600") {
+		t.Error("The user data doesn't contain the watchdog with the grace period")
+	}
+	if len(config.WriteFiles) != 2 || config.WriteFiles[1].Path != udpRelayFilepath || !strings.Contains(config.RunCmd[0], udpRelayFilepath) {
+		t.Error("The user data doesn't start the udp relay")
+	}
+	if len(config.RunCmd) == 0 || !strings.Contains(config.RunCmd[len(config.RunCmd)-1], watchdogFilepath) {
+		t.Error("The user data doesn't start the watchdog")
+	}
+}
+
+func TestHostKeyCallbackRejectsOtherKeys(t *testing.T) {
+	pinned, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := hostKeyCallback(pinned.PublicKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+	if err := callback("192.0.2.10:22", addr, pinned.PublicKey); err != nil {
+		t.Errorf("The pinned host key was rejected: %s", err)
+	}
+	if err := callback("192.0.2.10:22", addr, other.PublicKey); err == nil {
+		t.Error("A host key other than the pinned one was accepted")
+	}
+}
+
+func TestAddAndRemoveKnownHost(t *testing.T) {
+	hostKey, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownHostsFilepath := filepath.Join(t.TempDir(), "known_hosts")
+	existing := "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"
+	err = os.WriteFile(knownHostsFilepath, []byte(existing), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = AddKnownHost(knownHostsFilepath, "192.0.2.10", "22", hostKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := hostKeyCallback(nil, knownHostsFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+	if err := callback("192.0.2.10:22", addr, hostKey.PublicKey); err != nil {
+		t.Errorf("The added host key was rejected: %s", err)
+	}
+	err = RemoveKnownHost(knownHostsFilepath, "192.0.2.10", "22", hostKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(knownHostsFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != existing {
+		t.Errorf("Removing the host key changed the other entries: %q", content)
+	}
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+	log "github.com/sirupsen/logrus"
+)
+
+// hopByHopHeaders are meaningful for a single connection only and must not be forwarded (RFC 7230 section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPProxy is an HTTP proxy for clients which can't speak socksv5. It supports CONNECT tunnels
+// and plain requests with an absolute URI, and opens every connection through Dial.
+type HTTPProxy struct {
+	Dial        func(network, addr string) (net.Conn, error)
+	Credentials socks5.CredentialStore
+	transport   *http.Transport
+	once        sync.Once
+}
+
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="sockv5er"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, requests need an absolute URI", http.StatusBadRequest)
+		return
+	}
+	p.serveForward(w, r)
+}
+
+func (p *HTTPProxy) authorized(r *http.Request) bool {
+	if p.Credentials == nil {
+		return true
+	}
+	scheme, encoded, found := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	return found && p.Credentials.Valid(username, password)
+}
+
+func (p *HTTPProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT is not supported", http.StatusInternalServerError)
+		return
+	}
+	target, err := p.Dial("tcp", r.Host)
+	if err != nil {
+		log.Debugf("HTTP proxy failed to connect to `%s`: %s\n", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	_, err = client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		_ = client.Close()
+		_ = target.Close()
+		return
+	}
+	// The client may have sent data right after the CONNECT request.
+	if buffered.Reader.Buffered() > 0 {
+		_, err = io.CopyN(target, buffered, int64(buffered.Reader.Buffered()))
+		if err != nil {
+			_ = client.Close()
+			_ = target.Close()
+			return
+		}
+	}
+	pipeConnections(client, target)
+}
+
+// pipeConnections copies in both directions until either side is done and closes both.
+func pipeConnections(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyAndSignal := func(dst net.Conn, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyAndSignal(a, b)
+	go copyAndSignal(b, a)
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+	<-done
+}
+
+func (p *HTTPProxy) serveForward(w http.ResponseWriter, r *http.Request) {
+	p.once.Do(func() {
+		p.transport = &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return p.Dial(network, addr)
+			},
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	})
+	outgoing := r.Clone(r.Context())
+	outgoing.RequestURI = ""
+	removeHopByHopHeaders(outgoing.Header)
+	response, err := p.transport.RoundTrip(outgoing)
+	if err != nil {
+		log.Debugf("HTTP proxy failed to forward the request to `%s`: %s\n", r.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	removeHopByHopHeaders(response.Header)
+	for key, values := range response.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	_, _ = io.Copy(w, response.Body)
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	// Headers listed in Connection are hop-by-hop as well.
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
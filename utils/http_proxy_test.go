@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+func startTestHTTPProxy(t *testing.T, credentials socks5.CredentialStore) (*url.URL, *[]string) {
+	dialed := make([]string, 0)
+	proxy := &HTTPProxy{
+		Dial: func(network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return net.Dial(network, addr)
+		},
+		Credentials: credentials,
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	proxyURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxyURL, &dialed
+}
+
+func TestHTTPProxyForwardsAbsoluteURIRequests(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Error("Hop-by-hop headers were forwarded")
+		}
+		fmt.Fprint(w, "hello through the tunnel")
+	}))
+	defer target.Close()
+	proxyURL, dialed := startTestHTTPProxy(t, nil)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	request, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	request.Header.Set("Proxy-Connection", "keep-alive")
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "hello through the tunnel" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+	if len(*dialed) != 1 || (*dialed)[0] != target.Listener.Addr().String() {
+		t.Errorf("The request wasn't dialed through the proxy dialer: %v", *dialed)
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyURL, dialed := startTestHTTPProxy(t, nil)
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status for CONNECT: %s", response.Status)
+	}
+	assertEcho(t, &bufferedConn{Conn: conn, reader: reader})
+	if len(*dialed) != 1 || (*dialed)[0] != echoAddr {
+		t.Errorf("The tunnel wasn't dialed through the proxy dialer: %v", *dialed)
+	}
+}
+
+func TestHTTPProxyRequiresCredentials(t *testing.T) {
+	proxyURL, dialed := startTestHTTPProxy(t, socks5.StaticCredentials{"alice": "wonderland"})
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	response, err := client.Get("http://example.invalid/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Unexpected status without credentials: %s", response.Status)
+	}
+	if len(*dialed) != 0 {
+		t.Error("An unauthenticated request was dialed")
+	}
+
+	authenticated := *proxyURL
+	authenticated.User = url.UserPassword("alice", "wonderland")
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&authenticated)}}
+	response, err = client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status with credentials: %s", response.Status)
+	}
+}
+
+// bufferedConn reads through the reader which may hold data read past the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
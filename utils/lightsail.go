@@ -0,0 +1,340 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail"
+	"github.com/aws/aws-sdk-go-v2/service/lightsail/types"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// The smallest bundle, the $3.50 plan.
+	lightsailBundleId    = "nano_3_0"
+	lightsailBlueprintId = "ubuntu_22_04"
+	lightsailSSHUsername = "ubuntu"
+)
+
+// lightsailSelfDeleteScript deletes the instance with the keys in the credentials file, a Lightsail instance which
+// is only stopped is still billed. There is no instance role to get a token from and no AWS CLI on the image, so
+// the request is signed here.
+const lightsailSelfDeleteScript = `#!/usr/bin/env python3
+import datetime, hashlib, hmac, json, urllib.request
+
+with open("%[1]s") as f:
+    key_id, secret = f.read().split()
+region, name, target = "%[2]s", "%[3]s", "Lightsail_20161128.DeleteInstance"
+host = "lightsail." + region + ".amazonaws.com"
+body = json.dumps({"instanceName": name}).encode()
+now = datetime.datetime.now(datetime.timezone.utc)
+amz_date, date = now.strftime("%%Y%%m%%dT%%H%%M%%SZ"), now.strftime("%%Y%%m%%d")
+headers = {"content-type": "application/x-amz-json-1.1", "host": host, "x-amz-date": amz_date, "x-amz-target": target}
+signed = ";".join(sorted(headers))
+canonical = "\n".join(["POST", "/", ""] + [k + ":" + headers[k] for k in sorted(headers)] + ["", signed, hashlib.sha256(body).hexdigest()])
+scope = date + "/" + region + "/lightsail/aws4_request"
+to_sign = "\n".join(["AWS4-HMAC-SHA256", amz_date, scope, hashlib.sha256(canonical.encode()).hexdigest()])
+key = ("AWS4" + secret).encode()
+for part in (date, region, "lightsail", "aws4_request"):
+    key = hmac.new(key, part.encode(), hashlib.sha256).digest()
+headers["authorization"] = "AWS4-HMAC-SHA256 Credential=" + key_id + "/" + scope + ", SignedHeaders=" + signed + \
+    ", Signature=" + hmac.new(key, to_sign.encode(), hashlib.sha256).hexdigest()
+del headers["host"]
+urllib.request.urlopen(urllib.request.Request("https://" + host + "/", data=body, headers=headers, method="POST"), timeout=60)
+`
+
+const (
+	lightsailSelfDeleteFilepath  = "/usr/local/bin/sockv5er-self-delete"
+	lightsailCredentialsFilepath = "/root/.sockv5er-credentials"
+)
+
+// lightsailRegionCountries maps the Lightsail regions to the country they are in.
+var lightsailRegionCountries = map[string]string{
+	"ap-northeast-1": "Japan",
+	"ap-northeast-2": "S.Korea",
+	"ap-south-1":     "India",
+	"ap-southeast-1": "Singapore",
+	"ap-southeast-2": "Australia",
+	"ca-central-1":   "Canada",
+	"eu-central-1":   "Germany",
+	"eu-north-1":     "Sweden",
+	"eu-west-1":      "Ireland",
+	"eu-west-2":      "UK",
+	"eu-west-3":      "France",
+	"us-east-1":      "USA",
+	"us-east-2":      "USA",
+	"us-west-2":      "USA",
+}
+
+// LightsailRepository creates a Lightsail instance, which needs fewer resources than EC2: a key pair,
+// the instance and its port rules.
+type LightsailRepository struct {
+	Client       *lightsail.Client
+	Region       string
+	InstanceName string
+	KeyPairName  string
+	InstanceIP   string
+	PrivateKey   []byte
+	HostKey      *HostKey
+	settings     *Settings
+	endpoint     string
+	externalIP   func() (string, error)
+	pollInterval time.Duration
+}
+
+func NewLightsailProvider() CloudProvider {
+	return &LightsailRepository{externalIP: GetExternalIP, pollInterval: 5 * time.Second}
+}
+
+// Initialize connects to us-east-1, the client is replaced with one of the region in CreateResources and DeleteResources.
+func (repo *LightsailRepository) Initialize(ctx context.Context, s *Settings) error {
+	repo.settings = s
+	return repo.setRegion(ctx, "us-east-1")
+}
+
+func (repo *LightsailRepository) setRegion(ctx context.Context, region string) error {
+	cfg, err := config.LoadDefaultConfig(
+		ctx,
+		config.WithRegion(region),
+		config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(repo.settings.AccessKeyId, repo.settings.SecretKey, "")))
+	if err != nil {
+		return err
+	}
+	repo.Client = lightsail.NewFromConfig(cfg, func(o *lightsail.Options) {
+		if repo.endpoint != "" {
+			o.BaseEndpoint = aws.String(repo.endpoint)
+		}
+	})
+	repo.Region = region
+	return nil
+}
+
+func (repo *LightsailRepository) trackedResource() TrackedResource {
+	return TrackedResource{Kind: ProviderLightsail, Lightsail: &LightsailResource{
+		Region:       repo.Region,
+		InstanceName: repo.InstanceName,
+		KeyPairName:  repo.KeyPairName,
+	}}
+}
+
+func (repo *LightsailRepository) GetRegions(ctx context.Context, s *Settings) []Region {
+	result, err := repo.Client.GetRegions(ctx, &lightsail.GetRegionsInput{})
+	if err != nil {
+		log.Warnf("Listing the regions failed with error: %s\n", err)
+		return []Region{}
+	}
+	cloudAgnosticRegions := make([]Region, 0, len(result.Regions))
+	for _, region := range result.Regions {
+		country, found := lightsailRegionCountries[string(region.Name)]
+		if !found {
+			country = "Unknown"
+		}
+		cloudAgnosticRegions = append(cloudAgnosticRegions, Region{
+			ID:      string(region.Name),
+			Country: country,
+			City:    aws.ToString(region.DisplayName),
+		})
+	}
+	sort.Slice(cloudAgnosticRegions, func(i, j int) bool {
+		return cloudAgnosticRegions[i].ID < cloudAgnosticRegions[j].ID
+	})
+	return cloudAgnosticRegions
+}
+
+// CreateResources creates the key pair and the instance, limits its ports to ssh from the external IP
+// and waits until it's running. Both resources are tracked as soon as they exist.
+func (repo *LightsailRepository) CreateResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	err := repo.setRegion(ctx, region)
+	if err != nil {
+		return err
+	}
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	name := "sockv5er-" + suffix
+	repo.HostKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	log.Infof("Host key with fingerprint `%s` generated for the instance.\n", repo.HostKey.Fingerprint())
+	// The names are kept before the calls, so that DeleteResources also removes what an interrupted
+	// call created. Deleting what doesn't exist succeeds.
+	repo.KeyPairName = name
+	keyPair, err := repo.Client.CreateKeyPair(ctx, &lightsail.CreateKeyPairInput{
+		KeyPairName: aws.String(name),
+		Tags:        lightsailTags(),
+	})
+	if err != nil {
+		return err
+	}
+	repo.PrivateKey = []byte(aws.ToString(keyPair.PrivateKeyBase64))
+	tracker.Update(repo.trackedResource(), Add)
+	log.Infof("Key pair `%s` created.\n", name)
+	userdata, err := repo.userData(name, s)
+	if err != nil {
+		return err
+	}
+	repo.InstanceName = name
+	_, err = repo.Client.CreateInstances(ctx, &lightsail.CreateInstancesInput{
+		InstanceNames:    []string{name},
+		AvailabilityZone: aws.String(region + "a"),
+		BlueprintId:      aws.String(lightsailBlueprintId),
+		BundleId:         aws.String(lightsailBundleId),
+		KeyPairName:      aws.String(name),
+		UserData:         aws.String(userdata),
+		Tags:             lightsailTags(),
+	})
+	if err != nil {
+		return err
+	}
+	tracker.Update(repo.trackedResource(), Add)
+	log.Infof("Instance `%s` created.\n", name)
+	err = repo.WaitUntilInstanceIsRunning(ctx)
+	if err != nil {
+		return err
+	}
+	return repo.LimitPorts(ctx)
+}
+
+// userData makes the instance delete itself once the heartbeats stop when there are self delete keys, the keys of
+// the client would give whoever gets onto the instance the whole account.
+func (repo *LightsailRepository) userData(name string, s *Settings) (string, error) {
+	options := cloudInitOptions{HostKey: repo.HostKey, GracePeriod: s.InstanceGracePeriod}
+	if s.LightsailSelfDeleteAccessKeyId != "" && s.LightsailSelfDeleteSecretKey != "" {
+		options.ShutdownCommand = lightsailSelfDeleteFilepath + "; shutdown -h now"
+		options.WriteFiles = []cloudConfigFile{
+			{
+				Path:        lightsailCredentialsFilepath,
+				Permissions: "0600",
+				Content:     s.LightsailSelfDeleteAccessKeyId + "\n" + s.LightsailSelfDeleteSecretKey + "\n",
+			},
+			{
+				Path:        lightsailSelfDeleteFilepath,
+				Permissions: "0700",
+				Content:     fmt.Sprintf(lightsailSelfDeleteScript, lightsailCredentialsFilepath, repo.Region, name),
+			},
+		}
+	} else {
+		log.Warnf("lightsail_self_delete_access_key_id and lightsail_self_delete_secret_key aren't set, the instance only powers off once the heartbeats stop and is billed until `sockv5er cleanup` deletes it.\n")
+	}
+	return options.userData()
+}
+
+func (repo *LightsailRepository) WaitUntilInstanceIsRunning(ctx context.Context) error {
+	deadline := time.Now().Add(5 * time.Minute)
+	for {
+		result, err := repo.Client.GetInstance(ctx, &lightsail.GetInstanceInput{InstanceName: aws.String(repo.InstanceName)})
+		// The instance isn't always found right after it was created.
+		if err != nil && !isLightsailNotFound(err) {
+			return err
+		}
+		if err == nil && result.Instance != nil && result.Instance.State != nil &&
+			aws.ToString(result.Instance.State.Name) == "running" && aws.ToString(result.Instance.PublicIpAddress) != "" {
+			repo.InstanceIP = aws.ToString(result.Instance.PublicIpAddress)
+			log.Infoln("Instance is ready.")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instance `%s` isn't running after 5 minutes", repo.InstanceName)
+		}
+		err = sleepContext(ctx, repo.pollInterval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// LimitPorts replaces the default rules, which open ssh and http to everyone, with ssh from the external IP.
+func (repo *LightsailRepository) LimitPorts(ctx context.Context) error {
+	externalIP, err := repo.externalIP()
+	if err != nil {
+		externalIP = "0.0.0.0/0"
+	} else {
+		externalIP = externalIP + "/32"
+	}
+	_, err = repo.Client.PutInstancePublicPorts(ctx, &lightsail.PutInstancePublicPortsInput{
+		InstanceName: aws.String(repo.InstanceName),
+		PortInfos: []types.PortInfo{{
+			FromPort: 22,
+			ToPort:   22,
+			Protocol: types.NetworkProtocolTcp,
+			Cidrs:    []string{externalIP},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Ports of `%s` limited to ssh from %s.\n", repo.InstanceName, externalIP)
+	return nil
+}
+
+// DeleteResources deletes the instance and the key pair. Resources which are gone already count as deleted.
+func (repo *LightsailRepository) DeleteResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	err := repo.setRegion(ctx, region)
+	if err != nil {
+		return err
+	}
+	resource := repo.trackedResource()
+	if repo.InstanceName != "" {
+		_, err = repo.Client.DeleteInstance(ctx, &lightsail.DeleteInstanceInput{InstanceName: aws.String(repo.InstanceName)})
+		if err != nil && !isLightsailNotFound(err) {
+			log.Warnf("Lightsail instance deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Instance `%s` deleted.\n", repo.InstanceName)
+	}
+	if repo.KeyPairName != "" {
+		_, err = repo.Client.DeleteKeyPair(ctx, &lightsail.DeleteKeyPairInput{KeyPairName: aws.String(repo.KeyPairName)})
+		if err != nil && !isLightsailNotFound(err) {
+			log.Warnf("Key pair deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Key pair `%s` deleted.\n", repo.KeyPairName)
+	}
+	tracker.Update(resource, Remove)
+	return nil
+}
+
+func (repo *LightsailRepository) PrepareResourcesForDeletion(resource TrackedResource) {
+	res := resource.Lightsail
+	repo.InstanceName = res.InstanceName
+	repo.KeyPairName = res.KeyPairName
+}
+
+func (repo *LightsailRepository) GetHostIP() string {
+	return repo.InstanceIP
+}
+
+func (repo *LightsailRepository) GetPrivateKey() []byte {
+	return repo.PrivateKey
+}
+
+func (repo *LightsailRepository) GetHostPublicKey() ssh.PublicKey {
+	if repo.HostKey == nil {
+		return nil
+	}
+	return repo.HostKey.PublicKey
+}
+
+func (repo *LightsailRepository) GetSSHUsername() string {
+	return lightsailSSHUsername
+}
+
+func isLightsailNotFound(err error) bool {
+	var notFound *types.NotFoundException
+	return errors.As(err, &notFound)
+}
+
+// lightsailTags marks the resources as created by sockv5er in the console.
+func lightsailTags() []types.Tag {
+	return []types.Tag{{Key: aws.String("created-by"), Value: aws.String("sockv5er")}}
+}
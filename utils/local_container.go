@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	localContainerImage       = "alpine:3.19"
+	localContainerRegion      = "local"
+	localContainerSSHUsername = "root"
+	// localContainerHostKeyFilepath is where the host key is copied into the created container.
+	localContainerHostKeyFilepath = "/etc/sockv5er_host_key"
+)
+
+// localContainerScript turns an Alpine container into a stand-in for the cloud instances: sshd with the
+// generated host key and ssh key, and the UDP relay. The public key and the relay come in the environment, the
+// host key is a private key and is copied into the container before it starts.
+const localContainerScript = `set -e
+apk add --no-cache openssh-server python3 >/dev/null
+mkdir -p /root/.ssh
+printf '%s\n' "$SOCKV5ER_AUTHORIZED_KEY" > /root/.ssh/authorized_keys
+chmod 600 ` + localContainerHostKeyFilepath + ` /root/.ssh/authorized_keys
+printf '%s' "$SOCKV5ER_UDP_RELAY" > ` + udpRelayFilepath + `
+python3 ` + udpRelayFilepath + ` &
+touch ` + heartbeatFilepath + `
+# sshd refuses the keys of locked accounts and root is locked in the Alpine images.
+sed -i 's/^root:!/root:*/' /etc/shadow
+exec /usr/sbin/sshd -D -e -h ` + localContainerHostKeyFilepath + ` -o PermitRootLogin=prohibit-password -o AllowTcpForwarding=yes
+`
+
+// LocalContainerRepository runs the ssh server in a local Docker or Podman container instead of a cloud
+// instance, for developing and testing sockv5er without cloud credentials.
+type LocalContainerRepository struct {
+	Runtime       string
+	Image         string
+	ContainerName string
+	SSHPort       string
+	SSHKey        *HostKey
+	HostKey       *HostKey
+	// run runs the container runtime, it's replaced in the tests.
+	run          func(ctx context.Context, args ...string) (string, error)
+	readyTimeout time.Duration
+}
+
+func NewLocalContainerProvider() CloudProvider {
+	repo := &LocalContainerRepository{readyTimeout: 3 * time.Minute}
+	repo.run = repo.runRuntime
+	return repo
+}
+
+// Initialize uses the container_runtime setting, or docker or podman, whichever is installed.
+func (repo *LocalContainerRepository) Initialize(ctx context.Context, s *Settings) error {
+	repo.Runtime = s.ContainerRuntime
+	repo.Image = s.ContainerImage
+	if repo.Image == "" {
+		repo.Image = localContainerImage
+	}
+	if repo.Runtime != "" {
+		return nil
+	}
+	for _, runtime := range []string{"docker", "podman"} {
+		if _, err := exec.LookPath(runtime); err == nil {
+			repo.Runtime = runtime
+			return nil
+		}
+	}
+	return errors.New("install docker or podman, or set container_runtime, to use the local provider")
+}
+
+func (repo *LocalContainerRepository) runRuntime(ctx context.Context, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, repo.Runtime, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed with error: %w: %s", repo.Runtime, args[0], err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (repo *LocalContainerRepository) trackedResource() TrackedResource {
+	return TrackedResource{Kind: ProviderLocal, LocalContainer: &LocalContainerResource{
+		Region:        localContainerRegion,
+		Runtime:       repo.Runtime,
+		ContainerName: repo.ContainerName,
+	}}
+}
+
+func (repo *LocalContainerRepository) GetRegions(ctx context.Context, s *Settings) []Region {
+	return []Region{{ID: localContainerRegion, Country: "Local"}}
+}
+
+// CreateResources starts the container with its ssh port published on 127.0.0.1 and waits until sshd answers.
+func (repo *LocalContainerRepository) CreateResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	name := "sockv5er-" + suffix
+	repo.SSHKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	repo.HostKey, err = GenerateHostKey()
+	if err != nil {
+		return err
+	}
+	// The name is kept before the container is created, so that a run which is interrupted
+	// is still removed by DeleteResources.
+	repo.ContainerName = name
+	_, err = repo.run(ctx, "create", "--name", name,
+		"--label", "created-by=sockv5er",
+		"--publish", "127.0.0.1::22",
+		"--env", "SOCKV5ER_AUTHORIZED_KEY="+repo.SSHKey.AuthorizedKey(),
+		"--env", "SOCKV5ER_UDP_RELAY="+fmt.Sprintf(udpRelayScript, udpRelayPort, udpRelayIdleSeconds),
+		repo.Image, "sh", "-c", localContainerScript,
+	)
+	if err != nil {
+		return err
+	}
+	tracker.Update(repo.trackedResource(), Add)
+	err = repo.copyHostKey(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = repo.run(ctx, "start", name)
+	if err != nil {
+		return err
+	}
+	log.Infof("Container `%s` started with %s.\n", name, repo.Runtime)
+	published, err := repo.run(ctx, "port", name, "22/tcp")
+	if err != nil {
+		return err
+	}
+	// Podman and newer Docker versions print one line per address.
+	_, port, err := net.SplitHostPort(strings.Split(published, "\n")[0])
+	if err != nil {
+		return fmt.Errorf("unexpected port of container `%s`: %s", name, published)
+	}
+	repo.SSHPort = port
+	err = waitForSSHBanner(ctx, repo.GetHostIP()+":"+port, repo.readyTimeout)
+	if err != nil {
+		return err
+	}
+	log.Infoln("Container is ready.")
+	return nil
+}
+
+// copyHostKey copies the host key into the created container. Passed in the environment it would show up in ps
+// and in the inspect output of the container, so it goes through a file which only the user can read.
+func (repo *LocalContainerRepository) copyHostKey(ctx context.Context) error {
+	file, err := os.CreateTemp("", "sockv5er-host-key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(repo.HostKey.PrivateKeyPEM)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = repo.run(ctx, "cp", file.Name(), repo.ContainerName+":"+localContainerHostKeyFilepath)
+	return err
+}
+
+// waitForSSHBanner waits until the server at addr greets with the ssh banner. The published port
+// accepts connections before sshd runs, so an open port alone doesn't mean much.
+func waitForSSHBanner(ctx context.Context, addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			readDeadline := time.Now().Add(5 * time.Second)
+			if readDeadline.After(deadline) {
+				readDeadline = deadline
+			}
+			_ = conn.SetReadDeadline(readDeadline)
+			// Closing the connection stops the read when the context is cancelled.
+			read := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					_ = conn.Close()
+				case <-read:
+				}
+			}()
+			banner, _ := bufio.NewReader(conn).ReadString('\n')
+			close(read)
+			_ = conn.Close()
+			if strings.HasPrefix(banner, "SSH-") {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no ssh server answered on %s within %s", addr, timeout)
+		}
+		err = sleepContext(ctx, time.Second)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DeleteResources removes the container. A container which is already gone counts as deleted.
+func (repo *LocalContainerRepository) DeleteResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	resource := repo.trackedResource()
+	if repo.ContainerName != "" {
+		_, err := repo.run(ctx, "rm", "--force", repo.ContainerName)
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "no such container") {
+			log.Warnf("Container deletion failed with error: %s", err)
+			return err
+		}
+		log.Infof("Container `%s` deleted.\n", repo.ContainerName)
+	}
+	tracker.Update(resource, Remove)
+	return nil
+}
+
+func (repo *LocalContainerRepository) PrepareResourcesForDeletion(resource TrackedResource) {
+	res := resource.LocalContainer
+	repo.ContainerName = res.ContainerName
+	// The container is removed with the runtime which started it.
+	if res.Runtime != "" {
+		repo.Runtime = res.Runtime
+	}
+}
+
+func (repo *LocalContainerRepository) GetHostIP() string {
+	return "127.0.0.1"
+}
+
+func (repo *LocalContainerRepository) GetSSHPort() string {
+	return repo.SSHPort
+}
+
+func (repo *LocalContainerRepository) GetPrivateKey() []byte {
+	if repo.SSHKey == nil {
+		return nil
+	}
+	return repo.SSHKey.PrivateKeyPEM
+}
+
+func (repo *LocalContainerRepository) GetHostPublicKey() ssh.PublicKey {
+	if repo.HostKey == nil {
+		return nil
+	}
+	return repo.HostKey.PublicKey
+}
+
+func (repo *LocalContainerRepository) GetSSHUsername() string {
+	return localContainerSSHUsername
+}
+
+// OwnsHost is false, the container is removed by the cleanup and is never shut down or sent heartbeats.
+func (repo *LocalContainerRepository) OwnsHost() bool {
+	return false
+}
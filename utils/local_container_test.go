@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeContainerRuntime records the commands and the copied files, and publishes the container's ssh port on addr.
+type fakeContainerRuntime struct {
+	addr     string
+	commands [][]string
+	running  map[string]bool
+	copied   map[string]string
+}
+
+func (r *fakeContainerRuntime) run(ctx context.Context, args ...string) (string, error) {
+	r.commands = append(r.commands, args)
+	switch args[0] {
+	case "create":
+		r.running[args[2]] = true
+		return "0123456789abcdef", nil
+	case "cp":
+		content, err := os.ReadFile(args[1])
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(args[1])
+		if err != nil {
+			return "", err
+		}
+		if info.Mode().Perm() != 0600 {
+			return "", errors.New("the copied file can be read by others")
+		}
+		r.copied[args[2]] = string(content)
+		return "", nil
+	case "start":
+		return args[1], nil
+	case "port":
+		return r.addr + "\n[::1]:1", nil
+	case "rm":
+		if !r.running[args[2]] {
+			return "", errors.New("docker rm failed with error: exit status 1: Error response from daemon: No such container: " + args[2])
+		}
+		delete(r.running, args[2])
+		return args[2], nil
+	}
+	return "", errors.New("unexpected command")
+}
+
+func TestLocalContainerCreateAndDeleteResources(t *testing.T) {
+	server := startTestSSHServer(t)
+	runtime := &fakeContainerRuntime{addr: server.listener.Addr().String(), running: map[string]bool{}, copied: map[string]string{}}
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := &LocalContainerRepository{run: runtime.run, readyTimeout: 5 * time.Second}
+	err := repo.Initialize(context.Background(), &Settings{ContainerRuntime: "podman"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.CreateResources(context.Background(), localContainerRegion, &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(runtime.addr)
+	if repo.GetHostIP() != "127.0.0.1" || repo.GetSSHPort() != port || repo.GetSSHUsername() != "root" {
+		t.Errorf("Unexpected connection details: %s:%s %s", repo.GetHostIP(), repo.GetSSHPort(), repo.GetSSHUsername())
+	}
+	if ownsHost(repo) {
+		t.Error("The container must not be shut down or sent heartbeats")
+	}
+	create := strings.Join(runtime.commands[0], " ")
+	if !strings.Contains(create, "--publish 127.0.0.1::22") || !strings.Contains(create, localContainerImage+" sh -c") ||
+		!strings.Contains(create, "SOCKV5ER_AUTHORIZED_KEY="+repo.SSHKey.AuthorizedKey()) {
+		t.Errorf("Unexpected create command: %s", create)
+	}
+	for _, command := range runtime.commands {
+		if strings.Contains(strings.Join(command, " "), "PRIVATE KEY") {
+			t.Errorf("The host key is passed on the command line: %s", command[0])
+		}
+	}
+	if runtime.copied[repo.ContainerName+":"+localContainerHostKeyFilepath] != string(repo.HostKey.PrivateKeyPEM) {
+		t.Errorf("The host key wasn't copied into the container: %v", runtime.copied)
+	}
+	if _, err := os.Stat(runtime.commands[1][1]); !os.IsNotExist(err) {
+		t.Errorf("The copied host key file wasn't deleted: %v", err)
+	}
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 1 || tracked[0].Kind != ProviderLocal || tracked[0].LocalContainer.Runtime != "podman" ||
+		tracked[0].LocalContainer.ContainerName != repo.ContainerName {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+
+	cleanup := &LocalContainerRepository{run: runtime.run}
+	cleanup.PrepareResourcesForDeletion(tracked[0])
+	err = cleanup.DeleteResources(context.Background(), tracked[0].Region(), &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runtime.running) != 0 || len(tracker.TrackedResources()) != 0 {
+		t.Error("The container wasn't deleted")
+	}
+	// The container may have been removed by hand.
+	err = cleanup.DeleteResources(context.Background(), tracked[0].Region(), &Settings{}, tracker)
+	if err != nil {
+		t.Errorf("Deleting a container which is gone should succeed, got: %s", err)
+	}
+}
+
+func TestWaitForSSHBannerIgnoresSilentPorts(t *testing.T) {
+	// The published port of a starting container accepts connections before sshd runs.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	err = waitForSSHBanner(context.Background(), listener.Addr().String(), 100*time.Millisecond)
+	if err == nil {
+		t.Error("Expected a port without an ssh server to time out")
+	}
+}
+
+// TestLocalContainerLifecycle runs the provider against the real runtime. It pulls an image and installs
+// packages in the container, so it only runs when SOCKV5ER_CONTAINER_TESTS is set.
+func TestLocalContainerLifecycle(t *testing.T) {
+	if os.Getenv("SOCKV5ER_CONTAINER_TESTS") == "" {
+		t.Skip("set SOCKV5ER_CONTAINER_TESTS to run the tests with docker or podman")
+	}
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := NewLocalContainerProvider()
+	err := repo.Initialize(context.Background(), &Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := repo.DeleteResources(context.Background(), localContainerRegion, &Settings{}, tracker)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	err = repo.CreateResources(context.Background(), localContainerRegion, &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &SSHConfig{
+		PrivateKey:    repo.GetPrivateKey(),
+		SSHHost:       repo.GetHostIP(),
+		SSHPort:       repo.(SSHPortProvider).GetSSHPort(),
+		SSHUsername:   repo.GetSSHUsername(),
+		HostPublicKey: repo.GetHostPublicKey(),
+	}
+	client, err := config.connectToSSH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = sendHeartbeat(client)
+	if err != nil {
+		t.Errorf("Sending the heartbeat failed: %s", err)
+	}
+}
+
+func TestLocalContainerCreateResourcesCancelled(t *testing.T) {
+	// Nothing answers on the published port, so CreateResources waits until it's cancelled.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	runtime := &fakeContainerRuntime{addr: listener.Addr().String(), running: map[string]bool{}, copied: map[string]string{}}
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	repo := &LocalContainerRepository{run: runtime.run, readyTimeout: time.Minute}
+	err = repo.Initialize(context.Background(), &Settings{ContainerRuntime: "podman"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err = repo.CreateResources(ctx, localContainerRegion, &Settings{}, tracker)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the creation to be cancelled, got: %v", err)
+	}
+	err = repo.DeleteResources(context.Background(), localContainerRegion, &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runtime.running) != 0 || len(tracker.TrackedResources()) != 0 {
+		t.Error("The container of the cancelled creation wasn't deleted")
+	}
+}
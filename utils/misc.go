@@ -1,6 +1,14 @@
 package utils
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
 	externalip "github.com/glendc/go-external-ip"
 )
 
@@ -12,3 +20,58 @@ func GetExternalIP() (string, error) {
 	}
 	return "", err
 }
+
+// maxConcurrentRegions bounds the regions which are worked on at the same time.
+const maxConcurrentRegions = 8
+
+// forEachConcurrently calls fn with every index below count, at most limit of them at a time,
+// and returns once all of them are done.
+func forEachConcurrently(count int, limit int, fn func(i int)) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, limit)
+	for i := 0; i < count; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// sleepContext waits for the duration, or returns the error of ctx once it's cancelled.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// sessionOwner is user@host of the machine which starts the session, it tells the sessions of
+// several machines apart in the cloud console.
+func sessionOwner() string {
+	owner := "unknown"
+	if current, err := user.Current(); err == nil {
+		owner = current.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		owner += "@" + hostname
+	}
+	return owner
+}
+
+// randomSuffix is 8 random hex characters which keep the names of the resources apart.
+func randomSuffix() (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(suffix), nil
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEachConcurrentlyBoundsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	done := make([]bool, 20)
+	forEachConcurrently(len(done), 3, func(i int) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		done[i] = true
+	})
+	for i := range done {
+		if !done[i] {
+			t.Errorf("%d wasn't called", i)
+		}
+	}
+	if maxRunning > 3 || maxRunning < 2 {
+		t.Errorf("Expected at most 3 calls at a time, got: %d", maxRunning)
+	}
+}
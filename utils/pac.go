@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type PACRuleKind int
+
+const (
+	// PACDomain matches the domain and all of its subdomains.
+	PACDomain PACRuleKind = iota
+	// PACWildcard matches the host with a shell expression like `*.example.*`.
+	PACWildcard
+	// PACCIDR matches IPv4 addresses in the network.
+	PACCIDR
+)
+
+type PACRule struct {
+	Kind    PACRuleKind
+	Pattern string
+	Network *net.IPNet
+}
+
+// ParsePACRules parses domains (`example.com`), wildcards (`*.example.*`) and IPv4 CIDRs (`10.0.0.0/8`).
+func ParsePACRules(rules []string) ([]PACRule, error) {
+	parsed := make([]PACRule, 0, len(rules))
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case rule == "":
+			continue
+		case strings.Contains(rule, "/"):
+			_, network, err := net.ParseCIDR(rule)
+			if err != nil {
+				return nil, fmt.Errorf("`%s` is not a valid CIDR", rule)
+			}
+			if network.IP.To4() == nil {
+				return nil, fmt.Errorf("`%s` is not an IPv4 CIDR, PAC files only support IPv4 networks", rule)
+			}
+			parsed = append(parsed, PACRule{Kind: PACCIDR, Pattern: rule, Network: network})
+		case strings.ContainsAny(rule, " \t\"'\\:"):
+			return nil, fmt.Errorf("`%s` is not a domain, a wildcard or a CIDR", rule)
+		case strings.ContainsAny(rule, "*?"):
+			parsed = append(parsed, PACRule{Kind: PACWildcard, Pattern: rule})
+		default:
+			parsed = append(parsed, PACRule{Kind: PACDomain, Pattern: strings.TrimPrefix(rule, ".")})
+		}
+	}
+	return parsed, nil
+}
+
+func (r PACRule) condition() string {
+	quote := func(s string) string {
+		quoted, _ := json.Marshal(s)
+		return string(quoted)
+	}
+	switch r.Kind {
+	case PACWildcard:
+		return fmt.Sprintf("shExpMatch(host, %s)", quote(r.Pattern))
+	case PACCIDR:
+		// Only IP literals are matched, resolving every host name would leak it to the local DNS.
+		return fmt.Sprintf("isIPv4(host) && isInNet(host, %s, %s)", quote(r.Network.IP.String()), quote(net.IP(r.Network.Mask).String()))
+	default:
+		return fmt.Sprintf("(host == %s || dnsDomainIs(host, %s))", quote(r.Pattern), quote("."+r.Pattern))
+	}
+}
+
+// GeneratePAC returns a proxy auto-config file which sends the hosts matching the rules to the socksv5 server
+// and everything else direct. Without rules every host goes through the socksv5 server.
+func GeneratePAC(proxyHost string, proxyPort string, rules []PACRule) string {
+	address := net.JoinHostPort(proxyHost, proxyPort)
+	var pac strings.Builder
+	pac.WriteString("// Generated by sockv5er.\n")
+	pac.WriteString("function isIPv4(host) {\n  return /^\\d{1,3}(\\.\\d{1,3}){3}$/.test(host);\n}\n\n")
+	pac.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&pac, "  var proxy = \"SOCKS5 %s; SOCKS %s\";\n", address, address)
+	if len(rules) == 0 {
+		pac.WriteString("  return proxy;\n}\n")
+		return pac.String()
+	}
+	pac.WriteString("  host = host.toLowerCase();\n")
+	for _, rule := range rules {
+		fmt.Fprintf(&pac, "  if (%s) return proxy; // %s\n", rule.condition(), rule.Pattern)
+	}
+	pac.WriteString("  return \"DIRECT\";\n}\n")
+	return pac.String()
+}
+
+// PACServer serves the PAC file. The proxy address and the rules can be changed while it runs.
+type PACServer struct {
+	mu        sync.RWMutex
+	proxyHost string
+	proxyPort string
+	rules     []PACRule
+}
+
+func NewPACServer(proxyHost string, proxyPort string, rules []PACRule) *PACServer {
+	return &PACServer{proxyHost: proxyHost, proxyPort: proxyPort, rules: rules}
+}
+
+func (p *PACServer) SetProxy(proxyHost string, proxyPort string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proxyHost = proxyHost
+	p.proxyPort = proxyPort
+}
+
+func (p *PACServer) SetRules(rules []PACRule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+}
+
+func (p *PACServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.RLock()
+	proxyHost, proxyPort, rules := p.proxyHost, p.proxyPort, p.rules
+	p.mu.RUnlock()
+	if ip := net.ParseIP(proxyHost); ip != nil && ip.IsUnspecified() {
+		// The proxy listens on every interface, so the address the browser reached us on works for the proxy too.
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			proxyHost = host
+		} else {
+			proxyHost = "127.0.0.1"
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	// Browsers should pick up port and rule changes on their next fetch.
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = fmt.Fprint(w, GeneratePAC(proxyHost, proxyPort, rules))
+}
+
+// watchPACRules reloads the rules whenever the config file changes, until stop is closed.
+func watchPACRules(pac *PACServer, configFilepath string, interval time.Duration, stop <-chan struct{}) {
+	lastModified := time.Time{}
+	if info, err := os.Stat(configFilepath); err == nil {
+		lastModified = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(configFilepath)
+			if err != nil || info.ModTime().Equal(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+			rules, err := reloadPACRules(configFilepath)
+			if err != nil {
+				log.Warnf("Reloading the PAC rules failed with error: %s. Keeping the previous rules.\n", err)
+				continue
+			}
+			pac.SetRules(rules)
+			log.Infof("Reloaded %d PAC rules from `%s`.\n", len(rules), configFilepath)
+		}
+	}
+}
+
+func reloadPACRules(configFilepath string) ([]PACRule, error) {
+	settings, err := LoadSettings(configFilepath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if settings.PACRules == nil {
+		return nil, nil
+	}
+	return ParsePACRules(settings.PACRules)
+}
+
+// startPACServer serves the PAC file on host:port at every path, e.g. /proxy.pac.
+func startPACServer(pac *PACServer, host string, port string) (*http.Server, error) {
+	pacAddress := net.JoinHostPort(host, port)
+	listener, err := net.Listen("tcp", pacAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the PAC server: %w", err)
+	}
+	server := &http.Server{Handler: pac, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("PAC server stopped with error: %s\n", err)
+		}
+	}()
+	log.Infof("Serving the PAC file at http://%s/proxy.pac\n", pacAddress)
+	return server, nil
+}
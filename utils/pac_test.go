@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePACRules(t *testing.T) {
+	rules, err := ParsePACRules([]string{"Example.com", ".netflix.com", "*.bbc.*", "10.0.0.0/8", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PACRule{
+		{Kind: PACDomain, Pattern: "example.com"},
+		{Kind: PACDomain, Pattern: "netflix.com"},
+		{Kind: PACWildcard, Pattern: "*.bbc.*"},
+		{Kind: PACCIDR, Pattern: "10.0.0.0/8"},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("Unexpected number of rules: %d", len(rules))
+	}
+	for i := range want {
+		if rules[i].Kind != want[i].Kind || rules[i].Pattern != want[i].Pattern {
+			t.Errorf("Unexpected rule %d: %+v", i, rules[i])
+		}
+	}
+}
+
+func TestParsePACRulesRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []string{"10.0.0.0/33", "fd00::/8", "exa mple.com", "example.com\"); alert(1"} {
+		if _, err := ParsePACRules([]string{rule}); err == nil {
+			t.Errorf("The rule %q should be rejected", rule)
+		}
+	}
+}
+
+func TestGeneratePAC(t *testing.T) {
+	rules, _ := ParsePACRules([]string{"example.com", "10.0.0.0/8"})
+	pac := GeneratePAC("127.0.0.1", "1337", rules)
+	for _, want := range []string{
+		`var proxy = "SOCKS5 127.0.0.1:1337; SOCKS 127.0.0.1:1337";`,
+		`(host == "example.com" || dnsDomainIs(host, ".example.com"))`,
+		`isIPv4(host) && isInNet(host, "10.0.0.0", "255.0.0.0")`,
+		`return "DIRECT";`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("The PAC file doesn't contain %q:\n%s", want, pac)
+		}
+	}
+}
+
+func TestGeneratePACWithoutRules(t *testing.T) {
+	pac := GeneratePAC("127.0.0.1", "1337", nil)
+	if strings.Contains(pac, "DIRECT") {
+		t.Error("Without rules every host should go through the proxy")
+	}
+}
+
+func TestPACServerUpdatesLive(t *testing.T) {
+	pac := NewPACServer("0.0.0.0", "1337", nil)
+	server := httptest.NewServer(pac)
+	defer server.Close()
+	body := fetchPAC(t, server.URL)
+	if !strings.Contains(body, "SOCKS5 127.0.0.1:1337") {
+		t.Errorf("An unspecified listen address should be replaced with the requested host:\n%s", body)
+	}
+	rules, _ := ParsePACRules([]string{"example.com"})
+	pac.SetRules(rules)
+	pac.SetProxy("127.0.0.1", "1080")
+	body = fetchPAC(t, server.URL)
+	if !strings.Contains(body, "SOCKS5 127.0.0.1:1080") || !strings.Contains(body, `"example.com"`) {
+		t.Errorf("The PAC file didn't pick up the changes:\n%s", body)
+	}
+}
+
+func TestWatchPACRulesReloadsConfigFile(t *testing.T) {
+	clearAllENVs(t)
+	configFilepath := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(configFilepath, []byte("pac_rules = [\"example.com\"]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac := NewPACServer("127.0.0.1", "1337", nil)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchPACRules(pac, configFilepath, 10*time.Millisecond, stop)
+	err = os.WriteFile(configFilepath, []byte("pac_rules = [\"example.org\"]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 1; ; i++ {
+		// Keep moving the modification time, the watcher may only take its first look after the write.
+		future := time.Now().Add(time.Duration(i) * time.Second)
+		_ = os.Chtimes(configFilepath, future, future)
+		pac.mu.RLock()
+		rules := pac.rules
+		pac.mu.RUnlock()
+		if len(rules) == 1 && rules[0].Pattern == "example.org" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The PAC rules weren't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func fetchPAC(t *testing.T, url string) string {
+	response, err := http.Get(url + "/proxy.pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("Unexpected content type: %s", response.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(response.Body)
+	return string(body)
+}
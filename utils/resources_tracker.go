@@ -1,32 +1,146 @@
 package utils
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
+// ResourceTracker is safe for concurrent use, the resources of several regions are deleted at the same time.
 type ResourceTracker struct {
 	filepath  string
+	mu        sync.Mutex
+	cycle     sync.Mutex
 	resources *SockV5erResources
+	// sessionName and sessionPort are recorded with the sessions the tracker adds.
+	sessionName string
+	sessionPort string
 }
 
+// defaultSessionName is the session `sockv5er up` starts without --name. Sessions tracked before sessions
+// had names belong to it.
+const defaultSessionName = "default"
+
+var sessionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// validateSessionName checks the name given with `up --name`, it's part of a file name.
+func validateSessionName(name string) error {
+	if !sessionNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid session name `%s`, use up to 32 lowercase letters, digits and dashes, starting with a letter or a digit", name)
+	}
+	return nil
+}
+
+// The versions of resources.yaml. 1.0 has a section per provider, 2.0 a list of sessions with their status.
+const (
+	trackerVersion1 = "1.0"
+	trackerVersion2 = "2.0"
+)
+
+// SockV5erResources is resources.yaml, a session per entry with the resources of its provider.
 type SockV5erResources struct {
-	Version      string        `yaml:"version"`
-	Generator    string        `yaml:"generator"`
-	AWSResources []AWSResource `yaml:"awsResources"`
+	Version   string            `yaml:"version"`
+	Generator string            `yaml:"generator"`
+	Sessions  []TrackedResource `yaml:"sessions"`
 }
 
+// sockV5erResourcesV1 is resources.yaml as of version 1.0, it's only read to migrate it.
+type sockV5erResourcesV1 struct {
+	Version               string                   `yaml:"version"`
+	AWSResources          []AWSResource            `yaml:"awsResources"`
+	LightsailResources    []LightsailResource      `yaml:"lightsailResources"`
+	GCPResources          []GCPResource            `yaml:"gcpResources"`
+	DigitalOceanResources []DigitalOceanResource   `yaml:"digitalOceanResources"`
+	HetznerResources      []HetznerResource        `yaml:"hetznerResources"`
+	AzureResources        []AzureResource          `yaml:"azureResources"`
+	LocalContainers       []LocalContainerResource `yaml:"localContainers"`
+}
+
+// SessionStatus tells how far a tracked session got.
+type SessionStatus string
+
+const (
+	// StatusCreating is a session whose resources are being created, or whose creation failed.
+	StatusCreating SessionStatus = "creating"
+	// StatusActive is a session whose resources are all created.
+	StatusActive SessionStatus = "active"
+	// StatusDeleting is a session whose deletion started, it's left when the deletion failed.
+	StatusDeleting SessionStatus = "deleting"
+	// StatusUnknown is a session migrated from a version 1.0 file, which had no status.
+	StatusUnknown SessionStatus = "unknown"
+)
+
+// AWSResource is an EC2 session. Session is the value of the sockv5er:session tag of its resources,
+// entries written before the resources were tagged have none and are identified by InstanceId.
+// Intent is the resource which was being created when the entry was written, its id isn't known yet.
 type AWSResource struct {
-	Region          string `yaml:"region"`
-	InstanceId      string `yaml:"instanceId"`
-	SecurityGroupId string `yaml:"securityGroupId"`
-	KeyPairId       string `yaml:"keyPairId"`
+	Region          string `yaml:"region" json:"region"`
+	Session         string `yaml:"session,omitempty" json:"session,omitempty"`
+	Owner           string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Intent          string `yaml:"intent,omitempty" json:"intent,omitempty"`
+	InstanceId      string `yaml:"instanceId" json:"instanceId"`
+	SecurityGroupId string `yaml:"securityGroupId" json:"securityGroupId"`
+	KeyPairId       string `yaml:"keyPairId" json:"keyPairId"`
+}
+
+// LightsailResource is a Lightsail session. The key pair is created first, so KeyPairName identifies it.
+type LightsailResource struct {
+	Region       string `yaml:"region" json:"region"`
+	InstanceName string `yaml:"instanceName" json:"instanceName"`
+	KeyPairName  string `yaml:"keyPairName" json:"keyPairName"`
+}
+
+// GCPResource is a Compute Engine session. Region is the zone of the instance.
+type GCPResource struct {
+	Region       string `yaml:"region" json:"region"`
+	Project      string `yaml:"project" json:"project"`
+	InstanceName string `yaml:"instanceName" json:"instanceName"`
+	FirewallName string `yaml:"firewallName" json:"firewallName"`
+}
+
+// DigitalOceanResource is a droplet session. The ssh key is created first, so SSHKeyId identifies it.
+type DigitalOceanResource struct {
+	Region     string `yaml:"region" json:"region"`
+	DropletId  string `yaml:"dropletId" json:"dropletId"`
+	FirewallId string `yaml:"firewallId" json:"firewallId"`
+	SSHKeyId   string `yaml:"sshKeyId" json:"sshKeyId"`
+	Tag        string `yaml:"tag" json:"tag"`
+}
+
+// HetznerResource is a Hetzner Cloud session. Region is the location of the server,
+// the ssh key is created first, so SSHKeyId identifies it.
+type HetznerResource struct {
+	Region     string `yaml:"region" json:"region"`
+	ServerId   string `yaml:"serverId" json:"serverId"`
+	FirewallId string `yaml:"firewallId" json:"firewallId"`
+	SSHKeyId   string `yaml:"sshKeyId" json:"sshKeyId"`
+}
+
+// AzureResource is an Azure session, everything of it is in the resource group.
+type AzureResource struct {
+	Region         string `yaml:"region" json:"region"`
+	SubscriptionId string `yaml:"subscriptionId" json:"subscriptionId"`
+	ResourceGroup  string `yaml:"resourceGroup" json:"resourceGroup"`
+}
+
+// LocalContainerResource is a container started by the local provider.
+type LocalContainerResource struct {
+	Region        string `yaml:"region" json:"region"`
+	Runtime       string `yaml:"runtime" json:"runtime"`
+	ContainerName string `yaml:"containerName" json:"containerName"`
 }
 
 func GetNewTracker(trackerFilepath string) *ResourceTracker {
 	sockv5Resources := SockV5erResources{
-		Version:      "1.0",
-		Generator:    "SockV5er",
-		AWSResources: make([]AWSResource, 0),
+		Version:   trackerVersion2,
+		Generator: "SockV5er",
+		Sessions:  make([]TrackedResource, 0),
 	}
 	tracker := &ResourceTracker{
 		filepath:  trackerFilepath,
@@ -36,11 +150,13 @@ func GetNewTracker(trackerFilepath string) *ResourceTracker {
 }
 
 func (rt *ResourceTracker) WriteResourcesFile() error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
 	yamlContent, err := yaml.Marshal(&rt.resources)
 	if err != nil {
 		return err
 	}
-	err = WriteFileContent(rt.filepath, yamlContent)
+	err = writeFileAtomically(rt.filepath, yamlContent)
 	if err != nil {
 		return err
 	}
@@ -52,63 +168,416 @@ func (rt *ResourceTracker) ReadResourcesFile() error {
 	if err != nil {
 		return err
 	}
-	yamlContent := &SockV5erResources{}
-	err = yaml.Unmarshal(content, yamlContent)
+	resources, err := parseResourcesFile(content)
+	if err != nil {
+		return fmt.Errorf("reading `%s` failed: %w", rt.filepath, err)
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.resources = resources
+	return nil
+}
+
+// parseResourcesFile reads resources.yaml of any known version, a 1.0 file is migrated to the current version.
+// A version it doesn't know, e.g. one written by a newer sockv5er, is an error rather than a file read wrong.
+func parseResourcesFile(content []byte) (*SockV5erResources, error) {
+	header := struct {
+		Version string `yaml:"version"`
+	}{}
+	err := yaml.Unmarshal(content, &header)
+	if err != nil {
+		return nil, err
+	}
+	switch header.Version {
+	case trackerVersion2:
+		resources := &SockV5erResources{}
+		err = yaml.Unmarshal(content, resources)
+		if err != nil {
+			return nil, err
+		}
+		if resources.Sessions == nil {
+			resources.Sessions = make([]TrackedResource, 0)
+		}
+		return resources, nil
+	case trackerVersion1, "":
+		v1 := &sockV5erResourcesV1{}
+		err = yaml.Unmarshal(content, v1)
+		if err != nil {
+			return nil, err
+		}
+		return v1.migrate(), nil
+	}
+	return nil, fmt.Errorf("unsupported version %q, this sockv5er reads the versions %s and %s, the file may be from a newer sockv5er",
+		header.Version, trackerVersion1, trackerVersion2)
+}
+
+// migrate turns the sections of a 1.0 file into sessions. When they were created and how far they got
+// wasn't recorded, so their status is unknown.
+func (v1 *sockV5erResourcesV1) migrate() *SockV5erResources {
+	resources := &SockV5erResources{Version: trackerVersion2, Generator: "SockV5er", Sessions: make([]TrackedResource, 0)}
+	add := func(resource TrackedResource) {
+		resource.ID = newSessionID(resource)
+		resource.Status = StatusUnknown
+		resources.Sessions = append(resources.Sessions, resource)
+	}
+	for i := range v1.AWSResources {
+		add(TrackedResource{Kind: ProviderAWS, AWS: &v1.AWSResources[i]})
+	}
+	for i := range v1.LightsailResources {
+		add(TrackedResource{Kind: ProviderLightsail, Lightsail: &v1.LightsailResources[i]})
+	}
+	for i := range v1.GCPResources {
+		add(TrackedResource{Kind: ProviderGCP, GCP: &v1.GCPResources[i]})
+	}
+	for i := range v1.DigitalOceanResources {
+		add(TrackedResource{Kind: ProviderDigitalOcean, DigitalOcean: &v1.DigitalOceanResources[i]})
+	}
+	for i := range v1.HetznerResources {
+		add(TrackedResource{Kind: ProviderHetzner, Hetzner: &v1.HetznerResources[i]})
+	}
+	for i := range v1.AzureResources {
+		add(TrackedResource{Kind: ProviderAzure, Azure: &v1.AzureResources[i]})
+	}
+	for i := range v1.LocalContainers {
+		add(TrackedResource{Kind: ProviderLocal, LocalContainer: &v1.LocalContainers[i]})
+	}
+	return resources
+}
+
+// reload replaces the resources with the ones in resources.yaml, when there is a file with resources in it.
+func (rt *ResourceTracker) reload() error {
+	content, err := os.ReadFile(rt.filepath)
+	if os.IsNotExist(err) || (err == nil && len(bytes.TrimSpace(content)) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resources, err := parseResourcesFile(content)
 	if err != nil {
 		return err
 	}
-	rt.resources = yamlContent
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.resources = resources
+	return nil
+}
+
+// modify applies the change to the resources in resources.yaml and writes them back. The cycle holds the
+// lock of the file, so the entries another sockv5er process wrote since the last read are kept. When the file
+// can't be locked or read the change is only made in memory, a file which can't be read isn't overwritten.
+func (rt *ResourceTracker) modify(change func()) error {
+	rt.cycle.Lock()
+	defer rt.cycle.Unlock()
+	unlock, err := lockFile(rt.filepath + ".lock")
+	if err != nil {
+		change()
+		return err
+	}
+	defer unlock()
+	err = rt.reload()
+	if err != nil {
+		change()
+		return err
+	}
+	change()
+	return rt.WriteResourcesFile()
+}
+
+// TrackedResource is a session of any provider. Kind is the provider which created it and tells which
+// one of the typed resources is set. ID, CreatedAt and Status are filled in by the tracker, and so are Name
+// and Port, the name given with `up --name` and the port of its socksv5 server.
+type TrackedResource struct {
+	ID             string                  `yaml:"id" json:"id"`
+	Name           string                  `yaml:"name,omitempty" json:"name,omitempty"`
+	Port           string                  `yaml:"port,omitempty" json:"port,omitempty"`
+	Kind           string                  `yaml:"provider" json:"provider"`
+	CreatedAt      time.Time               `yaml:"createdAt,omitempty" json:"createdAt"`
+	Status         SessionStatus           `yaml:"status" json:"status"`
+	AWS            *AWSResource            `yaml:"aws,omitempty" json:"aws,omitempty"`
+	Lightsail      *LightsailResource      `yaml:"lightsail,omitempty" json:"lightsail,omitempty"`
+	GCP            *GCPResource            `yaml:"gcp,omitempty" json:"gcp,omitempty"`
+	DigitalOcean   *DigitalOceanResource   `yaml:"digitalocean,omitempty" json:"digitalocean,omitempty"`
+	Hetzner        *HetznerResource        `yaml:"hetzner,omitempty" json:"hetzner,omitempty"`
+	Azure          *AzureResource          `yaml:"azure,omitempty" json:"azure,omitempty"`
+	LocalContainer *LocalContainerResource `yaml:"local,omitempty" json:"local,omitempty"`
+}
+
+// providerResource is implemented by the typed resources of the providers.
+type providerResource interface {
+	region() string
+	// describe lists the ids of the resources, e.g. for the cleanup errors.
+	describe() []string
+	// key identifies the session among the ones of the provider, it's set once the first resource is created.
+	key() string
+}
+
+func (r TrackedResource) resource() providerResource {
+	switch {
+	case r.Kind == ProviderAWS && r.AWS != nil:
+		return r.AWS
+	case r.Kind == ProviderLightsail && r.Lightsail != nil:
+		return r.Lightsail
+	case r.Kind == ProviderGCP && r.GCP != nil:
+		return r.GCP
+	case r.Kind == ProviderDigitalOcean && r.DigitalOcean != nil:
+		return r.DigitalOcean
+	case r.Kind == ProviderHetzner && r.Hetzner != nil:
+		return r.Hetzner
+	case r.Kind == ProviderAzure && r.Azure != nil:
+		return r.Azure
+	case r.Kind == ProviderLocal && r.LocalContainer != nil:
+		return r.LocalContainer
+	}
 	return nil
 }
 
-func (rt *ResourceTracker) AddAWSResource(resource *AWSResource) {
-	rt.resources.AWSResources = append(rt.resources.AWSResources, *resource)
+// SessionName is the name of the session the resources belong to.
+func (r TrackedResource) SessionName() string {
+	if r.Name == "" {
+		return defaultSessionName
+	}
+	return r.Name
+}
+
+// Region is the region the resources are in, as passed to DeleteResources.
+func (r TrackedResource) Region() string {
+	if resource := r.resource(); resource != nil {
+		return resource.region()
+	}
+	return ""
+}
+
+// Describe lists the ids of the resources as `key: value` in a stable order.
+func (r TrackedResource) Describe() []string {
+	if resource := r.resource(); resource != nil {
+		return resource.describe()
+	}
+	return nil
+}
+
+// describeFields formats the non-empty values of the key and value pairs.
+func describeFields(keysAndValues ...string) []string {
+	fields := make([]string, 0, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i+1] != "" {
+			fields = append(fields, keysAndValues[i]+": "+keysAndValues[i+1])
+		}
+	}
+	return fields
+}
+
+func (a *AWSResource) region() string { return a.Region }
+
+// key is the session, entries of 1.0 files have none and are told apart by the first resource they have.
+func (a *AWSResource) key() string {
+	switch {
+	case a.Session != "":
+		return a.Session
+	case a.InstanceId != "":
+		return "instance:" + a.InstanceId
+	case a.SecurityGroupId != "":
+		return "security-group:" + a.SecurityGroupId
+	}
+	return "key-pair:" + a.KeyPairId
+}
+
+func (a *AWSResource) describe() []string {
+	return describeFields("session", a.Session, "owner", a.Owner, "intent", a.Intent, "instanceId", a.InstanceId, "keyPairId", a.KeyPairId, "securityGroupId", a.SecurityGroupId)
 }
 
-func (rt *ResourceTracker) RemoveAWSResource(resource *AWSResource) {
-	for i := range rt.resources.AWSResources {
-		sliceLength := len(rt.resources.AWSResources)
-		if rt.resources.AWSResources[i].InstanceId == resource.InstanceId {
-			if sliceLength <= 1 {
-				rt.resources.AWSResources = []AWSResource{}
-				return
-			} else {
-				rt.resources.AWSResources[i] = rt.resources.AWSResources[sliceLength-1]
-				rt.resources.AWSResources[sliceLength-1] = AWSResource{}
-				rt.resources.AWSResources = rt.resources.AWSResources[:sliceLength-1]
-				return
+func (l *LightsailResource) region() string { return l.Region }
+
+func (l *LightsailResource) key() string { return l.KeyPairName }
+
+func (l *LightsailResource) describe() []string {
+	return describeFields("instanceName", l.InstanceName, "keyPairName", l.KeyPairName)
+}
+
+func (g *GCPResource) region() string { return g.Region }
+
+func (g *GCPResource) key() string { return g.Project + "/" + g.FirewallName }
+
+func (g *GCPResource) describe() []string {
+	return describeFields("firewallName", g.FirewallName, "instanceName", g.InstanceName, "project", g.Project)
+}
+
+func (d *DigitalOceanResource) region() string { return d.Region }
+
+func (d *DigitalOceanResource) key() string { return d.SSHKeyId }
+
+func (d *DigitalOceanResource) describe() []string {
+	return describeFields("dropletId", d.DropletId, "firewallId", d.FirewallId, "sshKeyId", d.SSHKeyId, "tag", d.Tag)
+}
+
+func (h *HetznerResource) region() string { return h.Region }
+
+func (h *HetznerResource) key() string { return h.SSHKeyId }
+
+func (h *HetznerResource) describe() []string {
+	return describeFields("firewallId", h.FirewallId, "serverId", h.ServerId, "sshKeyId", h.SSHKeyId)
+}
+
+func (a *AzureResource) region() string { return a.Region }
+
+func (a *AzureResource) key() string { return a.ResourceGroup }
+
+func (a *AzureResource) describe() []string {
+	return describeFields("resourceGroup", a.ResourceGroup, "subscriptionId", a.SubscriptionId)
+}
+
+func (c *LocalContainerResource) region() string { return c.Region }
+
+func (c *LocalContainerResource) key() string { return c.ContainerName }
+
+func (c *LocalContainerResource) describe() []string {
+	return describeFields("containerName", c.ContainerName, "runtime", c.Runtime)
+}
+
+// sameSession tells whether the resources are of the same session of the same provider.
+func (r TrackedResource) sameSession(other TrackedResource) bool {
+	resource, otherResource := r.resource(), other.resource()
+	return resource != nil && otherResource != nil && r.Kind == other.Kind && resource.key() == otherResource.key()
+}
+
+// clone copies the resource with its typed part, so the copy can change without changing the tracker.
+func (r TrackedResource) clone() TrackedResource {
+	switch {
+	case r.AWS != nil:
+		resource := *r.AWS
+		r.AWS = &resource
+	case r.Lightsail != nil:
+		resource := *r.Lightsail
+		r.Lightsail = &resource
+	case r.GCP != nil:
+		resource := *r.GCP
+		r.GCP = &resource
+	case r.DigitalOcean != nil:
+		resource := *r.DigitalOcean
+		r.DigitalOcean = &resource
+	case r.Hetzner != nil:
+		resource := *r.Hetzner
+		r.Hetzner = &resource
+	case r.Azure != nil:
+		resource := *r.Azure
+		r.Azure = &resource
+	case r.LocalContainer != nil:
+		resource := *r.LocalContainer
+		r.LocalContainer = &resource
+	}
+	return r
+}
+
+// newSessionID is the session tag for AWS, which has one, and random otherwise.
+func newSessionID(resource TrackedResource) string {
+	if resource.AWS != nil && resource.AWS.Session != "" {
+		return resource.AWS.Session
+	}
+	id, err := randomSuffix()
+	if err != nil {
+		return "unknown"
+	}
+	return id
+}
+
+// setSession names the sessions the tracker adds from now on.
+func (rt *ResourceTracker) setSession(name, port string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.sessionName, rt.sessionPort = name, port
+}
+
+// Add tracks the resource, or updates the resources of its session if it's tracked already.
+// The ID, name and creation time of a session stay, a new one starts as creating unless the resource has a status.
+func (rt *ResourceTracker) Add(resource TrackedResource) {
+	if resource.resource() == nil {
+		return
+	}
+	resource = resource.clone()
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for i, tracked := range rt.resources.Sessions {
+		if tracked.sameSession(resource) {
+			resource.ID, resource.CreatedAt = tracked.ID, tracked.CreatedAt
+			if resource.Name == "" {
+				resource.Name, resource.Port = tracked.Name, tracked.Port
 			}
+			if resource.Status == "" {
+				resource.Status = tracked.Status
+			}
+			rt.resources.Sessions[i] = resource
+			return
 		}
 	}
+	if resource.ID == "" {
+		resource.ID = newSessionID(resource)
+	}
+	if resource.Name == "" {
+		resource.Name, resource.Port = rt.sessionName, rt.sessionPort
+	}
+	if resource.CreatedAt.IsZero() {
+		resource.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	if resource.Status == "" {
+		resource.Status = StatusCreating
+	}
+	rt.resources.Sessions = append(rt.resources.Sessions, resource)
 }
 
-func (rt *ResourceTracker) GetResources() *[]AWSResource {
-	return &rt.resources.AWSResources
+// Remove stops tracking the session of the resource.
+func (rt *ResourceTracker) Remove(resource TrackedResource) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for i, tracked := range rt.resources.Sessions {
+		if tracked.sameSession(resource) {
+			rt.resources.Sessions = append(rt.resources.Sessions[:i], rt.resources.Sessions[i+1:]...)
+			return
+		}
+	}
 }
 
-func ToMap(a *AWSResource) map[string]string {
-	resourceMap := make(map[string]string)
-	resourceMap["region"] = a.Region
-	resourceMap["instanceId"] = a.InstanceId
-	resourceMap["securityGroupId"] = a.SecurityGroupId
-	resourceMap["keyPairId"] = a.KeyPairId
-	return resourceMap
+// Update adds or removes the resource in resources.yaml. A failed write is only logged,
+// the session goes on and the resource stays tracked in memory.
+func (rt *ResourceTracker) Update(resource TrackedResource, op TrackingOp) {
+	err := rt.modify(func() {
+		if op == Add {
+			rt.Add(resource)
+		} else if op == Remove {
+			rt.Remove(resource)
+		}
+	})
+	if err != nil {
+		log.Warnf("Updating resources tracker file failed with err: %s.", err)
+	}
 }
 
-func FromMap(resourceMap map[string]string) *AWSResource {
-	return &AWSResource{
-		Region:          resourceMap["region"],
-		InstanceId:      resourceMap["instanceId"],
-		SecurityGroupId: resourceMap["securityGroupId"],
-		KeyPairId:       resourceMap["keyPairId"],
+// SetStatus changes the status of the session of the resource in resources.yaml, if it's tracked.
+func (rt *ResourceTracker) SetStatus(resource TrackedResource, status SessionStatus) {
+	err := rt.modify(func() {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		for i := range rt.resources.Sessions {
+			if rt.resources.Sessions[i].sameSession(resource) {
+				rt.resources.Sessions[i].Status = status
+			}
+		}
+	})
+	if err != nil {
+		log.Warnf("Updating resources tracker file failed with err: %s.", err)
 	}
 }
 
-func FromAWSRepository(a *AWSRepository) *AWSResource {
-	return &AWSResource{
-		Region:          a.Region,
-		InstanceId:      a.Ec2InstanceId,
-		SecurityGroupId: a.SecurityGroupID,
-		KeyPairId:       a.KeyPairId,
+// TrackedResources returns the sessions of every provider, ready for the PrepareResourcesForDeletion
+// of the provider of their Kind.
+func (rt *ResourceTracker) TrackedResources() []TrackedResource {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	// The resources are copies, so the sessions can change while the caller goes through them.
+	resources := make([]TrackedResource, 0, len(rt.resources.Sessions))
+	for _, resource := range rt.resources.Sessions {
+		if resource.resource() != nil {
+			resources = append(resources, resource.clone())
+		}
 	}
+	return resources
 }
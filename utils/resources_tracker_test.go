@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrackedResourcesRoundTrip(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	tracker := GetNewTracker(trackerFilepath)
+	tracker.Update(TrackedResource{Kind: ProviderAWS, AWS: &AWSResource{Region: "eu-west-2", InstanceId: "i-1", KeyPairId: "key-1"}}, Add)
+	tracker.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", ServerId: "7", SSHKeyId: "8"}}, Add)
+
+	readTracker := GetNewTracker(trackerFilepath)
+	err := readTracker.ReadResourcesFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := readTracker.TrackedResources()
+	if len(tracked) != 2 || tracked[0].Kind != ProviderAWS || tracked[1].Kind != ProviderHetzner {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+	if tracked[0].Region() != "eu-west-2" || tracked[1].Region() != "nbg1" {
+		t.Errorf("Unexpected regions: %s, %s", tracked[0].Region(), tracked[1].Region())
+	}
+	// The empty ids are left out.
+	want := []string{"instanceId: i-1", "keyPairId: key-1"}
+	if got := tracked[0].Describe(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got: %v", want, got)
+	}
+
+	// The resources are removed while going through them, like the cleanup does.
+	for _, resource := range tracked {
+		readTracker.Update(resource, Remove)
+	}
+	if len(readTracker.TrackedResources()) != 0 {
+		t.Errorf("Expected every resource to be removed, got: %v", readTracker.TrackedResources())
+	}
+}
+
+func TestTrackedResourceOfAnotherKind(t *testing.T) {
+	// A resource whose typed part doesn't match its kind is ignored instead of panicking.
+	resource := TrackedResource{Kind: ProviderGCP, AWS: &AWSResource{Region: "eu-west-2"}}
+	if resource.Region() != "" || resource.Describe() != nil {
+		t.Errorf("Unexpected region or description: %s %v", resource.Region(), resource.Describe())
+	}
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	tracker.Add(resource)
+	if len(tracker.TrackedResources()) != 0 {
+		t.Error("Expected the resource not to be tracked")
+	}
+}
+
+func TestAWSResourcesOfASession(t *testing.T) {
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	// An entry written before the sessions were tagged.
+	tracker.Add(TrackedResource{Kind: ProviderAWS, AWS: &AWSResource{Region: "eu-west-2", InstanceId: "i-1"}})
+	// The session is tracked as its resources are created, with no instance yet at first.
+	tracker.Add(TrackedResource{Kind: ProviderAWS, AWS: &AWSResource{Region: "eu-west-2", Session: "aaaa", SecurityGroupId: "sg-2"}})
+	tracker.Add(TrackedResource{Kind: ProviderAWS, AWS: &AWSResource{Region: "eu-west-2", Session: "aaaa", SecurityGroupId: "sg-2", InstanceId: "i-2"}})
+	if tracked := tracker.TrackedResources(); len(tracked) != 2 || tracked[1].AWS.InstanceId != "i-2" {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+	tracker.Remove(TrackedResource{Kind: ProviderAWS, AWS: &AWSResource{InstanceId: "i-1"}})
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 1 || tracked[0].AWS.Session != "aaaa" {
+		t.Fatalf("Expected only the tagged session to be left, got: %v", tracked)
+	}
+}
+
+func TestTrackerConcurrentUpdates(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	tracker := GetNewTracker(trackerFilepath)
+	forEachConcurrently(40, 8, func(i int) {
+		tracker.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: fmt.Sprint(i)}}, Add)
+	})
+	// Half of them are deleted at the same time, like the cleanup of several regions does.
+	forEachConcurrently(20, 8, func(i int) {
+		tracker.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{SSHKeyId: fmt.Sprint(i * 2)}}, Remove)
+	})
+	readTracker := GetNewTracker(trackerFilepath)
+	err := readTracker.ReadResourcesFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracked := readTracker.TrackedResources(); len(tracked) != 20 {
+		t.Errorf("Expected 20 tracked resources, got: %d", len(tracked))
+	}
+}
+
+func TestTrackersOfTwoProcessesKeepEachOthersEntries(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	first := GetNewTracker(trackerFilepath)
+	second := GetNewTracker(trackerFilepath)
+	first.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1"}}, Add)
+	second.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "fsn1", SSHKeyId: "2"}}, Add)
+	first.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1", ServerId: "3"}}, Add)
+
+	readTracker := GetNewTracker(trackerFilepath)
+	err := readTracker.ReadResourcesFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := readTracker.TrackedResources()
+	if len(tracked) != 2 || tracked[0].Hetzner.ServerId != "3" || tracked[1].Hetzner.SSHKeyId != "2" {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+	entries, err := os.ReadDir(filepath.Dir(trackerFilepath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "resources.yaml" && entry.Name() != "resources.yaml.lock" {
+			t.Errorf("Unexpected file left behind: %s", entry.Name())
+		}
+	}
+}
+
+func TestTrackerDoesNotOverwriteUnreadableFile(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	err := os.WriteFile(trackerFilepath, []byte("awsResources: [unclosed"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := GetNewTracker(trackerFilepath)
+	tracker.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1"}}, Add)
+	content, err := os.ReadFile(trackerFilepath)
+	if err != nil || string(content) != "awsResources: [unclosed" {
+		t.Errorf("The unreadable file was overwritten: %s %v", content, err)
+	}
+	if len(tracker.TrackedResources()) != 1 {
+		t.Error("Expected the resource to be tracked in memory")
+	}
+}
+
+func TestTrackerMigratesVersion1Files(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	v1 := `version: "1.0"
+generator: SockV5er
+awsResources:
+- region: eu-west-2
+  session: aaaa
+  instanceId: i-1
+  securityGroupId: sg-1
+  keyPairId: key-1
+hetznerResources:
+- region: nbg1
+  serverId: "7"
+  firewallId: "9"
+  sshKeyId: "8"
+`
+	err := os.WriteFile(trackerFilepath, []byte(v1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := GetNewTracker(trackerFilepath)
+	err = tracker.ReadResourcesFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 2 || tracked[0].Kind != ProviderAWS || tracked[0].AWS.InstanceId != "i-1" ||
+		tracked[1].Kind != ProviderHetzner || tracked[1].Hetzner.ServerId != "7" {
+		t.Fatalf("Unexpected migrated resources: %v", tracked)
+	}
+	// The AWS session keeps the id of its tags.
+	if tracked[0].ID != "aaaa" || tracked[1].ID == "" || tracked[0].Status != StatusUnknown || tracked[1].Status != StatusUnknown {
+		t.Errorf("Unexpected ids or statuses: %v", tracked)
+	}
+
+	// The next write saves the migrated file in the current version.
+	tracker.Update(tracked[1], Remove)
+	content, err := os.ReadFile(trackerFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `version: "2.0"`) || !strings.Contains(string(content), "instanceId: i-1") ||
+		strings.Contains(string(content), "hetzner") {
+		t.Errorf("Unexpected file after the migration: %s", content)
+	}
+}
+
+func TestTrackerKeepsMigratedAWSEntriesWithoutInstance(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	// Runs of 1.0 which stopped before the instance was created left entries with only a security group or a key pair.
+	v1 := `version: "1.0"
+generator: SockV5er
+awsResources:
+- region: eu-west-2
+  securityGroupId: sg-1
+- region: eu-west-2
+  securityGroupId: sg-2
+  keyPairId: key-2
+- region: us-east-1
+  keyPairId: key-3
+`
+	err := os.WriteFile(trackerFilepath, []byte(v1), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := GetNewTracker(trackerFilepath)
+	err = tracker.ReadResourcesFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := tracker.TrackedResources()
+	if len(tracked) != 3 {
+		t.Fatalf("Unexpected migrated resources: %v", tracked)
+	}
+	tracker.Update(tracked[0], Remove)
+	remaining := tracker.TrackedResources()
+	if len(remaining) != 2 || remaining[0].AWS.SecurityGroupId != "sg-2" || remaining[1].AWS.KeyPairId != "key-3" {
+		t.Errorf("Removing one entry changed the others: %v", remaining)
+	}
+}
+
+func TestTrackerRejectsUnknownVersions(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	future := "version: \"3.0\"\nsessions: []\n"
+	err := os.WriteFile(trackerFilepath, []byte(future), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := GetNewTracker(trackerFilepath)
+	err = tracker.ReadResourcesFile()
+	if err == nil || !strings.Contains(err.Error(), `unsupported version "3.0"`) {
+		t.Errorf("Expected an unsupported version error, got: %v", err)
+	}
+	tracker.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1"}}, Add)
+	content, _ := os.ReadFile(trackerFilepath)
+	if string(content) != future {
+		t.Errorf("The file of the unknown version was overwritten: %s", content)
+	}
+}
+
+func TestTrackerKeepsTheSessionWhileItChanges(t *testing.T) {
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	tracker.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1"}}, Add)
+	created := tracker.TrackedResources()[0]
+	if created.ID == "" || created.CreatedAt.IsZero() || created.Status != StatusCreating {
+		t.Fatalf("Unexpected new session: %v", created)
+	}
+	tracker.SetStatus(created, StatusActive)
+	tracker.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1", ServerId: "7"}}, Add)
+	updated := tracker.TrackedResources()
+	if len(updated) != 1 || updated[0].ID != created.ID || !updated[0].CreatedAt.Equal(created.CreatedAt) ||
+		updated[0].Status != StatusActive || updated[0].Hetzner.ServerId != "7" {
+		t.Errorf("Unexpected session after the update: %v", updated)
+	}
+}
+
+func TestTrackersOfTwoSessionsNameTheirEntries(t *testing.T) {
+	trackerFilepath := filepath.Join(t.TempDir(), "resources.yaml")
+	first, second := GetNewTracker(trackerFilepath), GetNewTracker(trackerFilepath)
+	first.setSession(defaultSessionName, "1337")
+	second.setSession("us-exit", "1080")
+	first.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "1"}}, Add)
+	second.Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "2"}}, Add)
+	// The cleanup tracks with an unnamed tracker, the update keeps the name of the session.
+	GetNewTracker(trackerFilepath).Update(TrackedResource{Kind: ProviderHetzner, Hetzner: &HetznerResource{Region: "nbg1", SSHKeyId: "2", ServerId: "7"}}, Add)
+
+	readTracker := GetNewTracker(trackerFilepath)
+	err := readTracker.ReadResourcesFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := readTracker.TrackedResources()
+	if len(tracked) != 2 {
+		t.Fatalf("Unexpected tracked resources: %v", tracked)
+	}
+	if tracked[0].SessionName() != defaultSessionName || tracked[0].Port != "1337" {
+		t.Errorf("Unexpected first session: %v", tracked[0])
+	}
+	if tracked[1].SessionName() != "us-exit" || tracked[1].Port != "1080" || tracked[1].Hetzner.ServerId != "7" {
+		t.Errorf("Unexpected second session: %v", tracked[1])
+	}
+}
+
+func TestValidateSessionName(t *testing.T) {
+	for _, name := range []string{"default", "us-exit", "1"} {
+		if err := validateSessionName(name); err != nil {
+			t.Errorf("Expected `%s` to be valid, got: %s", name, err)
+		}
+	}
+	for _, name := range []string{"", "-exit", "US", "us_exit", "../exit", strings.Repeat("a", 33)} {
+		if err := validateSessionName(name); err == nil {
+			t.Errorf("Expected `%s` to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errNotFound is returned for a 404, deleting something which is gone already isn't an error for the providers.
+var errNotFound = errors.New("not found")
+
+// RESTClient is a minimal client of a JSON REST API which takes a fixed bearer token, like the DigitalOcean
+// and the Hetzner Cloud APIs.
+type RESTClient struct {
+	Endpoint string
+	Token    string
+	HTTP     *http.Client
+}
+
+func (c *RESTClient) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	return doJSON(ctx, c.HTTP, method, c.Endpoint, path, c.Token, body, out)
+}
+
+// doJSON sends the body as JSON to the path of the endpoint and decodes the JSON response into out. The message
+// of a failed request is taken from `message` or `error.message`, which covers the APIs of all the providers.
+func doJSON(ctx context.Context, client *http.Client, method, endpoint, path, token string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(endpoint, "/")+"/"+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", method, path, errNotFound)
+	}
+	if response.StatusCode >= 300 {
+		var apiError struct {
+			Message string `json:"message"`
+			Error   struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(content, &apiError) == nil {
+			if message := apiError.Message + apiError.Error.Message; message != "" {
+				return fmt.Errorf("%s %s failed with status %d: %s", method, path, response.StatusCode, message)
+			}
+		}
+		return fmt.Errorf("%s %s failed with status %d", method, path, response.StatusCode)
+	}
+	if out != nil && len(content) > 0 {
+		return json.Unmarshal(content, out)
+	}
+	return nil
+}
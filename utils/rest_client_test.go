@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeRequest is a request to one of the fake provider APIs with the helpers their handlers share.
+type fakeRequest struct {
+	*http.Request
+	w http.ResponseWriter
+	t *testing.T
+}
+
+func (r *fakeRequest) reply(status int, value interface{}) {
+	r.w.WriteHeader(status)
+	_ = json.NewEncoder(r.w).Encode(value)
+}
+
+func (r *fakeRequest) decode() map[string]interface{} {
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		r.t.Errorf("Invalid request body for %s: %s", r.URL.Path, err)
+	}
+	return body
+}
+
+// startFakeAPI serves a local stand-in for the API of a provider. The requests are handled one at a time,
+// and only with the token the test clients use.
+func startFakeAPI(t *testing.T, handle func(r *fakeRequest)) *httptest.Server {
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handle(&fakeRequest{Request: r, w: w, t: t})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRESTClientErrors(t *testing.T) {
+	server := startFakeAPI(t, func(r *fakeRequest) {
+		switch r.URL.Path {
+		case "/top-level":
+			r.reply(http.StatusUnprocessableEntity, map[string]string{"message": "size is invalid"})
+		case "/nested":
+			r.reply(http.StatusConflict, map[string]interface{}{"error": map[string]string{"code": "conflict", "message": "name is taken"}})
+		default:
+			r.reply(http.StatusNotFound, map[string]string{"message": "not found"})
+		}
+	})
+	client := &RESTClient{Endpoint: server.URL + "/", Token: "test-token", HTTP: server.Client()}
+	err := client.do(context.Background(), http.MethodPost, "top-level", map[string]string{}, nil)
+	if err == nil || err.Error() != "POST top-level failed with status 422: size is invalid" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err = client.do(context.Background(), http.MethodPost, "nested", map[string]string{}, nil)
+	if err == nil || err.Error() != "POST nested failed with status 409: name is taken" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err = client.do(context.Background(), http.MethodDelete, "gone", nil, nil)
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("Expected a not found error, got: %v", err)
+	}
+	client.Token = "wrong-token"
+	err = client.do(context.Background(), http.MethodGet, "top-level", nil, nil)
+	if err == nil || err.Error() != "GET top-level failed with status 401" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-socks5"
+	log "github.com/sirupsen/logrus"
+)
+
+type RouteAction int
+
+const (
+	RouteTunnel RouteAction = iota
+	RouteDirect
+	RouteReject
+)
+
+func (a RouteAction) String() string {
+	switch a {
+	case RouteDirect:
+		return "direct"
+	case RouteReject:
+		return "reject"
+	default:
+		return "tunnel"
+	}
+}
+
+func ParseRouteAction(action string) (RouteAction, error) {
+	switch strings.ToLower(action) {
+	case "tunnel":
+		return RouteTunnel, nil
+	case "direct":
+		return RouteDirect, nil
+	case "reject":
+		return RouteReject, nil
+	}
+	return RouteTunnel, fmt.Errorf("`%s` is not one of tunnel, direct or reject", action)
+}
+
+// RouteRule picks the action for the destinations matching all of its conditions.
+// The rule `domain:example.com port:443 direct` sends https traffic to example.com and its subdomains direct.
+type RouteRule struct {
+	Source   string
+	Domain   string
+	Network  *net.IPNet
+	PortFrom int
+	PortTo   int
+	Country  string
+	Action   RouteAction
+}
+
+// ParseRouteRules parses rules made of `domain:`, `cidr:`, `port:` and `country:` conditions followed by the action.
+func ParseRouteRules(rules []string) ([]RouteRule, error) {
+	parsed := make([]RouteRule, 0, len(rules))
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("rule `%s` needs at least one condition and an action", rule)
+		}
+		action, err := ParseRouteAction(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("rule `%s`: %w", rule, err)
+		}
+		parsedRule := RouteRule{Source: rule, Action: action}
+		for _, condition := range fields[:len(fields)-1] {
+			err = parsedRule.addCondition(condition)
+			if err != nil {
+				return nil, fmt.Errorf("rule `%s`: %w", rule, err)
+			}
+		}
+		parsed = append(parsed, parsedRule)
+	}
+	return parsed, nil
+}
+
+func (r *RouteRule) addCondition(condition string) error {
+	kind, value, found := strings.Cut(condition, ":")
+	if !found || value == "" {
+		return fmt.Errorf("`%s` is not a condition like domain:example.com", condition)
+	}
+	switch strings.ToLower(kind) {
+	case "domain":
+		r.Domain = strings.TrimPrefix(strings.ToLower(value), ".")
+	case "cidr":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("`%s` is not a valid CIDR", value)
+		}
+		r.Network = network
+	case "port":
+		from, to, isRange := strings.Cut(value, "-")
+		if !isRange {
+			to = from
+		}
+		var err error
+		r.PortFrom, err = strconv.Atoi(from)
+		if err == nil {
+			r.PortTo, err = strconv.Atoi(to)
+		}
+		if err != nil || r.PortFrom < 1 || r.PortTo > 65535 || r.PortFrom > r.PortTo {
+			return fmt.Errorf("`%s` is not a port or a port range like 8000-8100", value)
+		}
+	case "country":
+		if len(value) != 2 {
+			return fmt.Errorf("`%s` is not a two letter country code like US", value)
+		}
+		r.Country = strings.ToUpper(value)
+	default:
+		return fmt.Errorf("unknown condition `%s`, expected domain, cidr, port or country", kind)
+	}
+	return nil
+}
+
+func (r *RouteRule) needsIP() bool {
+	return r.Network != nil || r.Country != ""
+}
+
+// Destination is where a client wants to connect to. Host is empty when the client asked for an IP.
+type Destination struct {
+	Host string
+	IP   net.IP
+	Port int
+}
+
+func (d Destination) String() string {
+	if d.Host != "" && d.IP != nil {
+		return fmt.Sprintf("%s (%s):%d", d.Host, d.IP, d.Port)
+	}
+	if d.Host != "" {
+		return net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+	}
+	return net.JoinHostPort(d.IP.String(), strconv.Itoa(d.Port))
+}
+
+type routeDecisionKey struct{}
+
+var errRouteRejected = errors.New("connection rejected by the routing rules")
+
+// Router sends every connection through the tunnel, direct or rejects it based on the first matching rule.
+// It implements socks5.RuleSet so that rejected requests get a proper socks reply.
+type Router struct {
+	Rules   []RouteRule
+	Default RouteAction
+	// Tunnel dials through the ssh connection.
+	Tunnel func(network, addr string) (net.Conn, error)
+	// Country returns the country code of an IP. Country rules never match when it's nil.
+	Country func(ip net.IP) (string, error)
+	// Resolve looks up destinations given by name when a cidr or country rule needs their IP.
+	// Such rules never match named destinations when it's nil.
+	Resolve func(ctx context.Context, host string) (net.IP, error)
+}
+
+// Decide returns the action for the destination and the rule which picked it, nil for the default.
+func (r *Router) Decide(ctx context.Context, dest Destination) (RouteAction, *RouteRule) {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.needsIP() && dest.IP == nil && dest.Host != "" && r.Resolve != nil {
+			ip, err := r.Resolve(ctx, dest.Host)
+			if err != nil {
+				log.Debugf("Resolving `%s` for the routing rules failed with error: %s\n", dest.Host, err)
+			}
+			dest.IP = ip
+		}
+		if r.matches(rule, dest) {
+			return rule.Action, rule
+		}
+	}
+	return r.Default, nil
+}
+
+func (r *Router) matches(rule *RouteRule, dest Destination) bool {
+	if rule.Domain != "" {
+		host := strings.ToLower(dest.Host)
+		if host != rule.Domain && !strings.HasSuffix(host, "."+rule.Domain) {
+			return false
+		}
+	}
+	if rule.PortFrom != 0 && (dest.Port < rule.PortFrom || dest.Port > rule.PortTo) {
+		return false
+	}
+	if rule.Network != nil && (dest.IP == nil || !rule.Network.Contains(dest.IP)) {
+		return false
+	}
+	if rule.Country != "" {
+		if dest.IP == nil || r.Country == nil {
+			return false
+		}
+		country, err := r.Country(dest.IP)
+		if err != nil || country != rule.Country {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Router) decideAndLog(ctx context.Context, dest Destination) RouteAction {
+	action, rule := r.Decide(ctx, dest)
+	if rule != nil {
+		log.Debugf("Routing %s: %s (rule `%s`)\n", dest, action, rule.Source)
+	} else {
+		log.Debugf("Routing %s: %s (default)\n", dest, action)
+	}
+	return action
+}
+
+// Allow decides the route of a socks request and remembers it for DialContext.
+func (r *Router) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		// go-socks5 answers the other commands as unsupported itself.
+		return ctx, true
+	}
+	dest := Destination{Host: req.DestAddr.FQDN, IP: req.DestAddr.IP, Port: req.DestAddr.Port}
+	action := r.decideAndLog(ctx, dest)
+	return context.WithValue(ctx, routeDecisionKey{}, action), action != RouteReject
+}
+
+// DialContext dials with the action decided by Allow, or decides it from addr when there is none.
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	action, decided := ctx.Value(routeDecisionKey{}).(RouteAction)
+	if !decided {
+		dest, err := destinationFromAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		action = r.decideAndLog(ctx, dest)
+	}
+	switch action {
+	case RouteReject:
+		return nil, errRouteRejected
+	case RouteDirect:
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		return dialer.DialContext(ctx, network, addr)
+	default:
+		return r.Tunnel(network, addr)
+	}
+}
+
+// Dial is DialContext for callers without a context, e.g. the HTTP proxy.
+func (r *Router) Dial(network, addr string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, addr)
+}
+
+func destinationFromAddr(addr string) (Destination, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Destination{}, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return Destination{}, fmt.Errorf("invalid port in `%s`", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return Destination{IP: ip, Port: port}, nil
+	}
+	return Destination{Host: host, Port: port}, nil
+}
+
+// NewRouter builds the router from the settings. The ip2location DB is only opened when a country rule needs it.
+// Resolve is left to the socksv5 server, which resolves through the tunnel.
+func NewRouter(s *Settings) (*Router, error) {
+	rules, err := ParseRouteRules(s.RoutingRules)
+	if err != nil {
+		return nil, err
+	}
+	router := &Router{Rules: rules}
+	if s.RoutingDefault != "" {
+		router.Default, err = ParseRouteAction(s.RoutingDefault)
+		if err != nil {
+			return nil, err
+		}
+	}
+	gh := &GeoHelper{Settings: s}
+	router.Country = gh.FindCountryCode
+	return router, nil
+}
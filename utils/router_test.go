@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseRouteRules(t *testing.T) {
+	rules, err := ParseRouteRules([]string{
+		"domain:.Example.com port:443 direct",
+		"cidr:10.0.0.0/8 tunnel",
+		"port:8000-8100 reject",
+		"country:de DIRECT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("Expected 4 rules, got %d", len(rules))
+	}
+	if rules[0].Domain != "example.com" || rules[0].PortFrom != 443 || rules[0].PortTo != 443 || rules[0].Action != RouteDirect {
+		t.Errorf("Unexpected domain rule: %+v", rules[0])
+	}
+	if rules[2].PortFrom != 8000 || rules[2].PortTo != 8100 || rules[2].Action != RouteReject {
+		t.Errorf("Unexpected port range rule: %+v", rules[2])
+	}
+	if rules[3].Country != "DE" {
+		t.Errorf("Expected the country code in upper case, got: %s", rules[3].Country)
+	}
+	for _, rule := range []string{"direct", "domain:example.com block", "port:0 direct", "cidr:10.0.0.0 tunnel", "country:USA reject", "host:x direct"} {
+		if _, err := ParseRouteRules([]string{rule}); err == nil {
+			t.Errorf("Expected `%s` to be rejected", rule)
+		}
+	}
+}
+
+func TestRouterDecide(t *testing.T) {
+	rules, err := ParseRouteRules([]string{
+		"port:25 reject",
+		"domain:example.com direct",
+		"cidr:192.168.0.0/16 direct",
+		"country:DE direct",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &Router{
+		Rules:   rules,
+		Default: RouteTunnel,
+		Country: func(ip net.IP) (string, error) {
+			if ip.Equal(net.ParseIP("203.0.113.7")) {
+				return "DE", nil
+			}
+			return "US", nil
+		},
+		Resolve: func(ctx context.Context, host string) (net.IP, error) {
+			if host == "lan.test" {
+				return net.ParseIP("192.168.1.10"), nil
+			}
+			return nil, errors.New("no such host")
+		},
+	}
+	cases := []struct {
+		dest     Destination
+		expected RouteAction
+	}{
+		{Destination{Host: "mail.example.org", Port: 25}, RouteReject},
+		{Destination{Host: "www.example.com", Port: 443}, RouteDirect},
+		{Destination{Host: "example.com", Port: 80}, RouteDirect},
+		{Destination{Host: "notexample.com", Port: 80}, RouteTunnel},
+		{Destination{IP: net.ParseIP("192.168.4.4"), Port: 22}, RouteDirect},
+		{Destination{Host: "lan.test", Port: 22}, RouteDirect},
+		{Destination{IP: net.ParseIP("203.0.113.7"), Port: 443}, RouteDirect},
+		{Destination{IP: net.ParseIP("198.51.100.1"), Port: 443}, RouteTunnel},
+		{Destination{Host: "unknown.test", Port: 443}, RouteTunnel},
+	}
+	for _, c := range cases {
+		action, _ := router.Decide(context.Background(), c.dest)
+		if action != c.expected {
+			t.Errorf("Expected %s for %s, got %s", c.expected, c.dest, action)
+		}
+	}
+}
+
+func TestRouterDialContext(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	tunnelled := 0
+	rules, err := ParseRouteRules([]string{"cidr:127.0.0.0/8 direct", "port:1 reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &Router{
+		Rules: rules,
+		Tunnel: func(network, addr string) (net.Conn, error) {
+			tunnelled++
+			return nil, errors.New("tunnel dialed")
+		},
+	}
+	conn, err := router.Dial("tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if tunnelled != 0 {
+		t.Error("The direct destination went through the tunnel")
+	}
+
+	_, err = router.Dial("tcp", "198.51.100.1:443")
+	if err == nil || tunnelled != 1 {
+		t.Errorf("Expected the default route through the tunnel, got: %v", err)
+	}
+	_, err = router.Dial("tcp", "198.51.100.1:1")
+	if !errors.Is(err, errRouteRejected) {
+		t.Errorf("Expected the connection to be rejected, got: %v", err)
+	}
+}
@@ -1,73 +1,461 @@
 package utils
 
 import (
-	log "github.com/sirupsen/logrus"
+	"errors"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
 )
 
 type Reader interface {
 	Read() *Settings
 }
 
-type ConfigFileData struct{}
+// ConfigFileData reads the settings from a TOML file. An empty Path means ~/.sockv5er/config.toml.
+type ConfigFileData struct {
+	Path string
+}
 type ENVData struct{}
 
+// Settings holds every option of the app. The `toml` tag is the key in the config file
+// and the `env` tag is the environment variable overriding it.
 type Settings struct {
-	AccessKeyId       string
-	SecretKey         string
-	SocksV5Host       string
-	SocksV5Port       string
-	GeoLocationFile   string
-	PrivateKeyPath    string
-	SSHKnownHostsPath string
-	SSHUserName       string
-	SSHPort           string
-	TrackingFilepath  string
+	// Provider is the cloud the instances are created in, aws, lightsail, gcp, digitalocean, hetzner or azure,
+	// local for a container on this machine or static for the existing server at SSHHost.
+	Provider    string `toml:"provider" env:"PROVIDER"`
+	AccessKeyId string `toml:"access_key_id" env:"ACCESS_KEY_ID"`
+	SecretKey   string `toml:"secret_key" env:"SECRET_KEY"`
+	// LightsailSelfDeleteAccessKeyId and LightsailSelfDeleteSecretKey are handed to the Lightsail instance, so that it
+	// can delete itself once the heartbeats stop. They should only allow lightsail:DeleteInstance. Without them an
+	// orphaned instance only powers off.
+	LightsailSelfDeleteAccessKeyId string `toml:"lightsail_self_delete_access_key_id" env:"LIGHTSAIL_SELF_DELETE_ACCESS_KEY_ID"`
+	LightsailSelfDeleteSecretKey   string `toml:"lightsail_self_delete_secret_key" env:"LIGHTSAIL_SELF_DELETE_SECRET_KEY"`
+	// GCPProject defaults to the project of the service account in GCPCredentialsFile.
+	// GCPAccessToken, e.g. from `gcloud auth print-access-token`, is used instead of the service account when set.
+	GCPProject         string `toml:"gcp_project" env:"GCP_PROJECT"`
+	GCPCredentialsFile string `toml:"gcp_credentials_file" env:"GCP_CREDENTIALS_FILE"`
+	GCPAccessToken     string `toml:"gcp_access_token" env:"GCP_ACCESS_TOKEN"`
+	// GCPSelfDeleteServiceAccount is attached to the instance, so that it can delete itself once the heartbeats stop.
+	// Its role should only allow compute.instances.delete. Without it the instance gets no service account and only powers off.
+	GCPSelfDeleteServiceAccount string `toml:"gcp_self_delete_service_account" env:"GCP_SELF_DELETE_SERVICE_ACCOUNT"`
+	DigitalOceanToken           string `toml:"digitalocean_token" env:"DIGITALOCEAN_TOKEN"`
+	// DigitalOceanSelfDestructToken is handed to the droplet, so that it can delete itself once the heartbeats stop.
+	// It should only have the droplet:delete scope. Without it an orphaned droplet only powers off.
+	DigitalOceanSelfDestructToken string `toml:"digitalocean_self_destruct_token" env:"DIGITALOCEAN_SELF_DESTRUCT_TOKEN"`
+	HetznerToken                  string `toml:"hetzner_token" env:"HCLOUD_TOKEN"`
+	AzureSubscriptionId           string `toml:"azure_subscription_id" env:"AZURE_SUBSCRIPTION_ID"`
+	AzureTenantId                 string `toml:"azure_tenant_id" env:"AZURE_TENANT_ID"`
+	AzureClientId                 string `toml:"azure_client_id" env:"AZURE_CLIENT_ID"`
+	AzureClientSecret             string `toml:"azure_client_secret" env:"AZURE_CLIENT_SECRET"`
+	// AzureAccessToken, e.g. from `az account get-access-token`, is used instead of the service principal when set.
+	AzureAccessToken string `toml:"azure_access_token" env:"AZURE_ACCESS_TOKEN"`
+	// ContainerRuntime is docker or podman for the local provider, whichever is installed by default.
+	// ContainerImage has to be Alpine based.
+	ContainerRuntime string `toml:"container_runtime" env:"CONTAINER_RUNTIME"`
+	ContainerImage   string `toml:"container_image" env:"CONTAINER_IMAGE"`
+
+	SocksV5Host string `toml:"socks_v5_host" env:"SOCKS_V5_HOST"`
+	SocksV5Port string `toml:"socks_v5_port" env:"SOCKS_V5_PORT"`
+	// SocksV5Username, SocksV5Password and SocksV5CredentialsFile enable username/password authentication (RFC 1929) on the socksv5 server.
+	SocksV5Username        string `toml:"socks_v5_username" env:"SOCKS_V5_USERNAME"`
+	SocksV5Password        string `toml:"socks_v5_password" env:"SOCKS_V5_PASSWORD"`
+	SocksV5CredentialsFile string `toml:"socks_v5_credentials_file" env:"SOCKS_V5_CREDENTIALS_FILE"`
+	// HTTPProxyPort starts an HTTP proxy on SocksV5Host which shares the tunnel with the socksv5 server.
+	HTTPProxyPort string `toml:"http_proxy_port" env:"HTTP_PROXY_PORT"`
+	// PACPort serves a proxy auto-config file on SocksV5Host. PACRules lists the domains and IPv4 CIDRs sent
+	// through the tunnel, everything else goes direct. Without rules all traffic goes through the tunnel.
+	PACPort  string   `toml:"pac_port" env:"PAC_PORT"`
+	PACRules []string `toml:"pac_rules" env:"PAC_RULES"`
+	// RoutingRules pick tunnel, direct or reject per destination, e.g. `domain:example.com port:443 direct`.
+	// The first matching rule wins, RoutingDefault applies when none matches.
+	RoutingRules   []string `toml:"routing_rules" env:"ROUTING_RULES"`
+	RoutingDefault string   `toml:"routing_default" env:"ROUTING_DEFAULT"`
+	// DNSUpstream is a DNS server (ip:port) queried over TCP through the tunnel. When empty the host names are
+	// passed to the instance and resolved there. Either way nothing is looked up with the local resolvers.
+	DNSUpstream string `toml:"dns_upstream" env:"DNS_UPSTREAM"`
+	// UDPIdleTimeout closes UDP associations without datagrams in either direction for this long.
+	UDPIdleTimeout time.Duration `toml:"udp_idle_timeout" env:"UDP_IDLE_TIMEOUT"`
+
+	GeoLocationFile string `toml:"geo_location_file" env:"GEO_LOCATION_FILE"`
+	// SSHHost and PrivateKeyPath are the existing server and its key for the static provider.
+	SSHHost           string `toml:"ssh_host" env:"SSH_HOST"`
+	PrivateKeyPath    string `toml:"private_key_path" env:"PRIVATE_KEY_PATH"`
+	SSHKnownHostsPath string `toml:"ssh_known_hosts_path" env:"SSH_KNOWN_HOSTS_PATH"`
+	SSHUserName       string `toml:"ssh_username" env:"SSH_USERNAME"`
+	SSHPort           string `toml:"ssh_port" env:"SSH_PORT"`
+	// SSHUpdateKnownHosts adds the pinned host key of the instance to SSHKnownHostsPath while the session runs.
+	SSHUpdateKnownHosts bool `toml:"ssh_update_known_hosts" env:"SSH_UPDATE_KNOWN_HOSTS"`
+	// SSHKeepaliveInterval is how often the tunnel is checked. A dead tunnel is reconnected automatically.
+	SSHKeepaliveInterval time.Duration `toml:"ssh_keepalive_interval" env:"SSH_KEEPALIVE_INTERVAL"`
+
+	TrackingFilepath string `toml:"tracking_filepath" env:"TRACKING_FILEPATH"`
+	// InstanceGracePeriod is how long the instance keeps running after the last heartbeat from sockv5er.
+	InstanceGracePeriod time.Duration `toml:"instance_grace_period" env:"INSTANCE_GRACE_PERIOD"`
+	// ConfigFilepath is the config file the settings were loaded from, if any.
+	ConfigFilepath string `toml:"-"`
+	// LogLevel is one of the logrus levels, e.g. debug to see the routing decisions.
+	LogLevel string `toml:"log_level" env:"LOG_LEVEL"`
+}
+
+// SettingsError is a validation error for a single setting.
+// Line is only set when the value came from the config file.
+type SettingsError struct {
+	Key  string
+	Line int
+	Err  error
+}
+
+func (e *SettingsError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("invalid setting `%s` on line %d: %s", e.Key, e.Line, e.Err)
+	}
+	return fmt.Sprintf("invalid setting `%s`: %s", e.Key, e.Err)
+}
+
+func (e *SettingsError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultSettings returns the values used when neither the config file, the env nor the flags set an option.
+func DefaultSettings() *Settings {
+	settings := &Settings{
+		Provider:             ProviderAWS,
+		SocksV5Host:          "127.0.0.1",
+		GeoLocationFile:      filepath.Join("assets", "IP2LOCATION-LITE-DB1.IPV6.BIN"),
+		SSHPort:              "22",
+		InstanceGracePeriod:  10 * time.Minute,
+		SSHKeepaliveInterval: 15 * time.Second,
+		RoutingDefault:       "tunnel",
+		UDPIdleTimeout:       2 * time.Minute,
+		LogLevel:             "info",
+	}
+	homeDir, err := os.UserHomeDir()
+	if err == nil {
+		settings.SSHKnownHostsPath = filepath.Join(homeDir, ".ssh/known_hosts")
+	}
+	return settings
+}
+
+// DefaultConfigFilepath returns the path of the per user config file, ~/.sockv5er/config.toml.
+func DefaultConfigFilepath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".sockv5er", "config.toml")
+}
+
+// LoadSettings layers the settings in the order defaults, config file, env and flags, then validates the result.
+// When configPath is empty the per user config file is used if it exists.
+func LoadSettings(configPath string, flags *Settings) (*Settings, error) {
+	settings := DefaultSettings()
+	fileData := &ConfigFileData{Path: configPath}
+	if configPath == "" {
+		fileData.Path = DefaultConfigFilepath()
+	}
+	if fileData.Path != "" {
+		err := fileData.apply(settings)
+		if err == nil {
+			settings.ConfigFilepath = fileData.Path
+		} else if !(errors.Is(err, os.ErrNotExist) && configPath == "") {
+			return nil, err
+		}
+	}
+	err := (&ENVData{}).apply(settings)
+	if err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		settings.Merge(flags)
+	}
+	err = settings.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if settings.SSHKnownHostsPath == "" {
+		return nil, &SettingsError{Key: "ssh_known_hosts_path", Err: errors.New("the home directory is unknown, set the path explicitly")}
+	}
+	return settings, nil
+}
+
+// Merge overrides the settings with every non empty value of other.
+func (s *Settings) Merge(other *Settings) {
+	values := reflect.ValueOf(s).Elem()
+	otherValues := reflect.ValueOf(other).Elem()
+	for i := 0; i < values.NumField(); i++ {
+		if !otherValues.Field(i).IsZero() {
+			values.Field(i).Set(otherValues.Field(i))
+		}
+	}
+}
+
+// Validate checks the values which have a fixed format.
+func (s *Settings) Validate() error {
+	values := reflect.ValueOf(s).Elem()
+	for key, index := range settingsFieldsByTag("toml") {
+		err := validateSetting(key, values.Field(index))
+		if err != nil {
+			return &SettingsError{Key: key, Err: err}
+		}
+	}
+	return nil
+}
+
+// validateSetting checks a single value, the config file uses it to report the line of a bad value.
+func validateSetting(key string, field reflect.Value) error {
+	switch {
+	case strings.HasSuffix(key, "_port"):
+		if field.String() != "" {
+			return validatePort(field.String())
+		}
+	case key == "instance_grace_period":
+		if d := time.Duration(field.Int()); d != 0 && d < time.Minute {
+			return errors.New("must be at least 1m")
+		}
+	case key == "pac_rules":
+		_, err := ParsePACRules(field.Interface().([]string))
+		return err
+	case key == "provider":
+		if field.String() != "" {
+			_, err := NewCloudProvider(field.String())
+			return err
+		}
+	case key == "routing_rules":
+		_, err := ParseRouteRules(field.Interface().([]string))
+		return err
+	case key == "routing_default":
+		if field.String() != "" {
+			_, err := ParseRouteAction(field.String())
+			return err
+		}
+	case key == "dns_upstream":
+		if field.String() != "" {
+			return validateDNSUpstream(field.String())
+		}
+	case key == "log_level":
+		if field.String() != "" {
+			_, err := log.ParseLevel(field.String())
+			return err
+		}
+	}
+	return nil
+}
+
+func validateDNSUpstream(upstream string) error {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil || net.ParseIP(host) == nil {
+		return fmt.Errorf("`%s` is not an ip:port address like 1.1.1.1:53", upstream)
+	}
+	return validatePort(port)
+}
+
+func validatePort(port string) error {
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return fmt.Errorf("`%s` is not a port number between 1 and 65535", port)
+	}
+	return nil
 }
 
 func (s *ConfigFileData) Read() *Settings {
-	return &Settings{}
+	settings, err := s.Parse()
+	if err != nil {
+		log.Fatalf("Reading the config file failed with error: %s\n", err)
+	}
+	return settings
+}
+
+// Parse reads the config file and returns only the values set in it.
+func (s *ConfigFileData) Parse() (*Settings, error) {
+	settings := &Settings{}
+	err := s.apply(settings)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// apply overrides the settings with the values set in the config file.
+func (s *ConfigFileData) apply(settings *Settings) error {
+	path := s.Path
+	if path == "" {
+		path = DefaultConfigFilepath()
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	_, err = toml.Decode(string(content), &values)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			return &SettingsError{Key: parseErr.LastKey, Line: parseErr.Position.Line, Err: errors.New(parseErr.Message)}
+		}
+		return err
+	}
+	fields := settingsFieldsByTag("toml")
+	for key, value := range values {
+		line := findKeyLine(content, key)
+		index, ok := fields[key]
+		if !ok {
+			return &SettingsError{Key: key, Line: line, Err: errors.New("unknown key")}
+		}
+		err = setSettingsField(reflect.ValueOf(settings).Elem().Field(index), value)
+		if err == nil {
+			expandPathSetting(key, reflect.ValueOf(settings).Elem().Field(index))
+			err = validateSetting(key, reflect.ValueOf(settings).Elem().Field(index))
+		}
+		if err != nil {
+			return &SettingsError{Key: key, Line: line, Err: err}
+		}
+	}
+	return nil
 }
 
+// Read returns only the settings present in the environment.
 func (s *ENVData) Read() *Settings {
-	accessKeyId := os.Getenv("ACCESS_KEY_ID")
-	secretKey := os.Getenv("SECRET_KEY")
-	socksV5Host := os.Getenv("SOCKS_V5_HOST")
-	if socksV5Host == "" {
-		socksV5Host = "127.0.0.1"
-	}
-	socksV5Port := os.Getenv("SOCKS_V5_PORT")
-	geoLocationFile := os.Getenv("GEO_LOCATION_FILE")
-	privateKeyPath := os.Getenv("PRIVATE_KEY_PATH")
-	sshKnownHostsPath := os.Getenv("SSH_KNOWN_HOSTS_PATH")
-	if geoLocationFile == "" {
-		geoLocationFile = filepath.Join("assets", "IP2LOCATION-LITE-DB1.IPV6.BIN")
-	}
-	sshUsername := os.Getenv("SSH_USERNAME")
-	if sshUsername == "" {
-		sshUsername = "ec2-user"
-	}
-	if sshKnownHostsPath == "" {
-		homeDir, err := os.UserHomeDir()
+	settings := &Settings{}
+	err := s.apply(settings)
+	if err != nil {
+		log.Fatalf("Reading the settings from the env failed with error: %s\n", err)
+	}
+	return settings
+}
+
+// apply overrides the settings with the non empty env variables.
+func (s *ENVData) apply(settings *Settings) error {
+	values := reflect.ValueOf(settings).Elem()
+	for name, index := range settingsFieldsByTag("env") {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		err := setSettingsField(values.Field(index), value)
 		if err != nil {
-			log.Fatalf("Getting users home directory failed with error: %s. Please set the SSH known hosts file path in the environment to continue.\n", err)
+			return &SettingsError{Key: name, Err: err}
+		}
+		expandPathSetting(values.Type().Field(index).Tag.Get("toml"), values.Field(index))
+	}
+	return nil
+}
+
+// setSettingsField converts a value from the config file or the env to the type of the field.
+func setSettingsField(field reflect.Value, value interface{}) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		switch v := value.(type) {
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("`%s` is not a duration like 10m or 1h30m", v)
+			}
+			field.SetInt(int64(d))
+		case int64:
+			field.SetInt(int64(time.Duration(v) * time.Second))
+		default:
+			return fmt.Errorf("expected a duration, got %T", value)
+		}
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		switch v := value.(type) {
+		case string:
+			field.SetString(v)
+		case int64:
+			field.SetString(strconv.FormatInt(v, 10))
+		default:
+			return fmt.Errorf("expected a string, got %T", value)
+		}
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", field.Type())
+		}
+		var items []string
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				itemString, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("expected a list of strings, got an item of type %T", item)
+				}
+				items = append(items, itemString)
+			}
+		case string:
+			// Lists in env variables are comma separated.
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		default:
+			return fmt.Errorf("expected a list of strings, got %T", value)
 		}
-		sshKnownHostsPath = filepath.Join(homeDir, ".ssh/known_hosts")
+		field.Set(reflect.ValueOf(items))
+	case reflect.Bool:
+		switch v := value.(type) {
+		case bool:
+			field.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("`%s` is not a boolean", v)
+			}
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("expected a boolean, got %T", value)
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Kind())
 	}
-	sshPort := os.Getenv("SSH_PORT")
-	if sshPort == "" {
-		sshPort = "22"
+	return nil
+}
+
+func settingsFieldsByTag(tag string) map[string]int {
+	types := reflect.TypeOf(Settings{})
+	fields := make(map[string]int)
+	for i := 0; i < types.NumField(); i++ {
+		if name := types.Field(i).Tag.Get(tag); name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+func findKeyLine(content []byte, key string) int {
+	pattern := regexp.MustCompile(`^\s*"?` + regexp.QuoteMeta(key) + `"?\s*=`)
+	for i, line := range strings.Split(string(content), "\n") {
+		if pattern.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// expandPathSetting expands a leading ~ in the settings which are paths, the ones whose key ends in _file, _path
+// or _filepath. Tokens and passwords are taken as they are.
+func expandPathSetting(key string, field reflect.Value) {
+	if strings.HasSuffix(key, "_file") || strings.HasSuffix(key, "_path") || strings.HasSuffix(key, "_filepath") {
+		field.SetString(expandHomeDir(field.String()))
+	}
+}
+
+func expandHomeDir(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
 	}
-	return &Settings{
-		AccessKeyId:       accessKeyId,
-		SecretKey:         secretKey,
-		SocksV5Host:       socksV5Host,
-		SocksV5Port:       socksV5Port,
-		GeoLocationFile:   geoLocationFile,
-		PrivateKeyPath:    privateKeyPath,
-		SSHKnownHostsPath: sshKnownHostsPath,
-		SSHUserName:       sshUsername,
-		SSHPort:           sshPort,
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
 	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~"))
 }
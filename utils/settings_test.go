@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -25,11 +27,97 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestConfigFileRead(t *testing.T) {
+	path := writeConfigFile(t, "socks_v5_port = 1080\nssh_username = \"admin\"\n")
+	settings, err := (&ConfigFileData{Path: path}).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.SocksV5Port != "1080" || settings.SSHUserName != "admin" {
+		t.Error("Unexpected values from the config file")
+	}
+	if settings.SocksV5Host != "" {
+		t.Error("Settings missing from the config file should stay empty")
+	}
+}
+
+func TestConfigFileUnknownKey(t *testing.T) {
+	path := writeConfigFile(t, "# sockv5er\nsocks_v5_port = 1080\nsock_v5_host = \"0.0.0.0\"\n")
+	_, err := (&ConfigFileData{Path: path}).Parse()
+	var settingsErr *SettingsError
+	if !errors.As(err, &settingsErr) || settingsErr.Key != "sock_v5_host" || settingsErr.Line != 3 {
+		t.Errorf("Unexpected error for an unknown key: %v", err)
+	}
+}
+
+func TestConfigFileInvalidPort(t *testing.T) {
+	path := writeConfigFile(t, "ssh_port = 70000\n")
+	_, err := (&ConfigFileData{Path: path}).Parse()
+	var settingsErr *SettingsError
+	if !errors.As(err, &settingsErr) || settingsErr.Key != "ssh_port" || settingsErr.Line != 1 {
+		t.Errorf("Unexpected error for an invalid port: %v", err)
+	}
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "socks_v5_port = 1080\nsocks_v5_host = \"0.0.0.0\"\nssh_username = \"admin\"\n")
+	clearAllENVs(t)
+	t.Setenv("SOCKS_V5_PORT", "1337")
+	settings, err := LoadSettings(path, &Settings{SocksV5Host: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.SSHUserName != "admin" {
+		t.Error("The config file should override the defaults")
+	}
+	if settings.SocksV5Port != "1337" {
+		t.Error("The env should override the config file")
+	}
+	if settings.SocksV5Host != "10.0.0.1" {
+		t.Error("The flags should override the config file")
+	}
+	if settings.SSHPort != "22" {
+		t.Error("The defaults should be used for settings set nowhere else")
+	}
+}
+
+func TestLoadSettingsExpandsOnlyPaths(t *testing.T) {
+	path := writeConfigFile(t, "private_key_path = \"~/.ssh/id_ed25519\"\nsocks_v5_password = \"~/secret\"\n")
+	clearAllENVs(t)
+	t.Setenv("HOME", "/home/sockv5er")
+	t.Setenv("HCLOUD_TOKEN", "~/token")
+	settings, err := LoadSettings(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("/home/sockv5er", ".ssh/id_ed25519"); settings.PrivateKeyPath != want {
+		t.Errorf("Expected the path %s, got: %s", want, settings.PrivateKeyPath)
+	}
+	if settings.SocksV5Password != "~/secret" || settings.HetznerToken != "~/token" {
+		t.Errorf("Expected the password and the token unchanged, got: %s, %s", settings.SocksV5Password, settings.HetznerToken)
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func clearAllENVs(t *testing.T) {
+	for name := range settingsFieldsByTag("env") {
+		t.Setenv(name, "")
+	}
+}
+
 func setAllENVs(settings *Settings) {
 	values := reflect.ValueOf(*settings)
 	types := reflect.TypeOf(*settings)
 	for i := 0; i < values.NumField(); i++ {
-		key := fmt.Sprintf("%v", types.Field(i).Name)
+		key := types.Field(i).Tag.Get("env")
 		value := fmt.Sprintf("%v", values.Field(i).Interface())
 		_ = os.Setenv(key, value)
 	}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// LoadSocksV5Credentials returns the users allowed on the socksv5 server, or nil when authentication is disabled.
+// Users come from the username/password settings and from the credentials file, one `username:password` per line.
+func LoadSocksV5Credentials(s *Settings) (socks5.StaticCredentials, error) {
+	credentials := socks5.StaticCredentials{}
+	if s.SocksV5Username != "" || s.SocksV5Password != "" {
+		if s.SocksV5Username == "" || s.SocksV5Password == "" {
+			return nil, &SettingsError{Key: "socks_v5_username", Err: errors.New("the username and the password have to be set together")}
+		}
+		credentials[s.SocksV5Username] = s.SocksV5Password
+	}
+	if s.SocksV5CredentialsFile != "" {
+		err := readCredentialsFile(s.SocksV5CredentialsFile, credentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(credentials) == 0 {
+		return nil, nil
+	}
+	return credentials, nil
+}
+
+func readCredentialsFile(path string, credentials socks5.StaticCredentials) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, found := strings.Cut(line, ":")
+		// RFC 1929 limits both fields to 255 bytes.
+		if !found || username == "" || password == "" || len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("%s:%d: expected `username:password`", path, lineNumber)
+		}
+		credentials[username] = password
+	}
+	return scanner.Err()
+}
+
+// isLoopbackHost tells whether only local processes can reach a listener on host.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
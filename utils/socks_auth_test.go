@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSocksV5CredentialsDisabled(t *testing.T) {
+	credentials, err := LoadSocksV5Credentials(&Settings{})
+	if err != nil || credentials != nil {
+		t.Error("Authentication should be disabled without credentials")
+	}
+}
+
+func TestLoadSocksV5CredentialsFromSettingsAndFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks-users")
+	err := os.WriteFile(path, []byte("# users\nalice:wonderland\n\nbob:builder\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := LoadSocksV5Credentials(&Settings{
+		SocksV5Username:        "admin",
+		SocksV5Password:        "secret",
+		SocksV5CredentialsFile: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !credentials.Valid("admin", "secret") || !credentials.Valid("alice", "wonderland") || !credentials.Valid("bob", "builder") {
+		t.Error("Expected users are missing from the credentials")
+	}
+	if credentials.Valid("alice", "secret") {
+		t.Error("A wrong password was accepted")
+	}
+}
+
+func TestLoadSocksV5CredentialsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks-users")
+	err := os.WriteFile(path, []byte("alice\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadSocksV5Credentials(&Settings{SocksV5CredentialsFile: path})
+	if err == nil {
+		t.Error("A line without a password should be rejected")
+	}
+}
+
+func TestLoadSocksV5CredentialsRequiresPassword(t *testing.T) {
+	_, err := LoadSocksV5Credentials(&Settings{SocksV5Username: "admin"})
+	if err == nil {
+		t.Error("A username without a password should be rejected")
+	}
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"127.0.0.1":   true,
+		"::1":         true,
+		"localhost":   true,
+		"0.0.0.0":     false,
+		"192.168.1.5": false,
+	} {
+		if got := isLoopbackHost(host); got != want {
+			t.Errorf("isLoopbackHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -2,13 +2,16 @@ package utils
 
 import (
 	"bytes"
-	"context"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	stdlog "log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/armon/go-socks5"
 	"golang.org/x/crypto/ssh"
@@ -22,84 +25,217 @@ type SSHConfig struct {
 	SSHUsername        string
 	SocksV5IP          string
 	SocksV5Port        string
+	// HostPublicKey is the host key injected into the instance. It is pinned for the session when set.
+	HostPublicKey ssh.PublicKey
+	// UpdateKnownHosts adds the pinned host key to the known hosts file for the lifetime of the session.
+	UpdateKnownHosts bool
+	// HeartbeatInterval is how often the instance's shutdown deadline is pushed forward. Zero disables the heartbeat.
+	HeartbeatInterval time.Duration
+	// ShutdownOnCleanup shuts the instance down when the server stops. Only set it for instances sockv5er created.
+	ShutdownOnCleanup bool
+	// HTTPProxyPort starts an HTTP proxy on SocksV5IP next to the socksv5 server when set.
+	HTTPProxyPort string
+	// PACPort serves a PAC file for the socksv5 server on SocksV5IP when set. The PAC rules are reloaded
+	// whenever ConfigFilepath changes.
+	PACPort        string
+	PACRules       []PACRule
+	ConfigFilepath string
+	// Credentials enables username/password authentication on the socksv5 server when set.
+	Credentials socks5.CredentialStore
+	// KeepaliveInterval is how often the ssh connection is checked. Zero only notices connections closed by the network.
+	KeepaliveInterval time.Duration
+	// Router picks tunnel, direct or reject per destination. Without it everything goes through the tunnel.
+	Router *Router
+	// DNSUpstream resolves the host names with DNS over TCP through the tunnel when set.
+	// Otherwise the names are passed to the instance, which resolves them itself.
+	DNSUpstream string
+	// UDPIdleTimeout closes the UDP associations without datagrams for this long. Zero keeps them until the client disconnects.
+	UDPIdleTimeout time.Duration
 }
 
-func (config *SSHConfig) StartSocksV5Server() {
+func (config *SSHConfig) StartSocksV5Server() error {
 	// References:
 	// 1. https://gist.github.com/afdalwahyu/4c70868c84e68676c86e1a54b410655d
 	// 2. https://pkg.go.dev/golang.org/x/crypto/ssh#PublicKeys
 	// 3. https://stackoverflow.com/questions/45441735/ssh-handshake-complains-about-missing-host-key
-	sshConn, err := config.connectToSSH()
+	sshConn, err := NewSupervisedClient(config.connectToSSH, config.KeepaliveInterval)
 	if err != nil {
-		log.Fatalf("SSH Connection failed with error: %s\n", err)
+		return fmt.Errorf("SSH connection failed: %w", err)
 	}
-	defer func(sshConn *ssh.Client) {
+	defer func(sshConn *SupervisedClient) {
+		log.Infof("The ssh connection was re-established %d times during the session.\n", sshConn.Reconnects())
 		err := sshConn.Close()
 		if err != nil {
 			log.Warnf("Error occurred when trying to close the SSH Connection. Error: %s\n", err)
 		}
 	}(sshConn)
 	log.Infoln("Connected to ssh server")
-	ch := make(chan os.Signal)
+	if config.UpdateKnownHosts && config.HostPublicKey != nil {
+		err = AddKnownHost(config.KnownHostsFilepath, config.SSHHost, config.SSHPort, config.HostPublicKey)
+		if err != nil {
+			log.Warnf("Adding the host key to `%s` failed with error: %s\n", config.KnownHostsFilepath, err)
+		} else {
+			defer config.removeKnownHost()
+		}
+	}
 
+	if config.HeartbeatInterval > 0 {
+		stopHeartbeat := make(chan struct{})
+		defer close(stopHeartbeat)
+		go keepInstanceAlive(sshConn.Client, config.HeartbeatInterval, stopHeartbeat)
+	}
+
+	udp := &UDPAssociator{Tunnel: sshConn.Dial, RelayAddr: udpRelayAddress, IdleTimeout: config.UDPIdleTimeout}
+	conf, router := config.socksV5Config(sshConn.Dial, udp)
+	if config.Credentials == nil && !isLoopbackHost(config.SocksV5IP) {
+		log.Warnf("!!! The proxy listens on `%s` without authentication. Anyone who can reach it can use your cloud egress. "+
+			"Set socks_v5_username and socks_v5_password or socks_v5_credentials_file. !!!\n", config.SocksV5IP)
+	}
+	serverSocks, err := socks5.New(conf)
+	if err != nil {
+		return err
+	}
+	socksV5Address := fmt.Sprintf("%s:%s", config.SocksV5IP, config.SocksV5Port)
+	listener, err := net.Listen("tcp", socksV5Address)
+	if err != nil {
+		return fmt.Errorf("failed to create socks5 server: %w", err)
+	}
+	defer listener.Close()
 	go func() {
-		conf := &socks5.Config{
-			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return sshConn.Dial(network, addr)
-			},
+		if err := serverSocks.Serve(udp.Listen(listener)); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Errorf("SocksV5 server stopped with error: %s\n", err)
 		}
-		serverSocks, err := socks5.New(conf)
+	}()
+	log.Infoln("Started SocksV5 server.")
+	if config.HTTPProxyPort != "" {
+		httpServer, err := config.startHTTPProxy(router.Dial)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
-		socksV5Address := fmt.Sprintf("%s:%s", config.SocksV5IP, config.SocksV5Port)
-		if err := serverSocks.ListenAndServe("tcp", socksV5Address); err != nil {
-			log.Fatalf("Failed to create socks5 server %s\n", err)
+		defer httpServer.Close()
+	}
+	if config.PACPort != "" {
+		pac := NewPACServer(config.SocksV5IP, config.SocksV5Port, config.PACRules)
+		pacServer, err := startPACServer(pac, config.SocksV5IP, config.PACPort)
+		if err != nil {
+			return err
 		}
-	}()
-	log.Infoln("Started SocksV5 server.")
-	log.Infoln("Press CTRL+C to stop SocksV5 server and exit!")
-
-	go func(ch chan os.Signal) {
-		exitSignal := <-ch
-		if exitSignal == syscall.SIGINT || exitSignal == syscall.SIGTERM {
-			config.cleanup()
-			os.Exit(0)
+		defer pacServer.Close()
+		if config.ConfigFilepath != "" {
+			stopWatching := make(chan struct{})
+			defer close(stopWatching)
+			go watchPACRules(pac, config.ConfigFilepath, 2*time.Second, stopWatching)
 		}
-	}(ch)
+	}
+	log.Infoln("Press CTRL+C to stop SocksV5 server and exit!")
 
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(ch)
 	<-ch
-	return
+	config.cleanup()
+	return nil
+}
+
+// socksV5Config routes the socksv5 connections through tunnel. Host names are never resolved locally:
+// they are either sent to the instance as they are or looked up through the tunnel at DNSUpstream.
+// The associate requests are served by udp when it's set, its Listen has to wrap the listener then.
+func (config *SSHConfig) socksV5Config(tunnel func(network, addr string) (net.Conn, error), udp *UDPAssociator) (*socks5.Config, *Router) {
+	router := config.Router
+	if router == nil {
+		router = &Router{}
+	}
+	router.Tunnel = tunnel
+	upstream := config.DNSUpstream
+	if upstream == "" {
+		upstream = defaultDNSUpstream
+	}
+	tunnelResolver := NewTunnelResolver(upstream, tunnel)
+	if router.Resolve == nil {
+		router.Resolve = tunnelResolver.LookupIP
+	}
+	conf := &socks5.Config{
+		Dial:     router.DialContext,
+		Rules:    router,
+		Resolver: remoteResolver{},
+	}
+	if config.DNSUpstream != "" {
+		conf.Resolver = tunnelResolver
+	}
+	if udp != nil {
+		udp.Route = router.decideAndLog
+		conf.Rules = udp.Rules(router)
+	}
+	if config.Credentials != nil {
+		conf.Credentials = config.Credentials
+	}
+	// go-socks5 logs every failed client connection, which is only interesting when debugging.
+	conf.Logger = stdlog.New(log.StandardLogger().WriterLevel(log.DebugLevel), "", 0)
+	return conf, router
+}
+
+// startHTTPProxy starts the HTTP proxy next to the socksv5 server, sharing its tunnel and credentials.
+func (config *SSHConfig) startHTTPProxy(dial func(network, addr string) (net.Conn, error)) (*http.Server, error) {
+	httpProxyAddress := net.JoinHostPort(config.SocksV5IP, config.HTTPProxyPort)
+	listener, err := net.Listen("tcp", httpProxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the http proxy: %w", err)
+	}
+	server := &http.Server{
+		Handler:           &HTTPProxy{Dial: dial, Credentials: config.Credentials},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("HTTP proxy stopped with error: %s\n", err)
+		}
+	}()
+	log.Infof("Started HTTP proxy on `%s`.\n", httpProxyAddress)
+	return server, nil
 }
 
 func (config *SSHConfig) cleanup() {
 	log.Infoln("Stopping SocksV5 Server")
+	if !config.ShutdownOnCleanup {
+		log.Infoln("Exiting...")
+		return
+	}
 	log.Infoln("Terminating EC2 Instance.")
 	session, err := config.GetNewSSHSession()
-	log.Warnf("Cleaning up resources fauled with err: %s", err)
-	defer func(session *ssh.Session) {
-		err := session.Close()
-		if err != nil {
-
-		}
-	}(session)
-	commandsToExecute := []string{"sudo shutdown now", ""}
+	if err != nil {
+		log.Warnf("Cleaning up resources failed with err: %s", err)
+		return
+	}
+	commandsToExecute := []string{"sudo shutdown now"}
 	config.IssueCommandsViaSSH(session, commandsToExecute)
 	log.Infoln("All clean up done without any errors.")
 	log.Infoln("Exiting...")
 }
 
+func (config *SSHConfig) removeKnownHost() {
+	err := RemoveKnownHost(config.KnownHostsFilepath, config.SSHHost, config.SSHPort, config.HostPublicKey)
+	if err != nil {
+		log.Warnf("Removing the host key from `%s` failed with error: %s\n", config.KnownHostsFilepath, err)
+	}
+}
+
 func (config *SSHConfig) connectToSSH() (*ssh.Client, error) {
 	signer, err := ssh.ParsePrivateKey(config.PrivateKey)
 	if err != nil {
-		log.Fatalf("Unable to parse private key: %v\n", err)
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+	callback, err := hostKeyCallback(config.HostPublicKey, config.KnownHostsFilepath)
+	if err != nil {
+		return nil, err
 	}
 	sshConf := &ssh.ClientConfig{
 		User:            config.SSHUsername,
 		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: callback,
+	}
+	if config.HostPublicKey != nil {
+		// Only ask for the pinned key type, otherwise the server may offer one of its own keys.
+		sshConf.HostKeyAlgorithms = []string{config.HostPublicKey.Type()}
 	}
 	hostWithPort := fmt.Sprintf("%s:%s", config.SSHHost, config.SSHPort)
 	sshConn, err := ssh.Dial("tcp", hostWithPort, sshConf)
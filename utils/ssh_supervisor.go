@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+var errSupervisorClosed = errors.New("ssh supervisor is closed")
+
+// SupervisedClient keeps an SSH connection alive. It sends keepalive requests, notices when the
+// connection dies and reconnects with an exponential backoff. Callers always dial through the
+// current connection, so the SOCKS server keeps its listener while the connection is swapped.
+type SupervisedClient struct {
+	dial              func() (*ssh.Client, error)
+	keepaliveInterval time.Duration
+	minBackoff        time.Duration
+	maxBackoff        time.Duration
+
+	mu         sync.RWMutex
+	client     *ssh.Client
+	reconnects uint64
+	broken     chan struct{}
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewSupervisedClient dials the first connection and starts supervising it.
+// A keepaliveInterval of zero only detects connections closed by the transport.
+func NewSupervisedClient(dial func() (*ssh.Client, error), keepaliveInterval time.Duration) (*SupervisedClient, error) {
+	sc := &SupervisedClient{
+		dial:              dial,
+		keepaliveInterval: keepaliveInterval,
+		minBackoff:        time.Second,
+		maxBackoff:        time.Minute,
+	}
+	err := sc.start()
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (sc *SupervisedClient) start() error {
+	client, err := sc.dial()
+	if err != nil {
+		return err
+	}
+	sc.client = client
+	sc.broken = make(chan struct{}, 1)
+	sc.closed = make(chan struct{})
+	go sc.supervise()
+	return nil
+}
+
+// Client returns the current connection.
+func (sc *SupervisedClient) Client() *ssh.Client {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.client
+}
+
+// Reconnects returns how many times the connection has been replaced.
+func (sc *SupervisedClient) Reconnects() uint64 {
+	return atomic.LoadUint64(&sc.reconnects)
+}
+
+// Dial opens a connection to addr from the remote host. A failed dial triggers an immediate
+// health check, so a dead connection is replaced without waiting for the next keepalive.
+func (sc *SupervisedClient) Dial(network, addr string) (net.Conn, error) {
+	select {
+	case <-sc.closed:
+		return nil, errSupervisorClosed
+	default:
+	}
+	conn, err := sc.Client().Dial(network, addr)
+	if err != nil {
+		sc.markBroken()
+	}
+	return conn, err
+}
+
+func (sc *SupervisedClient) Close() error {
+	var err error
+	sc.closeOnce.Do(func() {
+		close(sc.closed)
+		err = sc.Client().Close()
+	})
+	return err
+}
+
+func (sc *SupervisedClient) markBroken() {
+	select {
+	case sc.broken <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *SupervisedClient) supervise() {
+	for {
+		client := sc.Client()
+		died := make(chan struct{})
+		go func() {
+			_ = client.Wait()
+			close(died)
+		}()
+		var keepalive <-chan time.Time
+		var ticker *time.Ticker
+		if sc.keepaliveInterval > 0 {
+			ticker = time.NewTicker(sc.keepaliveInterval)
+			keepalive = ticker.C
+		}
+	healthy:
+		for {
+			select {
+			case <-sc.closed:
+				if ticker != nil {
+					ticker.Stop()
+				}
+				return
+			case <-died:
+				log.Warnln("SSH connection closed.")
+				break healthy
+			case <-keepalive:
+				if err := sc.sendKeepalive(client); err != nil {
+					log.Warnf("SSH keepalive failed with error: %s\n", err)
+					break healthy
+				}
+			case <-sc.broken:
+				if err := sc.sendKeepalive(client); err != nil {
+					log.Warnf("SSH health check failed with error: %s\n", err)
+					break healthy
+				}
+			}
+		}
+		if ticker != nil {
+			ticker.Stop()
+		}
+		_ = client.Close()
+		if !sc.reconnect() {
+			return
+		}
+	}
+}
+
+// sendKeepalive sends the same global request as OpenSSH's ServerAliveInterval and waits at most one interval for the reply.
+func (sc *SupervisedClient) sendKeepalive(client *ssh.Client) error {
+	timeout := sc.keepaliveInterval
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errors.New("no reply to the keepalive request")
+	}
+}
+
+// reconnect dials until it succeeds or the client is closed. It returns false once closed.
+func (sc *SupervisedClient) reconnect() bool {
+	backoff := sc.minBackoff
+	for attempt := 1; ; attempt++ {
+		log.Infof("Reconnecting to the ssh server, attempt %d.\n", attempt)
+		client, err := sc.dial()
+		if err == nil {
+			sc.mu.Lock()
+			sc.client = client
+			sc.mu.Unlock()
+			count := atomic.AddUint64(&sc.reconnects, 1)
+			log.Infof("Reconnected to the ssh server. Reconnects so far: %d.\n", count)
+			select {
+			case <-sc.closed:
+				// Close ran while dialing and closed the previous client, so close this one too.
+				_ = client.Close()
+				return false
+			default:
+			}
+			// Drop health checks requested for the previous connection.
+			select {
+			case <-sc.broken:
+			default:
+			}
+			return true
+		}
+		log.Warnf("Reconnecting to the ssh server failed with error: %s. Retrying in %s.\n", err, backoff)
+		select {
+		case <-sc.closed:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > sc.maxBackoff {
+			backoff = sc.maxBackoff
+		}
+	}
+}
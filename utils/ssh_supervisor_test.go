@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer is a minimal in-process ssh server which answers keepalives,
+// runs every command successfully and forwards direct-tcpip channels.
+type testSSHServer struct {
+	listener   net.Listener
+	hostKey    *HostKey
+	clientKey  []byte
+	mu         sync.Mutex
+	conns      []net.Conn
+	commands   []string
+	dialedAddr []string
+	// hosts are the names only the server can resolve, like a remote DNS.
+	hosts map[string]string
+}
+
+func startTestSSHServer(t *testing.T) *testSSHServer {
+	hostKey, err := GenerateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.ParsePrivateKey(hostKey.PrivateKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPublicKey, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientPublicKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSSHServer{
+		listener:  listener,
+		hostKey:   hostKey,
+		clientKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		server.dropConnections()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.mu.Unlock()
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *testSSHServer) sshConfig() *SSHConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return &SSHConfig{
+		PrivateKey:    s.clientKey,
+		SSHHost:       host,
+		SSHPort:       port,
+		SSHUsername:   "sockv5er",
+		HostPublicKey: s.hostKey.PublicKey,
+	}
+}
+
+func (s *testSSHServer) addHost(name string, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = map[string]string{}
+	}
+	s.hosts[name] = ip
+}
+
+func (s *testSSHServer) dialed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.dialedAddr...)
+}
+
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go func() {
+		for request := range requests {
+			if request.WantReply {
+				_ = request.Reply(request.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			go s.forward(newChannel)
+		case "session":
+			go s.session(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *testSSHServer) forward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	err := ssh.Unmarshal(newChannel.ExtraData(), &payload)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	s.mu.Lock()
+	s.dialedAddr = append(s.dialedAddr, addr)
+	host, resolved := s.hosts[payload.Host]
+	s.mu.Unlock()
+	if resolved {
+		addr = net.JoinHostPort(host, strconv.Itoa(int(payload.Port)))
+	}
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(target, channel)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(channel, target)
+	_ = channel.Close()
+}
+
+func (s *testSSHServer) session(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			_ = request.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		_ = ssh.Unmarshal(request.Payload, &payload)
+		s.mu.Lock()
+		s.commands = append(s.commands, payload.Command)
+		s.mu.Unlock()
+		_ = request.Reply(true, nil)
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
+
+// startEchoServer returns the address of a local tcp server which echoes what it receives.
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || string(reply) != "ping" {
+		t.Fatalf("Unexpected reply through the tunnel: %q %v", reply, err)
+	}
+}
+
+func TestSupervisedClientReconnects(t *testing.T) {
+	server := startTestSSHServer(t)
+	echoAddr := startEchoServer(t)
+	sc := &SupervisedClient{
+		dial:              server.sshConfig().connectToSSH,
+		keepaliveInterval: 100 * time.Millisecond,
+		minBackoff:        10 * time.Millisecond,
+		maxBackoff:        50 * time.Millisecond,
+	}
+	err := sc.start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	conn, err := sc.Dial("tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+
+	server.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for sc.Reconnects() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The supervised client didn't reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err = sc.Dial("tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+}
+
+func TestSupervisedClientClose(t *testing.T) {
+	server := startTestSSHServer(t)
+	sc, err := NewSupervisedClient(server.sshConfig().connectToSSH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sc.Dial("tcp", "127.0.0.1:1")
+	if err != errSupervisorClosed {
+		t.Errorf("Dialing through a closed client should fail with errSupervisorClosed, got: %v", err)
+	}
+}
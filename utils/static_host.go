@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// StaticHostProvider connects to an existing ssh server, e.g. a VPS or a bastion, instead of creating one.
+// Nothing is created, so nothing is tracked or deleted, and the host is never shut down.
+type StaticHostProvider struct {
+	Host       string
+	Port       string
+	Username   string
+	PrivateKey []byte
+}
+
+func NewStaticHostProvider() CloudProvider {
+	return &StaticHostProvider{}
+}
+
+// Initialize reads ssh_host, ssh_port, ssh_username and the key in private_key_path. The host key is
+// verified with ssh_known_hosts_path, so the host has to be in it already.
+func (p *StaticHostProvider) Initialize(ctx context.Context, s *Settings) error {
+	if s.SSHHost == "" || s.SSHUserName == "" || s.PrivateKeyPath == "" {
+		return errors.New("set ssh_host, ssh_username and private_key_path to use an existing ssh server")
+	}
+	privateKey, err := os.ReadFile(s.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	_, err = ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("`%s` is not a private key without a passphrase: %w", s.PrivateKeyPath, err)
+	}
+	p.Host = s.SSHHost
+	p.Port = s.SSHPort
+	p.Username = s.SSHUserName
+	p.PrivateKey = privateKey
+	return nil
+}
+
+// GetRegions returns the host as the only region.
+func (p *StaticHostProvider) GetRegions(ctx context.Context, s *Settings) []Region {
+	return []Region{{ID: p.Host, Country: "Existing server"}}
+}
+
+func (p *StaticHostProvider) CreateResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	log.Infof("Using the existing ssh server `%s`.\n", p.Host)
+	return nil
+}
+
+func (p *StaticHostProvider) DeleteResources(ctx context.Context, region string, s *Settings, tracker *ResourceTracker) error {
+	return nil
+}
+
+func (p *StaticHostProvider) PrepareResourcesForDeletion(resource TrackedResource) {}
+
+func (p *StaticHostProvider) GetHostIP() string {
+	return p.Host
+}
+
+func (p *StaticHostProvider) GetSSHPort() string {
+	return p.Port
+}
+
+func (p *StaticHostProvider) GetPrivateKey() []byte {
+	return p.PrivateKey
+}
+
+// GetHostPublicKey is nil, the host is verified with the known hosts file.
+func (p *StaticHostProvider) GetHostPublicKey() ssh.PublicKey {
+	return nil
+}
+
+func (p *StaticHostProvider) GetSSHUsername() string {
+	return p.Username
+}
+
+func (p *StaticHostProvider) OwnsHost() bool {
+	return false
+}
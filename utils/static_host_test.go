@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticHostProvider(t *testing.T) {
+	server := startTestSSHServer(t)
+	keyPath := filepath.Join(t.TempDir(), "id_ecdsa")
+	err := os.WriteFile(keyPath, server.clientKey, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewStaticHostProvider()
+	err = repo.Initialize(context.Background(), &Settings{SSHHost: "vps.example.com", SSHPort: "2222", SSHUserName: "me"})
+	if err == nil {
+		t.Error("Expected an error without private_key_path")
+	}
+	err = repo.Initialize(context.Background(), &Settings{SSHHost: "vps.example.com", SSHPort: "2222", SSHUserName: "me", PrivateKeyPath: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml"))
+	err = repo.CreateResources(context.Background(), "", &Settings{}, tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracker.TrackedResources()) != 0 {
+		t.Error("Expected nothing to be tracked for an existing server")
+	}
+	if repo.GetHostIP() != "vps.example.com" || repo.(SSHPortProvider).GetSSHPort() != "2222" || repo.GetSSHUsername() != "me" {
+		t.Errorf("Unexpected connection details: %s:%s %s", repo.GetHostIP(), repo.(SSHPortProvider).GetSSHPort(), repo.GetSSHUsername())
+	}
+	if string(repo.GetPrivateKey()) != string(server.clientKey) || repo.GetHostPublicKey() != nil {
+		t.Error("Expected the key from private_key_path and no pinned host key")
+	}
+	if ownsHost(repo) || !ownsHost(NewAWSProvider()) {
+		t.Error("Only the hosts created by sockv5er are owned")
+	}
+}
+
+func TestCleanupOnlyShutsDownOwnedHosts(t *testing.T) {
+	server := startTestSSHServer(t)
+	config := server.sshConfig()
+	config.cleanup()
+	server.mu.Lock()
+	commands := append([]string(nil), server.commands...)
+	server.mu.Unlock()
+	if len(commands) != 0 {
+		t.Errorf("Expected no commands on a host which isn't owned, got: %v", commands)
+	}
+	config.ShutdownOnCleanup = true
+	config.cleanup()
+	server.mu.Lock()
+	commands = append([]string(nil), server.commands...)
+	server.mu.Unlock()
+	if len(commands) != 1 || commands[0] != "sudo shutdown now" {
+		t.Errorf("Expected the owned host to be shut down, got: %v", commands)
+	}
+}
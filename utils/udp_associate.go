@@ -0,0 +1,482 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	udpRelayFilepath = "/usr/local/bin/sockv5er-udp-relay"
+	udpRelayPort     = 1081
+	// udpRelayIdleSeconds only cleans up after clients which vanished, sockv5er closes idle associations itself.
+	udpRelayIdleSeconds = 900
+)
+
+// udpRelayScript runs on the instance and sends the datagrams it receives over tcp as udp, and the replies back.
+// Every tcp connection is one association. A frame is a 2 byte length followed by the address in the
+// socksv5 format (ATYP, address, port) and the payload. It runs with python 2 and 3.
+const udpRelayScript = `import select
+import socket
+import struct
+import threading
+
+LISTEN = ("127.0.0.1", %d)
+IDLE_SECONDS = %d
+
+
+def parse_address(body):
+    atyp = ord(body[0:1])
+    if atyp == 1:
+        return socket.AF_INET, (socket.inet_ntoa(body[1:5]), struct.unpack("!H", body[5:7])[0]), body[7:]
+    if atyp == 4:
+        host = socket.inet_ntop(socket.AF_INET6, body[1:17])
+        return socket.AF_INET6, (host, struct.unpack("!H", body[17:19])[0]), body[19:]
+    if atyp == 3:
+        length = ord(body[1:2])
+        host = body[2:2 + length].decode("idna")
+        port = struct.unpack("!H", body[2 + length:4 + length])[0]
+        family, _, _, _, address = socket.getaddrinfo(host, port, 0, socket.SOCK_DGRAM)[0]
+        return family, address, body[4 + length:]
+    raise ValueError("unknown address type")
+
+
+def format_address(family, address):
+    if family == socket.AF_INET6:
+        return b"\x04" + socket.inet_pton(socket.AF_INET6, address[0]) + struct.pack("!H", address[1])
+    return b"\x01" + socket.inet_aton(address[0]) + struct.pack("!H", address[1])
+
+
+def serve(conn):
+    sockets = {}
+    buffered = b""
+    try:
+        while True:
+            readable, _, _ = select.select([conn] + list(sockets.values()), [], [], IDLE_SECONDS)
+            if not readable:
+                return
+            for sock in readable:
+                if sock is conn:
+                    data = conn.recv(65536)
+                    if not data:
+                        return
+                    buffered += data
+                    while len(buffered) >= 2:
+                        length = struct.unpack("!H", buffered[:2])[0]
+                        if len(buffered) < 2 + length:
+                            break
+                        body, buffered = buffered[2:2 + length], buffered[2 + length:]
+                        try:
+                            family, address, payload = parse_address(body)
+                            if family not in sockets:
+                                sockets[family] = socket.socket(family, socket.SOCK_DGRAM)
+                            sockets[family].sendto(payload, address)
+                        except (ValueError, IndexError, struct.error, socket.error):
+                            continue
+                else:
+                    payload, address = sock.recvfrom(65535)
+                    frame = format_address(sock.family, address) + payload
+                    conn.sendall(struct.pack("!H", len(frame)) + frame)
+    except socket.error:
+        return
+    finally:
+        conn.close()
+        for sock in sockets.values():
+            sock.close()
+
+
+server = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+server.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+server.bind(LISTEN)
+server.listen(16)
+while True:
+    conn, _ = server.accept()
+    thread = threading.Thread(target=serve, args=(conn,))
+    thread.daemon = True
+    thread.start()
+`
+
+var udpRelayAddress = net.JoinHostPort("127.0.0.1", strconv.Itoa(udpRelayPort))
+
+func udpRelayFiles() []cloudConfigFile {
+	return []cloudConfigFile{{
+		Path:        udpRelayFilepath,
+		Permissions: "0755",
+		Content:     fmt.Sprintf(udpRelayScript, udpRelayPort, udpRelayIdleSeconds),
+	}}
+}
+
+func udpRelayCommands() []string {
+	// Amazon Linux 2 may only have python 2.
+	return []string{
+		fmt.Sprintf("systemd-run --unit sockv5er-udp-relay $(command -v python3 || command -v python) %s", udpRelayFilepath),
+	}
+}
+
+// Reply codes of the socksv5 protocol (RFC 1928 section 6).
+const (
+	socksSucceeded     = 0
+	socksServerFailure = 1
+	socksHostFailure   = 4
+)
+
+// UDPAssociator serves the socksv5 UDP ASSOCIATE requests. go-socks5 only handles CONNECT, so the associator takes
+// over the control connection during the rule check and relays the datagrams through the tunnel to the relay on
+// the instance. The routing rules apply to every datagram like they do to CONNECT.
+type UDPAssociator struct {
+	Tunnel    func(network, addr string) (net.Conn, error)
+	RelayAddr string
+	// Route decides whether a datagram goes through the tunnel, direct or is dropped. Everything goes through the
+	// tunnel when it's nil.
+	Route func(ctx context.Context, dest Destination) RouteAction
+	// IdleTimeout ends associations without datagrams in either direction. Zero keeps them until the client disconnects.
+	IdleTimeout time.Duration
+	// conns are the accepted socksv5 connections by the address of the client.
+	conns sync.Map
+}
+
+// Listen tracks the connections accepted by listener, so that associate requests can find theirs.
+func (u *UDPAssociator) Listen(listener net.Listener) net.Listener {
+	return &associateListener{Listener: listener, u: u}
+}
+
+// Rules wraps the rules of the socksv5 server, serving the associate requests instead of passing them on.
+func (u *UDPAssociator) Rules(next socks5.RuleSet) socks5.RuleSet {
+	return &associateRules{next: next, u: u}
+}
+
+type associateListener struct {
+	net.Listener
+	u *UDPAssociator
+}
+
+func (l *associateListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.u.conns.Store(conn.RemoteAddr().String(), conn)
+	return &associateConn{Conn: conn, u: l.u}, nil
+}
+
+type associateConn struct {
+	net.Conn
+	u *UDPAssociator
+}
+
+func (c *associateConn) Close() error {
+	c.u.conns.Delete(c.RemoteAddr().String())
+	return c.Conn.Close()
+}
+
+type associateRules struct {
+	next socks5.RuleSet
+	u    *UDPAssociator
+}
+
+func (r *associateRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.AssociateCommand {
+		if r.next == nil {
+			return ctx, true
+		}
+		return r.next.Allow(ctx, req)
+	}
+	if req.RemoteAddr == nil {
+		return ctx, false
+	}
+	control, found := r.u.conns.Load(net.JoinHostPort(req.RemoteAddr.IP.String(), strconv.Itoa(req.RemoteAddr.Port)))
+	if !found {
+		return ctx, false
+	}
+	err := r.u.serve(control.(net.Conn))
+	if err != nil {
+		log.Debugf("UDP association of `%s` failed with error: %s\n", req.RemoteAddr, err)
+	}
+	// The association is over and its connection closed, go-socks5's rejection can't reach the client anymore.
+	return ctx, false
+}
+
+// serve relays the datagrams of the client until the control connection closes or the association is idle.
+func (u *UDPAssociator) serve(control net.Conn) error {
+	defer control.Close()
+	clientIP := control.RemoteAddr().(*net.TCPAddr).IP
+	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: control.LocalAddr().(*net.TCPAddr).IP})
+	if err != nil {
+		_ = writeSocksReply(control, socksServerFailure, nil)
+		return err
+	}
+	defer packetConn.Close()
+	tunnel, err := u.Tunnel("tcp", u.RelayAddr)
+	if err != nil {
+		_ = writeSocksReply(control, socksHostFailure, nil)
+		return fmt.Errorf("connecting to the udp relay failed: %w", err)
+	}
+	defer tunnel.Close()
+	err = writeSocksReply(control, socksSucceeded, packetConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return err
+	}
+	log.Debugf("UDP association of `%s` started on `%s`.\n", control.RemoteAddr(), packetConn.LocalAddr())
+
+	association := &udpAssociation{
+		clientIP:   clientIP,
+		packetConn: packetConn,
+		tunnel:     tunnel,
+		route:      u.Route,
+		routes:     map[string]RouteAction{},
+	}
+	defer association.closeDirect()
+	association.touch()
+	done := make(chan struct{}, 3)
+	go func() {
+		// The client ends the association by closing the control connection.
+		_, _ = io.Copy(io.Discard, control)
+		done <- struct{}{}
+	}()
+	go func() {
+		association.clientToTunnel()
+		done <- struct{}{}
+	}()
+	go func() {
+		association.tunnelToClient()
+		done <- struct{}{}
+	}()
+	var idle <-chan time.Time
+	if u.IdleTimeout > 0 {
+		ticker := time.NewTicker(u.IdleTimeout / 4)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-idle:
+			if association.idleFor() > u.IdleTimeout {
+				log.Debugf("UDP association of `%s` was idle for %s, closing it.\n", control.RemoteAddr(), u.IdleTimeout)
+				return nil
+			}
+		}
+	}
+}
+
+type udpAssociation struct {
+	clientIP   net.IP
+	packetConn *net.UDPConn
+	tunnel     net.Conn
+	route      func(ctx context.Context, dest Destination) RouteAction
+	// routes caches the decisions by destination, only clientToTunnel uses it.
+	routes       map[string]RouteAction
+	mu           sync.Mutex
+	clientAddr   *net.UDPAddr
+	direct       *net.UDPConn
+	lastActivity atomic.Int64
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (a *udpAssociation) idleFor() time.Duration {
+	return time.Since(time.Unix(0, a.lastActivity.Load()))
+}
+
+// clientToTunnel frames the datagrams of the client for the relay, or sends them direct or drops them as the routing
+// rules say. Fragments aren't supported and are dropped.
+func (a *udpAssociation) clientToTunnel() {
+	datagram := make([]byte, 65535)
+	for {
+		n, from, err := a.packetConn.ReadFromUDP(datagram)
+		if err != nil {
+			return
+		}
+		// Only the client which asked for the association may use it.
+		if !from.IP.Equal(a.clientIP) || n < 4 || datagram[2] != 0 {
+			continue
+		}
+		a.mu.Lock()
+		a.clientAddr = from
+		a.mu.Unlock()
+		a.touch()
+		dest, payload, err := parseUDPDestination(datagram[3:n])
+		if err != nil {
+			continue
+		}
+		switch a.decide(dest) {
+		case RouteReject:
+			continue
+		case RouteDirect:
+			a.sendDirect(dest, payload)
+		default:
+			err = writeUDPFrame(a.tunnel, datagram[3:n])
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (a *udpAssociation) decide(dest Destination) RouteAction {
+	if a.route == nil {
+		return RouteTunnel
+	}
+	action, found := a.routes[dest.String()]
+	if !found {
+		action = a.route(context.Background(), dest)
+		a.routes[dest.String()] = action
+	}
+	return action
+}
+
+// sendDirect sends the payload from a socket of its own, whose replies go back to the client like those of the relay.
+func (a *udpAssociation) sendDirect(dest Destination, payload []byte) {
+	host := dest.Host
+	if dest.IP != nil {
+		host = dest.IP.String()
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(dest.Port)))
+	if err != nil {
+		log.Debugf("Resolving `%s` for a direct datagram failed with error: %s\n", dest, err)
+		return
+	}
+	a.mu.Lock()
+	if a.direct == nil {
+		a.direct, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			a.mu.Unlock()
+			log.Debugf("Opening the socket for direct datagrams failed with error: %s\n", err)
+			return
+		}
+		go a.directToClient(a.direct)
+	}
+	direct := a.direct
+	a.mu.Unlock()
+	_, _ = direct.WriteToUDP(payload, addr)
+}
+
+// directToClient sends the replies to the direct datagrams to the client with the socksv5 UDP header.
+func (a *udpAssociation) directToClient(direct *net.UDPConn) {
+	reply := make([]byte, 65535)
+	for {
+		n, from, err := direct.ReadFromUDP(reply)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+		a.touch()
+		header := appendSocksAddr([]byte{0, 0, 0}, from.IP, from.Port)
+		_, _ = a.packetConn.WriteToUDP(append(header, reply[:n]...), clientAddr)
+	}
+}
+
+func (a *udpAssociation) closeDirect() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.direct != nil {
+		_ = a.direct.Close()
+	}
+}
+
+// tunnelToClient sends the replies from the relay to the client with the socksv5 UDP header.
+func (a *udpAssociation) tunnelToClient() {
+	for {
+		body, err := readUDPFrame(a.tunnel)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+		if clientAddr == nil {
+			continue
+		}
+		a.touch()
+		_, err = a.packetConn.WriteToUDP(append([]byte{0, 0, 0}, body...), clientAddr)
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+// parseUDPDestination splits the address in the socksv5 format (ATYP, address, port) off the payload.
+func parseUDPDestination(body []byte) (Destination, []byte, error) {
+	errShort := errors.New("datagram too short")
+	if len(body) < 1 {
+		return Destination{}, nil, errShort
+	}
+	var dest Destination
+	var rest []byte
+	switch body[0] {
+	case 1:
+		if len(body) < 7 {
+			return Destination{}, nil, errShort
+		}
+		dest.IP, rest = net.IP(body[1:5]), body[5:]
+	case 4:
+		if len(body) < 19 {
+			return Destination{}, nil, errShort
+		}
+		dest.IP, rest = net.IP(body[1:17]), body[17:]
+	case 3:
+		if len(body) < 2 || len(body) < 4+int(body[1]) {
+			return Destination{}, nil, errShort
+		}
+		dest.Host, rest = string(body[2:2+int(body[1])]), body[2+int(body[1]):]
+	default:
+		return Destination{}, nil, fmt.Errorf("unknown address type %d", body[0])
+	}
+	dest.Port = int(binary.BigEndian.Uint16(rest))
+	return dest, rest[2:], nil
+}
+
+func writeUDPFrame(w io.Writer, body []byte) error {
+	frame := make([]byte, 2+len(body))
+	binary.BigEndian.PutUint16(frame, uint16(len(body)))
+	copy(frame[2:], body)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readUDPFrame(r io.Reader) ([]byte, error) {
+	var length uint16
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return body, err
+}
+
+func writeSocksReply(w io.Writer, reply byte, addr *net.UDPAddr) error {
+	message := []byte{5, reply, 0}
+	if addr == nil {
+		message = appendSocksAddr(message, net.IPv4zero, 0)
+	} else {
+		message = appendSocksAddr(message, addr.IP, addr.Port)
+	}
+	_, err := w.Write(message)
+	return err
+}
+
+// appendSocksAddr appends the address in the socksv5 format (ATYP, address, port).
+func appendSocksAddr(b []byte, ip net.IP, port int) []byte {
+	if ip.To4() != nil {
+		b = append(append(b, 1), ip.To4()...)
+	} else {
+		b = append(append(b, 4), ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// startUDPRelay runs the relay script of the instance locally and returns its address.
+func startUDPRelay(t *testing.T) string {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is needed to run the udp relay")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	script := filepath.Join(t.TempDir(), "sockv5er-udp-relay")
+	err = os.WriteFile(script, []byte(fmt.Sprintf(udpRelayScript, port, 60)), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(python, script)
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	addr := listener.Addr().String()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The udp relay didn't start: %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func startUDPEchoServer(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buffer[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func startTestUDPSocksV5Server(t *testing.T, udp *UDPAssociator, router *Router) string {
+	conf, _ := (&SSHConfig{Router: router}).socksV5Config(udp.Tunnel, udp)
+	server, err := socks5.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() { _ = server.Serve(udp.Listen(listener)) }()
+	return listener.Addr().String()
+}
+
+// socksAssociate asks the socksv5 server at addr for a UDP association and returns its control connection and relay address.
+func socksAssociate(t *testing.T, addr string) (net.Conn, *net.UDPAddr) {
+	control, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = control.Close() })
+	_ = control.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = control.Write([]byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(control, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socksSucceeded || reply[5] != 1 {
+		t.Fatalf("The socksv5 server refused the association: %v", reply)
+	}
+	_ = control.SetDeadline(time.Time{})
+	return control, &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+}
+
+func TestUDPAssociateRelaysThroughTheTunnel(t *testing.T) {
+	relayAddr := startUDPRelay(t)
+	server := startTestSSHServer(t)
+	echoAddr := startUDPEchoServer(t)
+	sc, err := NewSupervisedClient(server.sshConfig().connectToSSH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	socksAddr := startTestUDPSocksV5Server(t, &UDPAssociator{Tunnel: sc.Dial, RelayAddr: relayAddr, IdleTimeout: time.Minute}, nil)
+	_, bindAddr := socksAssociate(t, socksAddr)
+
+	client, err := net.DialUDP("udp", nil, bindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	header := append([]byte{0, 0, 0, 1}, echoAddr.IP.To4()...)
+	header = append(header, byte(echoAddr.Port>>8), byte(echoAddr.Port))
+	_, err = client.Write(append(header, "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 1024)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:n], append(header, "ping"...)) {
+		t.Errorf("Unexpected reply through the association: %v", reply[:n])
+	}
+	dialed := server.dialed()
+	if len(dialed) != 1 || dialed[0] != relayAddr {
+		t.Errorf("Expected the datagrams to go through the tunnel to the relay, got: %v", dialed)
+	}
+}
+
+func TestUDPAssociationIdleTimeout(t *testing.T) {
+	udp := &UDPAssociator{
+		Tunnel: func(network, addr string) (net.Conn, error) {
+			relay, tunnel := net.Pipe()
+			go func() { _, _ = io.Copy(io.Discard, relay) }()
+			return tunnel, nil
+		},
+		IdleTimeout: 50 * time.Millisecond,
+	}
+	control, _ := socksAssociate(t, startTestUDPSocksV5Server(t, udp, nil))
+	_ = control.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(io.Discard, control)
+	if err != nil {
+		t.Errorf("Expected the idle association to be closed, got: %v", err)
+	}
+}
+
+// startRoutedUDPAssociation associates through a server with the rule and a tunnel which only records the
+// frames for the relay. It returns the client socket, the header of datagrams to echoAddr and the frames.
+func startRoutedUDPAssociation(t *testing.T, rule string, echoAddr *net.UDPAddr) (*net.UDPConn, []byte, chan []byte) {
+	rules, err := ParseRouteRules([]string{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan []byte, 10)
+	udp := &UDPAssociator{
+		Tunnel: func(network, addr string) (net.Conn, error) {
+			relay, tunnel := net.Pipe()
+			go func() {
+				for {
+					frame, err := readUDPFrame(relay)
+					if err != nil {
+						return
+					}
+					frames <- frame
+				}
+			}()
+			return tunnel, nil
+		},
+		IdleTimeout: time.Minute,
+	}
+	_, bindAddr := socksAssociate(t, startTestUDPSocksV5Server(t, udp, &Router{Rules: rules}))
+	client, err := net.DialUDP("udp", nil, bindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	header := appendSocksAddr([]byte{0, 0, 0}, echoAddr.IP, echoAddr.Port)
+	return client, header, frames
+}
+
+func TestUDPAssociateDropsRejectedDestinations(t *testing.T) {
+	echoAddr := startUDPEchoServer(t)
+	client, header, frames := startRoutedUDPAssociation(t, fmt.Sprintf("port:%d reject", echoAddr.Port), echoAddr)
+	_, err := client.Write(append(header, "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 1024)
+	_ = client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := client.Read(reply); err == nil {
+		t.Errorf("Expected no reply for a rejected destination, got: %v", reply[:n])
+	}
+	select {
+	case frame := <-frames:
+		t.Errorf("The datagram to a rejected destination was relayed: %v", frame)
+	default:
+	}
+}
+
+func TestUDPAssociateSendsDirectDestinationsDirect(t *testing.T) {
+	echoAddr := startUDPEchoServer(t)
+	client, header, frames := startRoutedUDPAssociation(t, "cidr:127.0.0.0/8 direct", echoAddr)
+	_, err := client.Write(append(header, "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 1024)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:n], append(header, "ping"...)) {
+		t.Errorf("Unexpected reply of the direct destination: %v", reply[:n])
+	}
+	select {
+	case frame := <-frames:
+		t.Errorf("The datagram to a direct destination was relayed: %v", frame)
+	default:
+	}
+}
@@ -1,12 +1,17 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"github.com/jedib0t/go-pretty/v6/table"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func showIntro() {
@@ -28,21 +33,49 @@ type SocksV5Er struct {
 	repo     CloudProvider
 }
 
-func showRegionsOptions(countryOptions []map[string]string) {
+// showRegionsOptions lists the regions, the city and latency columns are only shown when the provider tells them.
+func showRegionsOptions(regions []Region) {
+	showCity, showLatency := false, false
+	for _, region := range regions {
+		showCity = showCity || region.City != ""
+		showLatency = showLatency || region.Latency > 0
+	}
 	t := table.NewWriter()
 	t.SetOutputMirror(os.Stdout)
-	t.AppendHeader(table.Row{"#", "Country", "Region"})
-	for i := range countryOptions {
-		t.AppendRows([]table.Row{{i + 1, countryOptions[i]["country"], countryOptions[i]["Region"]}})
+	header := table.Row{"#", "Country"}
+	if showCity {
+		header = append(header, "City")
+	}
+	header = append(header, "Region")
+	if showLatency {
+		header = append(header, "Latency")
+	}
+	t.AppendHeader(header)
+	for i, region := range regions {
+		row := table.Row{i + 1, region.Country}
+		if showCity {
+			row = append(row, region.City)
+		}
+		row = append(row, region.ID)
+		if showLatency {
+			row = append(row, formatLatency(region.Latency))
+		}
+		t.AppendRow(row)
 		t.AppendSeparator()
 	}
 	t.Render()
 }
 
-func getRegionFromUserInput(countryOptions []map[string]string, selection int) (string, error) {
+func formatLatency(latency time.Duration) string {
+	if latency <= 0 {
+		return ""
+	}
+	return latency.Round(time.Millisecond).String()
+}
+
+func getRegionFromUserInput(regions []Region, selection int) (string, error) {
 	regionID := selection - 1
-	region := countryOptions[regionID]["Region"]
-	return region, nil
+	return regions[regionID].ID, nil
 }
 
 func getUserInput(numberOfRegions int, in *os.File) int {
@@ -66,16 +99,236 @@ func getUserInput(numberOfRegions int, in *os.File) int {
 	return regionID
 }
 
-func (s *SocksV5Er) createSocksV5Tunnel() {
+func (s *SocksV5Er) createSocksV5Tunnel() error {
 	config := SSHConfig{}
 	config.PrivateKey = s.repo.GetPrivateKey()
 	config.KnownHostsFilepath = s.settings.SSHKnownHostsPath
 	config.SSHUsername = s.settings.SSHUserName
+	if config.SSHUsername == "" {
+		config.SSHUsername = s.repo.GetSSHUsername()
+	}
 	config.SSHHost = s.repo.GetHostIP()
 	config.SSHPort = s.settings.SSHPort
+	if portProvider, ok := s.repo.(SSHPortProvider); ok {
+		config.SSHPort = portProvider.GetSSHPort()
+	}
 	config.SocksV5IP = s.settings.SocksV5Host
 	config.SocksV5Port = s.settings.SocksV5Port
-	config.StartSocksV5Server()
+	config.HTTPProxyPort = s.settings.HTTPProxyPort
+	config.PACPort = s.settings.PACPort
+	config.ConfigFilepath = s.settings.ConfigFilepath
+	config.HostPublicKey = s.repo.GetHostPublicKey()
+	config.UpdateKnownHosts = s.settings.SSHUpdateKnownHosts
+	config.ShutdownOnCleanup = ownsHost(s.repo)
+	if config.ShutdownOnCleanup {
+		config.HeartbeatInterval = HeartbeatInterval(s.settings.InstanceGracePeriod)
+	}
+	config.KeepaliveInterval = s.settings.SSHKeepaliveInterval
+	pacRules, err := ParsePACRules(s.settings.PACRules)
+	if err != nil {
+		return err
+	}
+	config.PACRules = pacRules
+	router, err := NewRouter(s.settings)
+	if err != nil {
+		return err
+	}
+	config.Router = router
+	config.DNSUpstream = s.settings.DNSUpstream
+	config.UDPIdleTimeout = s.settings.UDPIdleTimeout
+	credentials, err := LoadSocksV5Credentials(s.settings)
+	if err != nil {
+		return err
+	}
+	if credentials != nil {
+		config.Credentials = credentials
+	}
+	return config.StartSocksV5Server()
+}
+
+// ownsHost tells whether the host of the provider was created by sockv5er, which is the case unless the provider says otherwise.
+func ownsHost(repo CloudProvider) bool {
+	if owner, ok := repo.(HostOwner); ok {
+		return owner.OwnsHost()
+	}
+	return true
+}
+
+// trackerFilepath returns the path of an existing resources.yaml, or an empty string if there is none.
+func trackerFilepath(settings *Settings) string {
+	resourcesFilepath := settings.TrackingFilepath
+	if resourcesFilepath == "" {
+		var resourcesTrackerFlag bool
+		resourcesTrackerFlag, resourcesFilepath = CheckIfResourcesYAMLExistsAndReturnPath()
+		if !resourcesTrackerFlag {
+			return ""
+		}
+	}
+	if _, err := os.Stat(resourcesFilepath); err != nil {
+		return ""
+	}
+	return resourcesFilepath
+}
+
+// newSocksV5Er wires up the settings, the resources tracker and the cloud provider.
+// The tracker file is created if it doesn't exist yet; the returned flag tells whether it existed before.
+func newSocksV5Er(settings *Settings) (*SocksV5Er, bool, error) {
+	s := &SocksV5Er{settings: settings}
+	repo, err := NewCloudProvider(settings.Provider)
+	if err != nil {
+		return nil, false, err
+	}
+	s.repo = repo
+	resourcesFilepath := trackerFilepath(settings)
+	resourcesTrackerFlag := resourcesFilepath != ""
+	if !resourcesTrackerFlag {
+		//	Creating the tracker file
+		resourcesFilepath = settings.TrackingFilepath
+		if resourcesFilepath == "" {
+			resourcesFilepath = filepath.Join(CreateSockV5erDirectory(), "resources.yaml")
+		}
+		file, err := os.Create(resourcesFilepath)
+		if err != nil {
+			return nil, false, err
+		}
+		_ = file.Close()
+	}
+	s.settings.TrackingFilepath = resourcesFilepath
+	s.tracker = GetNewTracker(resourcesFilepath)
+	err = s.repo.Initialize(context.Background(), s.settings)
+	if err != nil {
+		return nil, false, err
+	}
+	return s, resourcesTrackerFlag, nil
+}
+
+// deleteTrackedResources deletes the resources listed in resources.yaml which include selects, each with the
+// provider which created it. It keeps going when a deletion fails and returns the number of failures.
+func (s *SocksV5Er) deleteTrackedResources(ctx context.Context, include func(TrackedResource) bool) (int, error) {
+	err := s.tracker.ReadResourcesFile()
+	if err != nil {
+		return 0, err
+	}
+	resources := make([]TrackedResource, 0)
+	for _, resource := range s.tracker.TrackedResources() {
+		if include(resource) {
+			resources = append(resources, resource)
+		}
+	}
+	return s.deleteResources(ctx, resources), nil
+}
+
+// ofSession selects the resources of the named session.
+func ofSession(name string) func(TrackedResource) bool {
+	return func(resource TrackedResource) bool {
+		return resource.SessionName() == name
+	}
+}
+
+// ofStoppedSessions selects the resources of the sessions which aren't among the running ones.
+func ofStoppedSessions(running map[string]int) func(TrackedResource) bool {
+	return func(resource TrackedResource) bool {
+		_, found := running[resource.SessionName()]
+		return !found
+	}
+}
+
+// deleteResources deletes the resources region by region, one after the other within a region and up to
+// maxConcurrentRegions regions at the same time. It reports the progress per region, lists the resources which
+// couldn't be deleted by region and returns their number.
+func (s *SocksV5Er) deleteResources(ctx context.Context, resources []TrackedResource) int {
+	var regions []string
+	byRegion := map[string][]int{}
+	for i, resource := range resources {
+		if _, found := byRegion[resource.Region()]; !found {
+			regions = append(regions, resource.Region())
+		}
+		byRegion[resource.Region()] = append(byRegion[resource.Region()], i)
+	}
+	errs := make([]error, len(resources))
+	forEachConcurrently(len(regions), maxConcurrentRegions, func(r int) {
+		region := regions[r]
+		fmt.Printf("[%s] Deleting %d tracked resources.\n", region, len(byRegion[region]))
+		deleted := 0
+		for _, i := range byRegion[region] {
+			errs[i] = s.deleteTrackedResource(ctx, resources[i])
+			if errs[i] != nil {
+				fmt.Printf("[%s] Deleting the %s resources failed with error: %s\n", region, resources[i].Kind, errs[i])
+			} else {
+				deleted++
+			}
+		}
+		fmt.Printf("[%s] Deleted %d of %d tracked resources.\n", region, deleted, len(byRegion[region]))
+	})
+	failures := 0
+	for i, resource := range resources {
+		if errs[i] != nil {
+			failures++
+			fmt.Printf(
+				"Couldn't delete atleast one resource. Please delete the resources manually.\n. Provider: %s\nRegion: %s\n%s\n",
+				resource.Kind,
+				resource.Region(),
+				strings.Join(resource.Describe(), "\n"),
+			)
+		}
+	}
+	return failures
+}
+
+func (s *SocksV5Er) deleteTrackedResource(ctx context.Context, resource TrackedResource) error {
+	repo, err := NewCloudProvider(resource.Kind)
+	if err != nil {
+		return err
+	}
+	err = repo.Initialize(ctx, s.settings)
+	if err != nil {
+		return err
+	}
+	repo.PrepareResourcesForDeletion(resource)
+	s.tracker.SetStatus(resource, StatusDeleting)
+	// Removes the resource from resources.yaml once it's deleted
+	return repo.DeleteResources(ctx, resource.Region(), s.settings, s.tracker)
+}
+
+// sessionTracker is implemented by the providers which track their session in resources.yaml.
+type sessionTracker interface {
+	trackedResource() TrackedResource
+}
+
+// setSessionStatus records the status of the session the provider created in resources.yaml.
+func (s *SocksV5Er) setSessionStatus(status SessionStatus) {
+	if tracker, ok := s.repo.(sessionTracker); ok {
+		s.tracker.SetStatus(tracker.trackedResource(), status)
+	}
+}
+
+// interruptContext is cancelled on ctrl-c or SIGTERM, which stops the provider calls in flight.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// createResources creates the resources in the region. When that fails or is interrupted, whatever was created
+// so far is deleted again. Interrupting the deletion too leaves the rest in resources.yaml for `sockv5er cleanup`.
+func (s *SocksV5Er) createResources(region string) error {
+	ctx, stop := interruptContext()
+	err := s.repo.CreateResources(ctx, region, s.settings, s.tracker)
+	interrupted := ctx.Err() != nil
+	stop()
+	if err == nil {
+		s.setSessionStatus(StatusActive)
+		return nil
+	}
+	s.setSessionStatus(StatusDeleting)
+	if interrupted {
+		log.Warnf("Interrupted, deleting the resources created so far. Interrupt again to leave them.\n")
+	}
+	rollbackCtx, stopRollback := interruptContext()
+	defer stopRollback()
+	rollbackErr := s.repo.DeleteResources(rollbackCtx, region, s.settings, s.tracker)
+	if rollbackErr != nil {
+		log.Warnf("Deleting the resources created so far failed with error: %s. They are still listed in resources.yaml, delete them with `sockv5er cleanup`.\n", rollbackErr)
+	}
+	return err
 }
 
 func (s *SocksV5Er) processResourcesTrackerFile(resourcesFilepath string) {
@@ -88,33 +341,12 @@ func (s *SocksV5Er) processResourcesTrackerFile(resourcesFilepath string) {
 	if err != nil {
 		log.Fatalf("Unexpected input. %s\n", err)
 	}
-	err = s.tracker.ReadResourcesFile()
-	if err != nil {
-		log.Warnf("Reading resources.yaml file failed with error: %s\n", err)
-		return
-	}
 	if strings.ToLower(cleanFlag) == "y" {
-		// clean resources from yaml file
-		repo := NewAWSProvider()
-		resources := s.tracker.GetResources()
-		resourcesCount := len(*resources)
-		for i := 0; i < resourcesCount; i++ {
-			resource := (*resources)[0]
-			// Deleting the resource from AWSResources
-			repo.PrepareResourcesForDeletion(ToMap(&resource))
-			err := repo.DeleteResources(resource.Region, s.settings, s.tracker)
-			// Removing the resource from resources.yaml
-			if err != nil {
-				fmt.Printf(
-					"Couldn't delete atleast one resource. Please delete the resources manually.\n. Region: %s\nInstance Id: %s\nKeypair Name: %s\nSecurity Group Id: %s\n",
-					resource.Region,
-					resource.InstanceId,
-					resource.KeyPairId,
-					resource.SecurityGroupId,
-				)
-			}
-			err = s.tracker.ReadResourcesFile()
-			resources = s.tracker.GetResources()
+		ctx, stop := interruptContext()
+		defer stop()
+		_, err = s.deleteTrackedResources(ctx, ofStoppedSessions(runningSessions()))
+		if err != nil {
+			log.Warnf("Reading resources.yaml file failed with error: %s\n", err)
 		}
 	} else {
 		// proceed without cleaning
@@ -122,30 +354,26 @@ func (s *SocksV5Er) processResourcesTrackerFile(resourcesFilepath string) {
 	}
 }
 
-func StartWorker() {
-	e := ENVData{}
-	s := SocksV5Er{}
-	s.repo = NewAWSProvider()
-	s.settings = e.Read()
-	resourcesTrackerFlag, resourcesFilepath := CheckIfResourcesYAMLExistsAndReturnPath()
-	s.settings.TrackingFilepath = resourcesFilepath
-	s.tracker = GetNewTracker(resourcesFilepath)
-	err := s.repo.Initialize(s.settings)
+func showConnectionDetails(settings *Settings) {
+	fmt.Printf("All systems online. You can set up your browser/system to use the socksv5 server.\nDetails: host: %s\nport: %s\n", settings.SocksV5Host, settings.SocksV5Port)
+	if settings.HTTPProxyPort != "" {
+		fmt.Printf("HTTP proxy: http://%s\n", net.JoinHostPort(settings.SocksV5Host, settings.HTTPProxyPort))
+	}
+	if settings.PACPort != "" {
+		fmt.Printf("Proxy auto-config URL: http://%s/proxy.pac\n", net.JoinHostPort(settings.SocksV5Host, settings.PACPort))
+	}
+}
+
+func StartWorker(settings *Settings) {
+	s, resourcesTrackerFlag, err := newSocksV5Er(settings)
+	if err != nil {
+		log.Fatalf("SockV5er failed with error: %s\n", err)
+	}
 	if resourcesTrackerFlag {
-		s.processResourcesTrackerFile(resourcesFilepath)
-	} else {
-		//	Creating the tracker file
-		trackerFilepath := CreateSockV5erDirectory()
-		// Create the file
-		resourcesFilepath := filepath.Join(trackerFilepath, "resources.yaml")
-		file, err := os.Create(resourcesFilepath)
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
+		s.processResourcesTrackerFile(s.settings.TrackingFilepath)
 	}
 	showIntro()
-	countryOptions := s.repo.GetRegions(s.settings)
+	countryOptions := s.repo.GetRegions(context.Background(), s.settings)
 	showRegionsOptions(countryOptions)
 	selection := getUserInput(len(countryOptions), nil)
 	region, err := getRegionFromUserInput(countryOptions, selection)
@@ -153,16 +381,22 @@ func StartWorker() {
 		log.Fatalf("SockV5er failed with error: %s\n", err)
 	}
 	fmt.Printf("Selected Region: %s\n", region)
-
+	err = s.createResources(region)
 	if err != nil {
 		log.Fatalf("Exiting program, please submit a bug report at: https://github.com/platput/sockv5er for the error: %s", err)
 	}
-	err = s.repo.CreateResources(region, s.settings, s.tracker)
+	log.Infoln("Created all the resources required to start the socksv5 server")
+	showConnectionDetails(s.settings)
+	err = s.createSocksV5Tunnel()
+	// The resources of the session are deleted like `up` does, the other sessions are left running with theirs.
+	failures, cleanupErr := deleteTrackedResourcesUntilInterrupted(s, ofSession(defaultSessionName))
 	if err != nil {
-		log.Fatalf("Exiting program, please submit a bug report at: https://github.com/platput/sockv5er for the error: %s", err)
+		log.Fatalf("SockV5er failed with error: %s\n", err)
+	}
+	if cleanupErr != nil {
+		log.Fatalf("Reading resources.yaml file failed with error: %s\n", cleanupErr)
+	}
+	if failures > 0 {
+		log.Fatalf("%d sessions couldn't be deleted, delete them with `sockv5er cleanup`.\n", failures)
 	}
-	log.Infoln("Created all the resources required to start the socksv5 server")
-	s.createSocksV5Tunnel()
-	log.Infoln("Started the socksv5 server. ")
-	fmt.Printf("All systems online. You can set up your browser/system to use the socksv5 server.\nDetails: host: %s\nport: %s\n", s.settings.SocksV5Host, s.settings.SocksV5Port)
 }
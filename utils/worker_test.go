@@ -3,16 +3,15 @@ package utils
 import (
 	log "github.com/sirupsen/logrus"
 	"io"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestGetRegionFromUserInput(t *testing.T) {
-	countryOptions := make([]map[string]string, 0)
-	countryOption := make(map[string]string)
-	countryOption["Region"] = "us-west-1"
-	countryOption["country"] = "USA"
-	countryOptions = append(countryOptions, countryOption)
+	countryOptions := []Region{{ID: "us-west-1", Country: "USA"}}
 	want := "us-west-1"
 	got, err := getRegionFromUserInput(countryOptions, 1)
 	if err != nil || want != got {
@@ -52,3 +51,25 @@ func TestGetUserInput(t *testing.T) {
 		t.Error("Unexpected output for getUserInput")
 	}
 }
+
+func TestCreateResourcesRollsBackOnFailure(t *testing.T) {
+	// Nothing answers on the published port, so the container never becomes ready.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	runtime := &fakeContainerRuntime{addr: listener.Addr().String(), running: map[string]bool{}, copied: map[string]string{}}
+	s := &SocksV5Er{
+		settings: &Settings{},
+		tracker:  GetNewTracker(filepath.Join(t.TempDir(), "resources.yaml")),
+		repo:     &LocalContainerRepository{Runtime: "docker", run: runtime.run, readyTimeout: 100 * time.Millisecond},
+	}
+	err = s.createResources(localContainerRegion)
+	if err == nil {
+		t.Fatal("Expected the creation to fail")
+	}
+	if len(runtime.running) != 0 || len(s.tracker.TrackedResources()) != 0 {
+		t.Error("The resources created before the failure weren't deleted")
+	}
+}